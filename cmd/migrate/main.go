@@ -0,0 +1,104 @@
+// Command migrate applies the versioned SQL migrations of a directory to the
+// database configured by the DB_* environment variables.
+//
+//	migrate -dir ./migrations up
+//	migrate -dir ./migrations down [N]
+//	migrate -dir ./migrations to VERSION
+//	migrate -dir ./migrations status
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/bitrise-io/api-utils/database"
+	"github.com/pkg/errors"
+)
+
+func main() {
+	dir := flag.String("dir", "migrations", "directory of the migration files")
+	table := flag.String("table", "", "table of the applied migrations (default schema_migrations)")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] up | down [N] | to VERSION | status\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if err := run(*dir, *table, flag.Args()); err != nil {
+		fmt.Fprintf(os.Stderr, "%+v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(dir, table string, args []string) error {
+	if len(args) < 1 {
+		flag.Usage()
+		return errors.New("No command specified")
+	}
+
+	migrations, err := database.LoadMigrationsFromDir(dir)
+	if err != nil {
+		return err
+	}
+	conn, err := database.NewConnection(database.PostgresDatabase{}, true)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := conn.Close(); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to close connection: %s\n", err)
+		}
+	}()
+
+	ctx := context.Background()
+	migrator := database.NewMigrator(conn, migrations, database.MigratorConfig{TableName: table})
+	switch args[0] {
+	case "up":
+		return migrator.Up(ctx)
+	case "down":
+		n := 1
+		if len(args) > 1 {
+			if n, err = strconv.Atoi(args[1]); err != nil || n < 1 {
+				return errors.Errorf("Invalid number of migrations: %s", args[1])
+			}
+		}
+		return migrator.Down(ctx, n)
+	case "to":
+		if len(args) < 2 {
+			return errors.New("No version specified")
+		}
+		version, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return errors.Errorf("Invalid version: %s", args[1])
+		}
+		return migrator.To(ctx, version)
+	case "status":
+		statuses, err := migrator.Status(ctx)
+		if err != nil {
+			return err
+		}
+		return printStatus(statuses)
+	}
+	flag.Usage()
+	return errors.Errorf("Unknown command: %s", args[0])
+}
+
+func printStatus(statuses []database.MigrationStatus) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED AT\tSTATE")
+	for _, status := range statuses {
+		appliedAt, state := "-", "pending"
+		if status.Applied {
+			appliedAt, state = status.AppliedAt.Format("2006-01-02 15:04:05"), "applied"
+		}
+		if status.Drifted {
+			state = "drifted"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", status.Version, status.Name, appliedAt, state)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,94 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"hash/fnv"
+
+	"github.com/bitrise-io/api-utils/logging"
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// AdvisoryLockFunc runs while the lock is held. conn is the session holding the
+// lock, it's only needed for work which has to run in the same session.
+type AdvisoryLockFunc func(ctx context.Context, conn *sql.Conn) error
+
+// AdvisoryLockKey hashes a name, e.g. "reports:daily", into an advisory lock key
+func AdvisoryLockKey(name string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	return int64(h.Sum64())
+}
+
+// WithAdvisoryLock waits for the session-level advisory lock, runs fn and releases the
+// lock. The lock is held on a dedicated connection, so it can't leak to other users of
+// the pool. Waiting is stopped when the context is cancelled.
+func (c *Connection) WithAdvisoryLock(ctx context.Context, key int64, fn AdvisoryLockFunc) error {
+	_, err := c.withAdvisoryLock(ctx, key, false, fn)
+	return err
+}
+
+// TryAdvisoryLock runs fn if the session-level advisory lock is free, and reports
+// whether it was acquired
+func (c *Connection) TryAdvisoryLock(ctx context.Context, key int64, fn AdvisoryLockFunc) (bool, error) {
+	return c.withAdvisoryLock(ctx, key, true, fn)
+}
+
+func (c *Connection) withAdvisoryLock(ctx context.Context, key int64, try bool, fn AdvisoryLockFunc) (bool, error) {
+	conn, err := c.db.DB().Conn(ctx)
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	defer closeConn(conn)
+
+	release := func() {
+		// not with ctx, the lock has to be released even if it's cancelled. If this fails
+		// the connection is broken, and the lock went away with the session.
+		if _, err := conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", key); err != nil {
+			logging.WithContext(ctx).Error("Failed to release advisory lock", zap.Int64("key", key), zap.Error(err))
+		}
+	}
+
+	if try {
+		var locked bool
+		if err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", key).Scan(&locked); err != nil {
+			return false, errors.Wrap(err, "Failed to acquire advisory lock")
+		}
+		if !locked {
+			return false, nil
+		}
+	} else if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", key); err != nil {
+		if ctx.Err() != nil {
+			// the lock could have been granted before the wait was cancelled, it can't
+			// stay with the session when the connection goes back to the pool
+			release()
+		}
+		return false, errors.Wrap(err, "Failed to acquire advisory lock")
+	}
+	defer release()
+
+	return true, fn(ctx, conn)
+}
+
+// TxAdvisoryLock waits for the transaction-level advisory lock, it's released when
+// the transaction ends. Waiting is stopped when the transaction's context is cancelled.
+func TxAdvisoryLock(tx *gorm.DB, key int64) error {
+	if err := tx.Exec("SELECT pg_advisory_xact_lock(?)", key).Error; err != nil {
+		return errors.Wrap(err, "Failed to acquire advisory lock")
+	}
+	return nil
+}
+
+// TryTxAdvisoryLock acquires the transaction-level advisory lock if it's free, and
+// reports whether it was acquired
+func TryTxAdvisoryLock(tx *gorm.DB, key int64) (bool, error) {
+	var result struct {
+		Locked bool
+	}
+	if err := tx.Raw("SELECT pg_try_advisory_xact_lock(?) AS locked", key).Scan(&result).Error; err != nil {
+		return false, errors.Wrap(err, "Failed to acquire advisory lock")
+	}
+	return result.Locked, nil
+}
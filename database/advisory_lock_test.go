@@ -0,0 +1,103 @@
+package database_test
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bitrise-io/api-utils/database"
+	"github.com/bitrise-io/api-utils/database/databasetest"
+)
+
+func Test_AdvisoryLockKey(t *testing.T) {
+	require.Equal(t, database.AdvisoryLockKey("reports:daily"), database.AdvisoryLockKey("reports:daily"))
+	require.NotEqual(t, database.AdvisoryLockKey("reports:daily"), database.AdvisoryLockKey("reports:weekly"))
+}
+
+func Test_AdvisoryLock(t *testing.T) {
+	testDB := databasetest.New(t, databasetest.Config{Schema: true})
+	conn := testDB.Connection()
+	ctx := context.Background()
+	key := database.AdvisoryLockKey(t.Name())
+
+	t.Log("ok - session lock is exclusive and released on return")
+	{
+		err := conn.WithAdvisoryLock(ctx, key, func(ctx context.Context, _ *sql.Conn) error {
+			locked, err := conn.TryAdvisoryLock(ctx, key, func(context.Context, *sql.Conn) error {
+				t.Fatal("lock acquired twice")
+				return nil
+			})
+			require.NoError(t, err)
+			require.False(t, locked)
+			return nil
+		})
+		require.NoError(t, err)
+
+		locked, err := conn.TryAdvisoryLock(ctx, key, func(context.Context, *sql.Conn) error { return nil })
+		require.NoError(t, err)
+		require.True(t, locked)
+	}
+	t.Log("ok - transaction lock is released with the transaction")
+	{
+		err := conn.WithTransaction(ctx, nil, func(ctx context.Context, tx *gorm.DB) error {
+			require.NoError(t, database.TxAdvisoryLock(tx, key))
+			locked, err := conn.TryAdvisoryLock(ctx, key, func(context.Context, *sql.Conn) error { return nil })
+			require.NoError(t, err)
+			require.False(t, locked)
+			return nil
+		})
+		require.NoError(t, err)
+
+		err = conn.WithTransaction(ctx, nil, func(ctx context.Context, tx *gorm.DB) error {
+			locked, err := database.TryTxAdvisoryLock(tx, key)
+			require.NoError(t, err)
+			require.True(t, locked)
+			return nil
+		})
+		require.NoError(t, err)
+	}
+	t.Log("error - cancelled while waiting")
+	{
+		err := conn.WithAdvisoryLock(ctx, key, func(context.Context, *sql.Conn) error {
+			cancelled, cancel := context.WithCancel(ctx)
+			defer cancel()
+			waitErr := make(chan error, 1)
+			go func() {
+				waitErr <- conn.WithAdvisoryLock(cancelled, key, func(context.Context, *sql.Conn) error {
+					return errors.New("lock acquired twice")
+				})
+			}()
+			require.Eventually(t, func() bool {
+				return advisoryLockCount(t, conn, key, false) == 1
+			}, 5*time.Second, 10*time.Millisecond)
+
+			cancel()
+			select {
+			case err := <-waitErr:
+				require.Error(t, err)
+				require.NotEqual(t, "lock acquired twice", err.Error())
+			case <-time.After(5 * time.Second):
+				t.Fatal("waiting for the lock wasn't cancelled")
+			}
+			require.Equal(t, 0, advisoryLockCount(t, conn, key, false))
+			return nil
+		})
+		require.NoError(t, err)
+		require.Equal(t, 0, advisoryLockCount(t, conn, key, true))
+	}
+}
+
+// advisoryLockCount returns the number of granted or waiting session-level locks of the key
+func advisoryLockCount(t *testing.T, conn *database.Connection, key int64, granted bool) int {
+	var count int
+	err := conn.GetDB().DB().QueryRow(`SELECT count(*) FROM pg_locks
+		WHERE locktype = 'advisory' AND classid::bigint = $1 AND objid::bigint = $2 AND objsubid = 1 AND granted = $3`,
+		int64(uint32(key>>32)), int64(uint32(key)), granted).Scan(&count)
+	require.NoError(t, err)
+	return count
+}
@@ -0,0 +1,15 @@
+package database
+
+import "time"
+
+// ExponentialBackoff returns min doubled for every attempt after the first, up to max
+func ExponentialBackoff(min, max time.Duration, attempt int) time.Duration {
+	backoff := min
+	for i := 1; i < attempt && backoff < max; i++ {
+		backoff *= 2
+	}
+	if backoff > max {
+		backoff = max
+	}
+	return backoff
+}
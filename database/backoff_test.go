@@ -0,0 +1,17 @@
+package database_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/bitrise-io/api-utils/database"
+)
+
+func Test_ExponentialBackoff(t *testing.T) {
+	require.Equal(t, time.Second, database.ExponentialBackoff(time.Second, time.Minute, 1))
+	require.Equal(t, 4*time.Second, database.ExponentialBackoff(time.Second, time.Minute, 3))
+	require.Equal(t, time.Minute, database.ExponentialBackoff(time.Second, time.Minute, 100))
+	require.Equal(t, time.Minute, database.ExponentialBackoff(time.Second, time.Minute, 7))
+}
@@ -0,0 +1,243 @@
+package database
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bitrise-io/api-utils/logging"
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultHealthCheckInterval = 10 * time.Second
+	defaultHealthCheckTimeout  = 2 * time.Second
+	defaultPrimaryPinWindow    = 5 * time.Second
+)
+
+// ReplicaBalancing ...
+type ReplicaBalancing int
+
+const (
+	// RoundRobin picks the healthy replicas one after the other
+	RoundRobin ReplicaBalancing = iota
+	// LeastConnections picks the healthy replica with the fewest connections in use
+	LeastConnections
+)
+
+type writeTrackerKey struct{}
+
+// writeTracker records the time of the last write in a request
+type writeTracker struct {
+	lastWrite int64
+}
+
+// ClusterConfig ...
+type ClusterConfig struct {
+	Primary   PostgresDatabase
+	Replicas  []PostgresDatabase
+	Balancing ReplicaBalancing
+	// HealthCheckInterval of the replicas, defaults to 10 seconds
+	HealthCheckInterval time.Duration
+	// PrimaryPinWindow is how long the reads go to the primary after a write in
+	// the same request context, defaults to 5 seconds
+	PrimaryPinWindow time.Duration
+}
+
+type replica struct {
+	config PostgresDatabase
+	// conn is nil until the replica is reachable, it's set by the health check
+	// before healthy, so it can be used once healthy is 1
+	conn    *Connection
+	healthy int32
+}
+
+// Cluster routes the queries between the primary and the read replicas
+type Cluster struct {
+	// accessed atomically, kept first for 64-bit alignment on 32-bit platforms
+	next uint64
+
+	primary  *Connection
+	config   ClusterConfig
+	replicas []*replica
+	connect  func(psql PostgresDatabase, withDB bool) (*Connection, error)
+
+	stop    chan struct{}
+	stopped sync.WaitGroup
+}
+
+// NewCluster connects to the primary and to the replicas, and starts health
+// checking the replicas. A replica which isn't reachable is unhealthy until the
+// health check connects to it, the reads go to the primary meanwhile. The replicas
+// fall back to the DB_* environment variables except their host, which is required.
+func NewCluster(config ClusterConfig) (*Cluster, error) {
+	return newCluster(config, NewConnection)
+}
+
+func newCluster(config ClusterConfig, connect func(psql PostgresDatabase, withDB bool) (*Connection, error)) (*Cluster, error) {
+	if config.HealthCheckInterval == 0 {
+		config.HealthCheckInterval = defaultHealthCheckInterval
+	}
+	if config.PrimaryPinWindow == 0 {
+		config.PrimaryPinWindow = defaultPrimaryPinWindow
+	}
+	for i, replicaConfig := range config.Replicas {
+		// the DB_HOST fallback would be the primary
+		if replicaConfig.Host == "" {
+			return nil, errors.Errorf("No host specified for replica #%d", i)
+		}
+	}
+
+	primary, err := connect(config.Primary, true)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to connect to primary")
+	}
+	c := &Cluster{
+		primary: primary,
+		config:  config,
+		connect: connect,
+		stop:    make(chan struct{}),
+	}
+	for _, replicaConfig := range config.Replicas {
+		r := &replica{config: replicaConfig}
+		conn, err := connect(replicaConfig, true)
+		if err != nil {
+			logging.WithContext(nil).Warn("Failed to connect to database replica, reading from the primary until it's reachable",
+				zap.String("host", replicaConfig.Host), zap.Error(err))
+		} else {
+			r.conn = conn
+			r.healthy = 1
+		}
+		c.replicas = append(c.replicas, r)
+	}
+
+	if len(c.replicas) > 0 {
+		c.stopped.Add(1)
+		go c.checkReplicas()
+	}
+	return c, nil
+}
+
+// Primary ...
+func (c *Cluster) Primary() *Connection {
+	return c.primary
+}
+
+// WriteDB returns the primary, and pins the reads of the request context
+// to it for the PrimaryPinWindow
+func (c *Cluster) WriteDB(ctx context.Context) *gorm.DB {
+	if tracker, ok := ctx.Value(writeTrackerKey{}).(*writeTracker); ok {
+		atomic.StoreInt64(&tracker.lastWrite, time.Now().UnixNano())
+	}
+	return c.primary.WithContext(ctx)
+}
+
+// ReadDB returns a healthy replica, or the primary if there is none or if
+// there was a write in the request context within the PrimaryPinWindow
+func (c *Cluster) ReadDB(ctx context.Context) *gorm.DB {
+	if tracker, ok := ctx.Value(writeTrackerKey{}).(*writeTracker); ok {
+		lastWrite := atomic.LoadInt64(&tracker.lastWrite)
+		if lastWrite > 0 && time.Since(time.Unix(0, lastWrite)) < c.config.PrimaryPinWindow {
+			return c.primary.WithContext(ctx)
+		}
+	}
+
+	healthy := []*replica{}
+	for _, r := range c.replicas {
+		if atomic.LoadInt32(&r.healthy) == 1 {
+			healthy = append(healthy, r)
+		}
+	}
+	if len(healthy) == 0 {
+		return c.primary.WithContext(ctx)
+	}
+
+	if c.config.Balancing == LeastConnections {
+		selected := healthy[0]
+		for _, r := range healthy[1:] {
+			if r.conn.GetDB().DB().Stats().InUse < selected.conn.GetDB().DB().Stats().InUse {
+				selected = r
+			}
+		}
+		return selected.conn.WithContext(ctx)
+	}
+	next := atomic.AddUint64(&c.next, 1)
+	return healthy[next%uint64(len(healthy))].conn.WithContext(ctx)
+}
+
+// Close stops the health checks and closes every connection
+func (c *Cluster) Close() error {
+	close(c.stop)
+	c.stopped.Wait()
+
+	var closeErr error
+	for _, r := range c.replicas {
+		if r.conn == nil {
+			continue
+		}
+		if err := r.conn.Close(); err != nil {
+			closeErr = err
+		}
+	}
+	if err := c.primary.Close(); err != nil {
+		closeErr = err
+	}
+	return closeErr
+}
+
+func (c *Cluster) checkReplicas() {
+	defer c.stopped.Done()
+	ticker := time.NewTicker(c.config.HealthCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			for _, r := range c.replicas {
+				c.checkReplica(r)
+			}
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// checkReplica pings the replica, or connects to it if it wasn't reachable before
+func (c *Cluster) checkReplica(r *replica) {
+	var healthy int32 = 1
+	if r.conn == nil {
+		conn, err := c.connect(r.config, true)
+		if err != nil {
+			return
+		}
+		r.conn = conn
+	} else {
+		ctx, cancel := context.WithTimeout(context.Background(), defaultHealthCheckTimeout)
+		defer cancel()
+		if err := r.conn.GetDB().DB().PingContext(ctx); err != nil {
+			healthy = 0
+		}
+	}
+	if atomic.SwapInt32(&r.healthy, healthy) != healthy {
+		logging.WithContext(nil).Warn("Database replica health changed",
+			zap.String("host", r.config.Host), zap.Bool("healthy", healthy == 1))
+	}
+}
+
+// WithWriteTracking returns a context in which a write through Cluster.WriteDB
+// pins the following reads to the primary
+func WithWriteTracking(ctx context.Context) context.Context {
+	return context.WithValue(ctx, writeTrackerKey{}, &writeTracker{})
+}
+
+// CreateWriteTrackingMiddleware enables the write tracking for every request
+func CreateWriteTrackingMiddleware() func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			h.ServeHTTP(w, r.WithContext(WithWriteTracking(r.Context())))
+		})
+	}
+}
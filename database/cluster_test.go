@@ -0,0 +1,198 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+// testServer is a database/sql connector without a database, its connections
+// can only be pinged, which fails while it's down
+type testServer struct {
+	down int32
+}
+
+type testServerConn struct {
+	server *testServer
+}
+
+func (s *testServer) Connect(context.Context) (driver.Conn, error) {
+	if atomic.LoadInt32(&s.down) == 1 {
+		return nil, errors.New("connection refused")
+	}
+	return &testServerConn{server: s}, nil
+}
+
+func (s *testServer) Driver() driver.Driver {
+	return &pq.Driver{}
+}
+
+func (s *testServer) setDown(down bool) {
+	var value int32
+	if down {
+		value = 1
+	}
+	atomic.StoreInt32(&s.down, value)
+}
+
+func (c *testServerConn) Ping(context.Context) error {
+	if atomic.LoadInt32(&c.server.down) == 1 {
+		return driver.ErrBadConn
+	}
+	return nil
+}
+
+func (c *testServerConn) Prepare(string) (driver.Stmt, error) {
+	return nil, errors.New("not supported")
+}
+
+func (c *testServerConn) Close() error {
+	return nil
+}
+
+func (c *testServerConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("not supported")
+}
+
+// testCluster serves every host of the cluster with a testServer
+type testCluster struct {
+	servers map[string]*testServer
+
+	mu    sync.Mutex
+	hosts map[*sql.DB]string
+}
+
+func newTestCluster(hosts ...string) *testCluster {
+	c := &testCluster{servers: map[string]*testServer{}, hosts: map[*sql.DB]string{}}
+	for _, host := range hosts {
+		c.servers[host] = &testServer{}
+	}
+	return c
+}
+
+func (c *testCluster) connect(psql PostgresDatabase, withDB bool) (*Connection, error) {
+	server, ok := c.servers[psql.Host]
+	if !ok || atomic.LoadInt32(&server.down) == 1 {
+		return nil, errors.Errorf("Failed to connect to %s", psql.Host)
+	}
+	sqlDB := sql.OpenDB(server)
+	db, err := gorm.Open(dbDialect, sqlDB)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.hosts[sqlDB] = psql.Host
+	return &Connection{db: db}, nil
+}
+
+// host returns the host of the connection's server
+func (c *testCluster) host(db *gorm.DB) string {
+	sqlDB, _ := db.CommonDB().(*sql.DB)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hosts[sqlDB]
+}
+
+func Test_Cluster_ReadDB(t *testing.T) {
+	servers := newTestCluster("primary", "replica-1", "replica-2")
+	cluster, err := newCluster(ClusterConfig{
+		Primary:             PostgresDatabase{Host: "primary"},
+		Replicas:            []PostgresDatabase{{Host: "replica-1"}, {Host: "replica-2"}},
+		HealthCheckInterval: time.Hour,
+		PrimaryPinWindow:    time.Minute,
+	}, servers.connect)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, cluster.Close()) }()
+
+	t.Log("ok - reads are balanced between the replicas")
+	{
+		hosts := map[string]int{}
+		for i := 0; i < 4; i++ {
+			hosts[servers.host(cluster.ReadDB(context.Background()))]++
+		}
+		require.Equal(t, map[string]int{"replica-1": 2, "replica-2": 2}, hosts)
+	}
+	t.Log("ok - writes go to the primary and pin the reads of the context")
+	{
+		ctx := WithWriteTracking(context.Background())
+		require.NotEqual(t, "primary", servers.host(cluster.ReadDB(ctx)))
+		require.Equal(t, "primary", servers.host(cluster.WriteDB(ctx)))
+		require.Equal(t, "primary", servers.host(cluster.ReadDB(ctx)))
+		require.NotEqual(t, "primary", servers.host(cluster.ReadDB(context.Background())))
+	}
+	t.Log("ok - unhealthy replicas are skipped")
+	{
+		servers.servers["replica-1"].setDown(true)
+		for _, r := range cluster.replicas {
+			cluster.checkReplica(r)
+		}
+		for i := 0; i < 3; i++ {
+			require.Equal(t, "replica-2", servers.host(cluster.ReadDB(context.Background())))
+		}
+	}
+	t.Log("ok - reads fall back to the primary without healthy replicas")
+	{
+		servers.servers["replica-2"].setDown(true)
+		for _, r := range cluster.replicas {
+			cluster.checkReplica(r)
+		}
+		require.Equal(t, "primary", servers.host(cluster.ReadDB(context.Background())))
+	}
+	t.Log("ok - recovered replicas are used again")
+	{
+		servers.servers["replica-1"].setDown(false)
+		for _, r := range cluster.replicas {
+			cluster.checkReplica(r)
+		}
+		require.Equal(t, "replica-1", servers.host(cluster.ReadDB(context.Background())))
+	}
+}
+
+func Test_NewCluster(t *testing.T) {
+	t.Log("ok - unreachable replica is connected by the health check")
+	{
+		servers := newTestCluster("primary", "replica-1")
+		servers.servers["replica-1"].setDown(true)
+		cluster, err := newCluster(ClusterConfig{
+			Primary:             PostgresDatabase{Host: "primary"},
+			Replicas:            []PostgresDatabase{{Host: "replica-1"}},
+			HealthCheckInterval: 10 * time.Millisecond,
+		}, servers.connect)
+		require.NoError(t, err)
+		defer func() { require.NoError(t, cluster.Close()) }()
+		require.Equal(t, "primary", servers.host(cluster.ReadDB(context.Background())))
+
+		servers.servers["replica-1"].setDown(false)
+		require.Eventually(t, func() bool {
+			return servers.host(cluster.ReadDB(context.Background())) == "replica-1"
+		}, 5*time.Second, 10*time.Millisecond)
+	}
+	t.Log("not ok - unreachable primary")
+	{
+		servers := newTestCluster("replica-1")
+		_, err := newCluster(ClusterConfig{
+			Primary:  PostgresDatabase{Host: "primary"},
+			Replicas: []PostgresDatabase{{Host: "replica-1"}},
+		}, servers.connect)
+		require.EqualError(t, err, "Failed to connect to primary: Failed to connect to primary")
+	}
+	t.Log("not ok - replica without host")
+	{
+		servers := newTestCluster("primary", "replica-1")
+		_, err := newCluster(ClusterConfig{
+			Primary:  PostgresDatabase{Host: "primary"},
+			Replicas: []PostgresDatabase{{Host: "replica-1"}, {DBName: "app"}},
+		}, servers.connect)
+		require.EqualError(t, err, "No host specified for replica #1")
+	}
+}
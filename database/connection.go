@@ -0,0 +1,110 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"log"
+
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+// Connection owns the connection pool of a database, a process can hold
+// multiple ones, e.g. to the main and to the analytics database
+type Connection struct {
+	db     *gorm.DB
+	logger queryLogger
+}
+
+// NewConnection opens and pings the database. With withDB set to false it connects
+// to the server without selecting a database, e.g. to create one.
+func NewConnection(psql PostgresDatabase, withDB bool) (*Connection, error) {
+	return newConnection(context.Background(), psql, withDB)
+}
+
+// newConnection is NewConnection, the ping is stopped when the context is cancelled
+func newConnection(ctx context.Context, psql PostgresDatabase, withDB bool) (*Connection, error) {
+	psql, err := psql.withEnvFallbacks()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	connString, err := psql.connectionString(withDB)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	db, err := openDB(ctx, psql, connString)
+	if err != nil {
+		return nil, err
+	}
+	if psql.MaxOpenConns > 0 {
+		db.DB().SetMaxOpenConns(psql.MaxOpenConns)
+	}
+	if psql.MaxIdleConns > 0 {
+		db.DB().SetMaxIdleConns(psql.MaxIdleConns)
+	}
+	if psql.ConnMaxLifetime > 0 {
+		db.DB().SetConnMaxLifetime(psql.ConnMaxLifetime)
+	}
+	logger := newQueryLogger(psql)
+	db.SetLogger(logger)
+	if logger.detailed() {
+		db.LogMode(true)
+	}
+	return &Connection{db: db, logger: logger}, nil
+}
+
+// GetDB ...
+func (c *Connection) GetDB() *gorm.DB {
+	return c.db
+}
+
+// WithContext returns a session of the database which logs the queries with
+// the context's logger
+func (c *Connection) WithContext(ctx context.Context) *gorm.DB {
+	db := c.db.New()
+	db.SetLogger(c.logger.withContext(ctx))
+	return db
+}
+
+// Close ...
+func (c *Connection) Close() error {
+	return errors.WithStack(c.db.Close())
+}
+
+// openDB pings the pool before gorm opens it, gorm's own ping can't be cancelled
+func openDB(ctx context.Context, psql PostgresDatabase, connString string) (*gorm.DB, error) {
+	var connector driver.Connector = &passwordConnector{connString: connString, provider: psql.PasswordProvider}
+	if psql.PasswordProvider == nil {
+		// a connector, unlike sql.Open, dials with the context
+		var err error
+		if connector, err = pq.NewConnector(connString); err != nil {
+			return nil, errors.Wrap(err, "Failed to open database")
+		}
+	}
+	sqlDB := sql.OpenDB(connector)
+	if err := sqlDB.PingContext(ctx); err != nil {
+		closeSQLDB(sqlDB)
+		return nil, errors.Wrap(err, "Failed to ping database")
+	}
+	db, err := gorm.Open(dbDialect, sqlDB)
+	if err != nil {
+		// gorm only closes the pools it opened
+		closeSQLDB(sqlDB)
+		return nil, errors.Wrap(err, "Failed to open database")
+	}
+	return db, nil
+}
+
+func closeSQLDB(sqlDB *sql.DB) {
+	if err := sqlDB.Close(); err != nil {
+		log.Printf(" [!] Exception: Failed to close DB: %+v", err)
+	}
+}
+
+func closeDB(dbToClose *gorm.DB) {
+	if err := dbToClose.Close(); err != nil {
+		log.Printf(" [!] Exception: Failed to close DB: %+v", err)
+	}
+}
@@ -0,0 +1,82 @@
+package database_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/bitrise-io/api-utils/database"
+	"github.com/bitrise-io/api-utils/database/databasetest"
+)
+
+var unreachableDatabase = database.PostgresDatabase{Host: "127.0.0.1", Port: 1, DBName: "test", User: "test", Password: "test", SSLMode: "disable"}
+
+func Test_NewConnection(t *testing.T) {
+	t.Log("not ok - invalid configuration")
+	{
+		_, err := database.NewConnection(database.PostgresDatabase{Host: "localhost", DBName: "test", User: "test"}, true)
+		require.EqualError(t, err, "No database password specified")
+	}
+	t.Log("not ok - unreachable database")
+	{
+		_, err := database.NewConnection(unreachableDatabase, true)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "connection refused")
+	}
+
+	testDB := databasetest.New(t, databasetest.Config{})
+	t.Log("ok - connected with the pool settings")
+	{
+		conn, err := database.NewConnection(database.PostgresDatabase{DBName: testDB.Name, MaxOpenConns: 3}, true)
+		require.NoError(t, err)
+		defer func() { require.NoError(t, conn.Close()) }()
+
+		require.NoError(t, conn.GetDB().DB().Ping())
+		require.Equal(t, 3, conn.GetDB().DB().Stats().MaxOpenConnections)
+	}
+	t.Log("ok - connections are independent")
+	{
+		conn1, err := database.NewConnection(database.PostgresDatabase{DBName: testDB.Name}, true)
+		require.NoError(t, err)
+		conn2, err := database.NewConnection(database.PostgresDatabase{DBName: testDB.Name}, true)
+		require.NoError(t, err)
+		defer func() { require.NoError(t, conn2.Close()) }()
+
+		require.NoError(t, conn1.Close())
+		require.NoError(t, conn2.GetDB().DB().Ping())
+	}
+}
+
+func Test_PostgresDatabase_InitializeConnection(t *testing.T) {
+	t.Log("not ok - unreachable database")
+	{
+		require.Error(t, unreachableDatabase.InitializeConnection(true))
+		require.Error(t, unreachableDatabase.InitializeConnectionWithRetry(context.Background(), true, database.RetryConfig{MaxAttempts: 1}))
+		require.Nil(t, unreachableDatabase.GetDB())
+	}
+
+	testDB := databasetest.New(t, databasetest.Config{})
+	psql := database.PostgresDatabase{DBName: testDB.Name}
+	defer psql.Close()
+	t.Log("ok - shared by the PostgresDatabase values")
+	{
+		require.NoError(t, psql.InitializeConnection(true))
+		require.NoError(t, database.PostgresDatabase{}.GetDB().DB().Ping())
+	}
+	t.Log("ok - the previous connection is closed when it's replaced")
+	{
+		previous := psql.GetDB()
+		require.NoError(t, psql.InitializeConnectionWithRetry(context.Background(), true, database.RetryConfig{MaxAttempts: 1}))
+		require.NotEqual(t, previous, psql.GetDB())
+		require.EqualError(t, previous.DB().Ping(), "sql: database is closed")
+		require.NoError(t, psql.GetDB().DB().Ping())
+	}
+	t.Log("ok - close")
+	{
+		db := psql.GetDB()
+		psql.Close()
+		require.Nil(t, psql.GetDB())
+		require.EqualError(t, db.DB().Ping(), "sql: database is closed")
+	}
+}
@@ -0,0 +1,264 @@
+// Package databasetest creates uniquely named Postgres databases for the integration tests
+package databasetest
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/bitrise-io/api-utils/database"
+	"github.com/bitrise-io/api-utils/logging"
+)
+
+const (
+	defaultNamePrefix   = "test"
+	maxIdentifierLength = 63
+	nameSuffixLength    = 8
+	migrationsTableName = "schema_migrations"
+)
+
+var invalidIdentifierChars = regexp.MustCompile(`[^a-z0-9_]+`)
+
+// Config ...
+type Config struct {
+	// Server to create the test database on, with the DB_* environment variables as
+	// fallbacks. In schema mode the schema is created in its DBName.
+	Server     database.PostgresDatabase
+	Migrations []database.Migration
+	// Schema creates a schema instead of a database, which is faster, but the
+	// tests share the database's extensions
+	Schema bool
+	// Rollback runs the test in a transaction which is rolled back instead of
+	// committed, use the Database's DB and Context to query in it
+	Rollback bool
+	// NamePrefix of the database or schema, New defaults it to the test's name
+	NamePrefix string
+}
+
+// Database is a uniquely named database or schema for the integration tests,
+// so they can run in parallel without seeing each other's data
+type Database struct {
+	Name string
+
+	config Config
+	admin  *database.Connection
+	conn   *database.Connection
+	tx     *gorm.DB
+}
+
+// New creates a test database and drops it when the test and its subtests
+// complete. The test is skipped if there is no database host configured.
+func New(t testing.TB, config Config) *Database {
+	t.Helper()
+	if config.Server.Host == "" && os.Getenv("DB_HOST") == "" {
+		t.Skip("No database host specified")
+	}
+	if config.NamePrefix == "" {
+		config.NamePrefix = t.Name()
+	}
+	testDB, err := Create(config)
+	if err != nil {
+		t.Fatalf("Failed to create test database: %+v", err)
+	}
+	t.Cleanup(func() {
+		if err := testDB.Drop(); err != nil {
+			t.Errorf("Failed to drop test database: %+v", err)
+		}
+	})
+	return testDB
+}
+
+// Create creates a test database and runs the migrations on it, e.g. to share
+// one in a package's TestMain. It has to be dropped with Drop.
+func Create(config Config) (*Database, error) {
+	if config.NamePrefix == "" {
+		config.NamePrefix = defaultNamePrefix
+	}
+	name, err := databaseName(config.NamePrefix)
+	if err != nil {
+		return nil, err
+	}
+	testDB := &Database{Name: name, config: config}
+
+	server := config.Server
+	if config.Schema {
+		if testDB.admin, err = database.NewConnection(server, true); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if err := testDB.admin.GetDB().Exec("CREATE SCHEMA " + pq.QuoteIdentifier(name)).Error; err != nil {
+			testDB.closeAdmin()
+			return nil, errors.Wrap(err, "Failed to create schema")
+		}
+		// public is kept for the extensions installed in the database
+		server.SearchPath = pq.QuoteIdentifier(name) + ", public"
+	} else {
+		// connects without selecting a database, like InitializeConnection(false)
+		if testDB.admin, err = database.NewConnection(server, false); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if err := testDB.admin.GetDB().Exec("CREATE DATABASE " + pq.QuoteIdentifier(name)).Error; err != nil {
+			testDB.closeAdmin()
+			return nil, errors.Wrap(err, "Failed to create database")
+		}
+		server.DBName = name
+	}
+
+	if testDB.conn, err = database.NewConnection(server, true); err != nil {
+		return nil, testDB.dropAfter(errors.WithStack(err))
+	}
+	if len(config.Migrations) > 0 {
+		migrator := database.NewMigrator(testDB.conn, config.Migrations, database.MigratorConfig{
+			TableName: migrationsTableName,
+			LockKey:   database.AdvisoryLockKey("migrations:" + name),
+		})
+		if err := migrator.Up(context.Background()); err != nil {
+			return nil, testDB.dropAfter(err)
+		}
+	}
+	if config.Rollback {
+		testDB.tx = testDB.conn.GetDB().Begin()
+		if testDB.tx.Error != nil {
+			return nil, testDB.dropAfter(errors.Wrap(testDB.tx.Error, "Failed to begin transaction"))
+		}
+	}
+	return testDB, nil
+}
+
+// DB returns the database, or the transaction in rollback mode
+func (d *Database) DB() *gorm.DB {
+	if d.tx != nil {
+		return d.tx
+	}
+	return d.conn.GetDB()
+}
+
+// Connection returns the connection of the database, in rollback mode its queries
+// run outside of the transaction unless they get the context returned by Context
+func (d *Database) Connection() *database.Connection {
+	return d.conn
+}
+
+// Context returns a context in which Connection.WithTransaction creates savepoints
+// in the rollback mode's transaction, in the other modes it returns ctx
+func (d *Database) Context(ctx context.Context) context.Context {
+	if d.tx == nil {
+		return ctx
+	}
+	return d.conn.ContextWithTransaction(ctx, d.tx)
+}
+
+// Truncate empties the tables and resets their sequences, by default every table
+// of the test database except the migrations table
+func (d *Database) Truncate(tables ...string) error {
+	if len(tables) == 0 {
+		rows, err := d.DB().Raw(`SELECT table_name FROM information_schema.tables
+			WHERE table_schema = current_schema() AND table_type = 'BASE TABLE' AND table_name <> ?`,
+			migrationsTableName).Rows()
+		if err != nil {
+			return errors.Wrap(err, "Failed to list tables")
+		}
+		defer func() {
+			if err := rows.Close(); err != nil {
+				logging.WithContext(nil).Error("Failed to close rows", zap.Error(err))
+			}
+		}()
+		for rows.Next() {
+			var table string
+			if err := rows.Scan(&table); err != nil {
+				return errors.WithStack(err)
+			}
+			tables = append(tables, table)
+		}
+		if err := rows.Err(); err != nil {
+			return errors.WithStack(err)
+		}
+		if len(tables) == 0 {
+			return nil
+		}
+	}
+
+	quoted := make([]string, 0, len(tables))
+	for _, table := range tables {
+		quoted = append(quoted, pq.QuoteIdentifier(table))
+	}
+	if err := d.DB().Exec("TRUNCATE TABLE " + strings.Join(quoted, ", ") + " RESTART IDENTITY CASCADE").Error; err != nil {
+		return errors.Wrap(err, "Failed to truncate tables")
+	}
+	return nil
+}
+
+// Drop rolls back the transaction of the rollback mode, closes the connection
+// and drops the database or schema
+func (d *Database) Drop() error {
+	var dropErr error
+	if d.tx != nil {
+		if err := d.tx.Rollback().Error; err != nil {
+			dropErr = errors.Wrap(err, "Failed to roll back transaction")
+		}
+		d.tx = nil
+	}
+	if d.conn != nil {
+		if err := d.conn.Close(); err != nil {
+			dropErr = err
+		}
+		d.conn = nil
+	}
+	if d.admin == nil {
+		return dropErr
+	}
+	defer d.closeAdmin()
+
+	db := d.admin.GetDB()
+	if d.config.Schema {
+		if err := db.Exec("DROP SCHEMA IF EXISTS " + pq.QuoteIdentifier(d.Name) + " CASCADE").Error; err != nil {
+			return errors.Wrap(err, "Failed to drop schema")
+		}
+		return dropErr
+	}
+	// connections leaked by the test would block dropping the database
+	if err := db.Exec("SELECT pg_terminate_backend(pid) FROM pg_stat_activity WHERE datname = ? AND pid <> pg_backend_pid()", d.Name).Error; err != nil {
+		return errors.Wrap(err, "Failed to terminate connections")
+	}
+	if err := db.Exec("DROP DATABASE IF EXISTS " + pq.QuoteIdentifier(d.Name)).Error; err != nil {
+		return errors.Wrap(err, "Failed to drop database")
+	}
+	return dropErr
+}
+
+func (d *Database) dropAfter(err error) error {
+	if dropErr := d.Drop(); dropErr != nil {
+		return errors.Wrapf(err, "Also failed to drop test database: %s", dropErr)
+	}
+	return err
+}
+
+func (d *Database) closeAdmin() {
+	if d.admin != nil {
+		if err := d.admin.Close(); err != nil {
+			logging.WithContext(nil).Error("Failed to close test database connection", zap.Error(err))
+		}
+		d.admin = nil
+	}
+}
+
+// databaseName returns a valid, lower case identifier with a random suffix
+func databaseName(prefix string) (string, error) {
+	suffix := make([]byte, nameSuffixLength/2)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", errors.WithStack(err)
+	}
+	name := strings.Trim(invalidIdentifierChars.ReplaceAllString(strings.ToLower(prefix), "_"), "_")
+	if maxLength := maxIdentifierLength - nameSuffixLength - 1; len(name) > maxLength {
+		name = name[:maxLength]
+	}
+	return name + "_" + hex.EncodeToString(suffix), nil
+}
@@ -0,0 +1,64 @@
+package databasetest_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bitrise-io/api-utils/database"
+	"github.com/bitrise-io/api-utils/database/databasetest"
+)
+
+var testMigrations = []database.Migration{
+	{Version: 1, Name: "create_builds", Up: "CREATE TABLE builds (id bigserial PRIMARY KEY, status text NOT NULL);"},
+}
+
+func countBuilds(t *testing.T, db *gorm.DB) int {
+	var count int
+	require.NoError(t, db.Table("builds").Count(&count).Error)
+	return count
+}
+
+func Test_New(t *testing.T) {
+	for _, schema := range []bool{false, true} {
+		testDB := databasetest.New(t, databasetest.Config{Migrations: testMigrations, Schema: schema})
+
+		t.Log("ok - migrated")
+		{
+			require.NoError(t, testDB.DB().Exec("INSERT INTO builds (status) VALUES ('running')").Error)
+			require.Equal(t, 1, countBuilds(t, testDB.DB()))
+		}
+		t.Log("ok - truncate")
+		{
+			require.NoError(t, testDB.Truncate())
+			require.Equal(t, 0, countBuilds(t, testDB.DB()))
+		}
+	}
+}
+
+func Test_New_Rollback(t *testing.T) {
+	testDB := databasetest.New(t, databasetest.Config{Migrations: testMigrations, Schema: true, Rollback: true})
+	ctx := testDB.Context(context.Background())
+
+	t.Log("ok - nested transactions use savepoints")
+	{
+		err := testDB.Connection().WithTransaction(ctx, nil, func(ctx context.Context, tx *gorm.DB) error {
+			return tx.Exec("INSERT INTO builds (status) VALUES ('running')").Error
+		})
+		require.NoError(t, err)
+
+		err = testDB.Connection().WithTransaction(ctx, nil, func(ctx context.Context, tx *gorm.DB) error {
+			require.NoError(t, tx.Exec("INSERT INTO builds (status) VALUES ('failed')").Error)
+			return errors.New("rolled back")
+		})
+		require.EqualError(t, err, "rolled back")
+		require.Equal(t, 1, countBuilds(t, testDB.DB()))
+	}
+	t.Log("ok - not visible outside of the transaction")
+	{
+		require.Equal(t, 0, countBuilds(t, testDB.Connection().GetDB()))
+	}
+}
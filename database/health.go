@@ -0,0 +1,101 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"time"
+
+	"github.com/bitrise-io/api-utils/httpresponse"
+	"github.com/bitrise-io/api-utils/logging"
+	"go.uber.org/zap"
+)
+
+// PoolStats of the connection pool, see sql.DBStats
+type PoolStats struct {
+	MaxOpenConnections int   `json:"max_open_connections"`
+	OpenConnections    int   `json:"open_connections"`
+	InUse              int   `json:"in_use"`
+	Idle               int   `json:"idle"`
+	WaitCount          int64 `json:"wait_count"`
+	WaitDurationMs     int64 `json:"wait_duration_ms"`
+}
+
+// HealthStatus ...
+type HealthStatus struct {
+	Healthy   bool      `json:"healthy"`
+	Error     string    `json:"error,omitempty"`
+	LatencyMs int64     `json:"latency_ms"`
+	Pool      PoolStats `json:"pool"`
+}
+
+// HealthChecker pings the database, it's an http.Handler responding with the
+// HealthStatus, with 200 if the database is reachable and with 503 if it isn't.
+// Use it as the readiness probe, and one in Liveness mode as the liveness probe:
+// a database outage should take the instances out of the load balancer, restarting
+// them wouldn't help.
+type HealthChecker struct {
+	conn *Connection
+	// Timeout of the ping, defaults to 2 seconds
+	Timeout time.Duration
+	// Liveness skips the ping, only the pool stats are reported and it's always healthy
+	Liveness bool
+}
+
+// NewHealthChecker ...
+func NewHealthChecker(conn *Connection) *HealthChecker {
+	return &HealthChecker{conn: conn, Timeout: defaultHealthCheckTimeout}
+}
+
+// NewLivenessChecker returns a HealthChecker in Liveness mode
+func NewLivenessChecker(conn *Connection) *HealthChecker {
+	return &HealthChecker{conn: conn, Timeout: defaultHealthCheckTimeout, Liveness: true}
+}
+
+// Check pings the database within the timeout, unless it's in Liveness mode
+func (h *HealthChecker) Check(ctx context.Context) HealthStatus {
+	db := h.conn.GetDB().DB()
+	if h.Liveness {
+		return HealthStatus{Healthy: true, Pool: poolStats(db)}
+	}
+
+	timeout := h.Timeout
+	if timeout <= 0 {
+		timeout = defaultHealthCheckTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	err := db.PingContext(ctx)
+	status := HealthStatus{Healthy: err == nil, LatencyMs: int64(time.Since(start) / time.Millisecond)}
+	if err != nil {
+		// the details, e.g. the address, are only logged as the endpoint can be public
+		logging.WithContext(ctx).Warn("Database health check failed", zap.Error(err))
+		status.Error = "Database unreachable"
+	}
+
+	status.Pool = poolStats(db)
+	return status
+}
+
+func poolStats(db *sql.DB) PoolStats {
+	stats := db.Stats()
+	return PoolStats{
+		MaxOpenConnections: stats.MaxOpenConnections,
+		OpenConnections:    stats.OpenConnections,
+		InUse:              stats.InUse,
+		Idle:               stats.Idle,
+		WaitCount:          stats.WaitCount,
+		WaitDurationMs:     int64(stats.WaitDuration / time.Millisecond),
+	}
+}
+
+func (h *HealthChecker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	status := h.Check(r.Context())
+	if !status.Healthy {
+		httpresponse.RespondWithJSONNoErr(w, http.StatusServiceUnavailable, status)
+		return
+	}
+	httpresponse.RespondWithJSONNoErr(w, http.StatusOK, status)
+}
@@ -0,0 +1,41 @@
+package database
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_HealthChecker(t *testing.T) {
+	t.Log("not ok - unreachable database")
+	{
+		sqlDB, err := sql.Open(dbDialect, "host=127.0.0.1 port=1 user=test password=test dbname=test sslmode=disable connect_timeout=1")
+		require.NoError(t, err)
+		sqlDB.SetMaxOpenConns(5)
+		// the ping of Open fails, the pool is still usable
+		db, _ := gorm.Open(dbDialect, sqlDB)
+		conn := &Connection{db: db}
+		defer func() { require.NoError(t, conn.Close()) }()
+
+		checker := NewHealthChecker(conn)
+		checker.Timeout = time.Second
+		w := httptest.NewRecorder()
+		checker.ServeHTTP(w, httptest.NewRequest("GET", "/ready", nil))
+
+		require.Equal(t, http.StatusServiceUnavailable, w.Code)
+		require.Contains(t, w.Body.String(), `"healthy":false`)
+		require.Contains(t, w.Body.String(), `"error":"Database unreachable"`)
+		require.Contains(t, w.Body.String(), `"max_open_connections":5`)
+
+		w = httptest.NewRecorder()
+		NewLivenessChecker(conn).ServeHTTP(w, httptest.NewRequest("GET", "/live", nil))
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Contains(t, w.Body.String(), `"healthy":true`)
+		require.Contains(t, w.Body.String(), `"max_open_connections":5`)
+	}
+}
@@ -0,0 +1,381 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bitrise-io/api-utils/logging"
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultJobsTableName       = "jobs"
+	defaultJobPollInterval     = time.Second
+	defaultJobMaxAttempts      = 10
+	defaultJobMinBackoff       = time.Second
+	defaultJobMaxBackoff       = time.Hour
+	defaultJobRescueAfter      = 30 * time.Minute
+	defaultJobRetention        = 7 * 24 * time.Hour
+	defaultJobCleanupInterval  = time.Hour
+	jobFinishTimeout           = 10 * time.Second
+	jobStateAvailable          = "available"
+	jobStateRunning            = "running"
+	jobStateCompleted          = "completed"
+	jobStateDiscarded          = "discarded"
+	jobActiveStatesCondition   = "unique_key IS NOT NULL AND state IN ('available', 'running')"
+	maxJobErrorMessageByteSize = 2000
+)
+
+// Job ...
+type Job struct {
+	ID      int64
+	Kind    string
+	Payload json.RawMessage
+	// Attempt is 1 on the first run
+	Attempt     int
+	MaxAttempts int
+	CreatedAt   time.Time
+}
+
+// Decode unmarshals the JSON payload into v
+func (j Job) Decode(v interface{}) error {
+	if err := json.Unmarshal(j.Payload, v); err != nil {
+		return errors.Wrapf(err, "Failed to decode payload of %s job %d", j.Kind, j.ID)
+	}
+	return nil
+}
+
+// JobHandler runs a job, it's retried with backoff if it returns an error or panics
+type JobHandler func(ctx context.Context, job Job) error
+
+// EnqueueOptions ...
+type EnqueueOptions struct {
+	// RunAt schedules the job, it runs as soon as possible by default
+	RunAt time.Time
+	// MaxAttempts defaults to the queue's MaxAttempts
+	MaxAttempts int
+	// UniqueKey prevents enqueueing a job of the same kind and key while one is
+	// waiting or running
+	UniqueKey string
+}
+
+// JobQueueConfig ...
+type JobQueueConfig struct {
+	// TableName of the jobs, defaults to jobs
+	TableName string
+	// Concurrency is the number of jobs run in parallel, defaults to 1
+	Concurrency int
+	// PollInterval of the workers when there are no jobs to run, defaults to 1 second
+	PollInterval time.Duration
+	// MaxAttempts of the jobs, defaults to 10
+	MaxAttempts int
+	// MinBackoff is the wait after the first failed attempt, it's doubled after every
+	// further one up to MaxBackoff. Defaults to 1 second and 1 hour.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// RescueAfter is how long a job can run before it's considered abandoned, e.g.
+	// because its worker was killed, and is run again. Defaults to 30 minutes.
+	RescueAfter time.Duration
+	// Retention of the completed and discarded jobs, defaults to 7 days
+	Retention time.Duration
+	// CleanupInterval defaults to 1 hour
+	CleanupInterval time.Duration
+}
+
+// JobQueue is a durable job queue in a Postgres table. The jobs are claimed with
+// SELECT ... FOR UPDATE SKIP LOCKED, so any number of workers can share the table.
+type JobQueue struct {
+	conn   *Connection
+	config JobQueueConfig
+
+	handlersLock sync.RWMutex
+	handlers     map[string]JobHandler
+}
+
+// JobQueueMigration creates the jobs table, it should be added to the service's
+// migrations. The table name defaults to jobs.
+func JobQueueMigration(version int64, tableName string) Migration {
+	if tableName == "" {
+		tableName = defaultJobsTableName
+	}
+	table := pq.QuoteIdentifier(tableName)
+	return Migration{
+		Version: version,
+		Name:    "create_" + tableName,
+		Up: fmt.Sprintf(`CREATE TABLE %s (
+	id bigserial PRIMARY KEY,
+	kind text NOT NULL,
+	payload jsonb NOT NULL,
+	state text NOT NULL DEFAULT 'available',
+	unique_key text,
+	attempts integer NOT NULL DEFAULT 0,
+	max_attempts integer NOT NULL,
+	last_error text,
+	run_at timestamptz NOT NULL DEFAULT now(),
+	locked_at timestamptz,
+	finished_at timestamptz,
+	created_at timestamptz NOT NULL DEFAULT now()
+);
+CREATE INDEX %s ON %s (kind, run_at) WHERE state = 'available';
+CREATE UNIQUE INDEX %s ON %s (kind, unique_key) WHERE %s;`,
+			table,
+			pq.QuoteIdentifier(tableName+"_available_idx"), table,
+			pq.QuoteIdentifier(tableName+"_unique_key_idx"), table, jobActiveStatesCondition),
+		Down: fmt.Sprintf("DROP TABLE %s;", table),
+	}
+}
+
+// NewJobQueue ...
+func NewJobQueue(conn *Connection, config JobQueueConfig) *JobQueue {
+	if config.TableName == "" {
+		config.TableName = defaultJobsTableName
+	}
+	if config.Concurrency < 1 {
+		config.Concurrency = 1
+	}
+	if config.PollInterval == 0 {
+		config.PollInterval = defaultJobPollInterval
+	}
+	if config.MaxAttempts <= 0 {
+		config.MaxAttempts = defaultJobMaxAttempts
+	}
+	if config.MinBackoff == 0 {
+		config.MinBackoff = defaultJobMinBackoff
+	}
+	if config.MaxBackoff == 0 {
+		config.MaxBackoff = defaultJobMaxBackoff
+	}
+	if config.RescueAfter == 0 {
+		config.RescueAfter = defaultJobRescueAfter
+	}
+	if config.Retention == 0 {
+		config.Retention = defaultJobRetention
+	}
+	if config.CleanupInterval == 0 {
+		config.CleanupInterval = defaultJobCleanupInterval
+	}
+	return &JobQueue{conn: conn, config: config, handlers: map[string]JobHandler{}}
+}
+
+// Register sets the handler of a job kind, the workers only claim the registered kinds
+func (q *JobQueue) Register(kind string, handler JobHandler) {
+	q.handlersLock.Lock()
+	defer q.handlersLock.Unlock()
+	q.handlers[kind] = handler
+}
+
+// Enqueue stores a job with the payload encoded as JSON. Called with a transaction the
+// job only becomes visible to the workers when it's committed. It returns false if the
+// job wasn't enqueued because of a waiting or running job with the same unique key.
+func (q *JobQueue) Enqueue(tx *gorm.DB, kind string, payload interface{}, opts *EnqueueOptions) (bool, error) {
+	if opts == nil {
+		opts = &EnqueueOptions{}
+	}
+	encoded, err := json.Marshal(payload)
+	if err != nil {
+		return false, errors.Wrapf(err, "Failed to encode %s job payload", kind)
+	}
+	maxAttempts := opts.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = q.config.MaxAttempts
+	}
+	runAt := opts.RunAt
+	if runAt.IsZero() {
+		runAt = time.Now()
+	}
+	var uniqueKey *string
+	if opts.UniqueKey != "" {
+		uniqueKey = &opts.UniqueKey
+	}
+
+	result := tx.Exec(fmt.Sprintf(`INSERT INTO %s (kind, payload, unique_key, max_attempts, run_at) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (kind, unique_key) WHERE %s DO NOTHING`, pq.QuoteIdentifier(q.config.TableName), jobActiveStatesCondition),
+		kind, string(encoded), uniqueKey, maxAttempts, runAt)
+	if result.Error != nil {
+		return false, errors.Wrapf(result.Error, "Failed to enqueue %s job", kind)
+	}
+	return result.RowsAffected == 1, nil
+}
+
+// Run starts the workers and the periodic cleanup, and returns the context's error
+// after it's cancelled and the running jobs have returned
+func (q *JobQueue) Run(ctx context.Context) error {
+	wg := sync.WaitGroup{}
+	for i := 0; i < q.config.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				worked, err := q.Work(ctx)
+				if err != nil && ctx.Err() == nil {
+					logging.WithContext(ctx).Error("Failed to work job", zap.Error(err))
+				}
+				if !worked {
+					sleep(ctx, q.config.PollInterval)
+				}
+			}
+		}()
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for ctx.Err() == nil {
+			if _, err := q.Cleanup(ctx); err != nil && ctx.Err() == nil {
+				logging.WithContext(ctx).Error("Failed to clean up jobs", zap.Error(err))
+			}
+			sleep(ctx, q.config.CleanupInterval)
+		}
+	}()
+
+	wg.Wait()
+	return ctx.Err()
+}
+
+// Work claims and runs a job, and reports whether there was one to run
+func (q *JobQueue) Work(ctx context.Context) (bool, error) {
+	job, err := q.claim(ctx)
+	if err != nil || job == nil {
+		return false, err
+	}
+
+	q.handlersLock.RLock()
+	handler := q.handlers[job.Kind]
+	q.handlersLock.RUnlock()
+
+	logger := logging.WithContext(ctx).With(zap.Int64("job_id", job.ID), zap.String("job_kind", job.Kind), zap.Int("attempt", job.Attempt))
+	if err := runJobHandler(ctx, handler, *job); err != nil {
+		logger.Warn("Job failed", zap.Error(err))
+		return true, q.fail(*job, err)
+	}
+	if err := q.finish(*job, "state = $1, finished_at = now(), last_error = NULL", jobStateCompleted); err != nil {
+		return true, errors.Wrapf(err, "Failed to complete job %d", job.ID)
+	}
+	return true, nil
+}
+
+func runJobHandler(ctx context.Context, handler JobHandler, job Job) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.Errorf("Job handler panicked: %v", r)
+		}
+	}()
+	return handler(ctx, job)
+}
+
+func (q *JobQueue) claim(ctx context.Context) (*Job, error) {
+	q.handlersLock.RLock()
+	kinds := make([]string, 0, len(q.handlers))
+	for kind := range q.handlers {
+		kinds = append(kinds, kind)
+	}
+	q.handlersLock.RUnlock()
+	if len(kinds) == 0 {
+		return nil, errors.New("No job handlers registered")
+	}
+
+	table := pq.QuoteIdentifier(q.config.TableName)
+	rows, err := q.conn.WithContext(ctx).Raw(fmt.Sprintf(`UPDATE %s SET state = ?, attempts = attempts + 1, locked_at = now()
+		WHERE id = (
+			SELECT id FROM %s
+			WHERE kind = ANY(?) AND attempts < max_attempts AND (
+				(state = ? AND run_at <= now()) OR
+				(state = ? AND locked_at < now() - ? * interval '1 millisecond'))
+			ORDER BY run_at, id LIMIT 1
+			FOR UPDATE SKIP LOCKED)
+		RETURNING id, kind, payload, attempts, max_attempts, created_at`, table, table),
+		jobStateRunning, pq.Array(kinds), jobStateAvailable, jobStateRunning, int64(q.config.RescueAfter/time.Millisecond)).Rows()
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to claim job")
+	}
+	defer closeRows(rows)
+
+	if !rows.Next() {
+		return nil, errors.WithStack(rows.Err())
+	}
+	job := &Job{}
+	var payload []byte
+	if err := rows.Scan(&job.ID, &job.Kind, &payload, &job.Attempt, &job.MaxAttempts, &job.CreatedAt); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	job.Payload = json.RawMessage(payload)
+	return job, nil
+}
+
+func (q *JobQueue) fail(job Job, jobErr error) error {
+	message := jobErr.Error()
+	if len(message) > maxJobErrorMessageByteSize {
+		message = strings.ToValidUTF8(message[:maxJobErrorMessageByteSize], "")
+	}
+
+	var err error
+	if job.Attempt >= job.MaxAttempts {
+		err = q.finish(job, "state = $1, finished_at = now(), last_error = $2", jobStateDiscarded, message)
+	} else {
+		backoff := ExponentialBackoff(q.config.MinBackoff, q.config.MaxBackoff, job.Attempt)
+		err = q.finish(job, "state = $1, locked_at = NULL, last_error = $2, run_at = now() + $3 * interval '1 millisecond'",
+			jobStateAvailable, message, int64(backoff/time.Millisecond))
+	}
+	return errors.Wrapf(err, "Failed to record failure of job %d", job.ID)
+}
+
+// finish records the state of a run job with the assignments of set, whose parameters
+// are args. It isn't cancelled with the worker's context, otherwise a job finished
+// during shutdown would stay running and would be run again after RescueAfter. If the
+// job was rescued by another worker in the meantime, the state is left to that run.
+func (q *JobQueue) finish(job Job, set string, args ...interface{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), jobFinishTimeout)
+	defer cancel()
+	query := fmt.Sprintf("UPDATE %s SET %s WHERE id = $%d AND state = $%d AND attempts = $%d",
+		pq.QuoteIdentifier(q.config.TableName), set, len(args)+1, len(args)+2, len(args)+3)
+	result, err := q.conn.GetDB().DB().ExecContext(ctx, query, append(args, job.ID, jobStateRunning, job.Attempt)...)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if affected == 0 {
+		logging.WithContext(nil).Warn("Lost the claim of the job, it ran longer than RescueAfter and was claimed again",
+			zap.Int64("job_id", job.ID), zap.String("job_kind", job.Kind), zap.Int("attempt", job.Attempt))
+	}
+	return nil
+}
+
+// Cleanup deletes the completed and discarded jobs after the retention period, and
+// discards the abandoned ones which ran out of attempts. It returns the number of
+// deleted jobs.
+func (q *JobQueue) Cleanup(ctx context.Context) (int64, error) {
+	table := pq.QuoteIdentifier(q.config.TableName)
+	db := q.conn.WithContext(ctx)
+	err := db.Exec(fmt.Sprintf(`UPDATE %s SET state = ?, finished_at = now(), last_error = 'Abandoned'
+		WHERE state = ? AND attempts >= max_attempts AND locked_at < now() - ? * interval '1 millisecond'`, table),
+		jobStateDiscarded, jobStateRunning, int64(q.config.RescueAfter/time.Millisecond)).Error
+	if err != nil {
+		return 0, errors.Wrap(err, "Failed to discard abandoned jobs")
+	}
+
+	result := db.Exec(fmt.Sprintf("DELETE FROM %s WHERE state IN (?, ?) AND finished_at < ?", table),
+		jobStateCompleted, jobStateDiscarded, time.Now().Add(-q.config.Retention))
+	if result.Error != nil {
+		return 0, errors.Wrap(result.Error, "Failed to delete finished jobs")
+	}
+	return result.RowsAffected, nil
+}
+
+func sleep(ctx context.Context, d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
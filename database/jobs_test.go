@@ -0,0 +1,140 @@
+package database_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bitrise-io/api-utils/database"
+	"github.com/bitrise-io/api-utils/database/databasetest"
+)
+
+type sendEmailJob struct {
+	To string `json:"to"`
+}
+
+func Test_Job_Decode(t *testing.T) {
+	payload := sendEmailJob{}
+	require.NoError(t, database.Job{Kind: "send_email", Payload: []byte(`{"to":"user@example.com"}`)}.Decode(&payload))
+	require.Equal(t, sendEmailJob{To: "user@example.com"}, payload)
+
+	err := database.Job{ID: 1, Kind: "send_email", Payload: []byte(`[]`)}.Decode(&payload)
+	require.EqualError(t, err, "Failed to decode payload of send_email job 1: json: cannot unmarshal array into Go value of type database_test.sendEmailJob")
+}
+
+func Test_JobQueue(t *testing.T) {
+	testDB := databasetest.New(t, databasetest.Config{Schema: true, Migrations: []database.Migration{database.JobQueueMigration(1, "")}})
+	queue := database.NewJobQueue(testDB.Connection(), database.JobQueueConfig{MinBackoff: time.Nanosecond})
+	ctx := context.Background()
+
+	sent := []string{}
+	var sendErr error
+	queue.Register("send_email", func(ctx context.Context, job database.Job) error {
+		if sendErr != nil {
+			return sendErr
+		}
+		payload := sendEmailJob{}
+		if err := job.Decode(&payload); err != nil {
+			return err
+		}
+		sent = append(sent, payload.To)
+		return nil
+	})
+
+	t.Log("ok - unique key")
+	{
+		enqueued, err := queue.Enqueue(testDB.DB(), "send_email", sendEmailJob{To: "user@example.com"}, &database.EnqueueOptions{UniqueKey: "welcome:1"})
+		require.NoError(t, err)
+		require.True(t, enqueued)
+
+		enqueued, err = queue.Enqueue(testDB.DB(), "send_email", sendEmailJob{To: "user@example.com"}, &database.EnqueueOptions{UniqueKey: "welcome:1"})
+		require.NoError(t, err)
+		require.False(t, enqueued)
+	}
+	t.Log("ok - retried after failure")
+	{
+		sendErr = errors.New("smtp unavailable")
+		worked, err := queue.Work(ctx)
+		require.NoError(t, err)
+		require.True(t, worked)
+		require.Empty(t, sent)
+
+		sendErr = nil
+		worked, err = queue.Work(ctx)
+		require.NoError(t, err)
+		require.True(t, worked)
+		require.Equal(t, []string{"user@example.com"}, sent)
+
+		worked, err = queue.Work(ctx)
+		require.NoError(t, err)
+		require.False(t, worked)
+	}
+	t.Log("ok - scheduled")
+	{
+		_, err := queue.Enqueue(testDB.DB(), "send_email", sendEmailJob{To: "later@example.com"}, &database.EnqueueOptions{RunAt: time.Now().Add(time.Hour)})
+		require.NoError(t, err)
+
+		worked, err := queue.Work(ctx)
+		require.NoError(t, err)
+		require.False(t, worked)
+	}
+}
+
+func Test_JobQueue_Rescued(t *testing.T) {
+	testDB := databasetest.New(t, databasetest.Config{Schema: true, Migrations: []database.Migration{database.JobQueueMigration(1, "")}})
+	queue := database.NewJobQueue(testDB.Connection(), database.JobQueueConfig{MinBackoff: time.Nanosecond, RescueAfter: time.Millisecond})
+	ctx := context.Background()
+
+	started := map[int]chan bool{1: make(chan bool), 2: make(chan bool)}
+	release := map[int]chan error{1: make(chan error), 2: make(chan error)}
+	queue.Register("send_email", func(ctx context.Context, job database.Job) error {
+		started[job.Attempt] <- true
+		return <-release[job.Attempt]
+	})
+	_, err := queue.Enqueue(testDB.DB(), "send_email", sendEmailJob{To: "user@example.com"}, nil)
+	require.NoError(t, err)
+
+	jobState := func() (string, int, bool) {
+		var state string
+		var attempts int
+		var locked bool
+		require.NoError(t, testDB.DB().Raw("SELECT state, attempts, locked_at IS NOT NULL FROM jobs").Row().Scan(&state, &attempts, &locked))
+		return state, attempts, locked
+	}
+	work := func() chan error {
+		errs := make(chan error, 1)
+		go func() {
+			worked, err := queue.Work(ctx)
+			if err == nil && !worked {
+				err = errors.New("no job")
+			}
+			errs <- err
+		}()
+		return errs
+	}
+
+	t.Log("ok - the stale run doesn't record its state over the rescuing run's")
+	{
+		stale := work()
+		<-started[1]
+		time.Sleep(10 * time.Millisecond)
+		rescuing := work()
+		<-started[2]
+
+		release[1] <- errors.New("smtp unavailable")
+		require.NoError(t, <-stale)
+		state, attempts, locked := jobState()
+		require.Equal(t, "running", state)
+		require.Equal(t, 2, attempts)
+		require.True(t, locked)
+
+		release[2] <- nil
+		require.NoError(t, <-rescuing)
+		state, attempts, _ = jobState()
+		require.Equal(t, "completed", state)
+		require.Equal(t, 2, attempts)
+	}
+}
@@ -0,0 +1,369 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bitrise-io/api-utils/logging"
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultMinReconnectInterval = time.Second
+	defaultMaxReconnectInterval = time.Minute
+	defaultListenerPingInterval = 90 * time.Second
+	// maxNotifyPayloadSize is the limit of Postgres with the default configuration
+	maxNotifyPayloadSize = 8000
+)
+
+// Notification ...
+type Notification struct {
+	Channel string
+	Payload string
+	// PID of the server process of the notifying session
+	PID int
+}
+
+// Decode unmarshals the JSON payload into v
+func (n Notification) Decode(v interface{}) error {
+	if err := json.Unmarshal([]byte(n.Payload), v); err != nil {
+		return errors.Wrapf(err, "Failed to decode notification of channel %s", n.Channel)
+	}
+	return nil
+}
+
+// NotificationHandler ...
+type NotificationHandler func(ctx context.Context, notification Notification)
+
+// ListenerConfig ...
+type ListenerConfig struct {
+	// MinReconnectInterval is the first wait after a connection failure, it's doubled
+	// after every failed attempt up to MaxReconnectInterval. Defaults to 1 second and 1 minute.
+	MinReconnectInterval time.Duration
+	MaxReconnectInterval time.Duration
+	// PingInterval checks the connection when there was no notification, defaults to 90 seconds
+	PingInterval time.Duration
+	// OnReconnect is called after the connection is restored. The notifications sent while
+	// it was down are lost, so it should reload the state the notifications would update.
+	OnReconnect func(ctx context.Context)
+}
+
+// Listener receives the notifications of Postgres channels on a dedicated connection,
+// which is reopened, with the channels listened again, if it's lost
+type Listener struct {
+	config     ListenerConfig
+	connString string
+	provider   PasswordProvider
+	// failures counts the rejected connection attempts since the last connection
+	failures int32
+
+	mu         sync.Mutex
+	listener   *pq.Listener
+	generation int
+	channels   map[string]bool
+	closed     bool
+
+	notify   chan *pq.Notification
+	rejected chan int
+	done     chan struct{}
+}
+
+// NewListener opens the listener's connection, and returns the error of the first
+// connection attempt. pq reconnects with the same connection string, so with a
+// PasswordProvider the listener is reopened with a new password when the server
+// rejects the previous one, e.g. an expired RDS IAM token.
+func NewListener(psql PostgresDatabase, config ListenerConfig) (*Listener, error) {
+	if config.MinReconnectInterval == 0 {
+		config.MinReconnectInterval = defaultMinReconnectInterval
+	}
+	if config.MaxReconnectInterval == 0 {
+		config.MaxReconnectInterval = defaultMaxReconnectInterval
+	}
+	if config.PingInterval == 0 {
+		config.PingInterval = defaultListenerPingInterval
+	}
+	psql, err := psql.withEnvFallbacks()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	connString, err := psql.connectionString(true)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	l := &Listener{
+		config:     config,
+		connString: connString,
+		provider:   psql.PasswordProvider,
+		channels:   map[string]bool{},
+		notify:     make(chan *pq.Notification),
+		rejected:   make(chan int, 1),
+		done:       make(chan struct{}),
+	}
+	if l.provider != nil {
+		password, err := l.provider.Password(context.Background())
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to get database password")
+		}
+		connString += " " + connectionParam("password", password)
+	}
+	connected := make(chan error, 1)
+	l.listener = l.open(connString, false, connected)
+	if err := <-connected; err != nil {
+		if closeErr := l.listener.Close(); closeErr != nil {
+			logging.WithContext(nil).Warn("Failed to close database listener", zap.Error(closeErr))
+		}
+		return nil, errors.Wrap(err, "Failed to connect database listener")
+	}
+	if l.provider != nil {
+		go l.renewPassword()
+	}
+	return l, nil
+}
+
+// open starts a pq.Listener and forwards its notifications. It's called with mu held,
+// or before the Listener is returned. The result of the first connection attempt is
+// sent to connected if it isn't nil.
+func (l *Listener) open(connString string, reopened bool, connected chan<- error) *pq.Listener {
+	generation := l.generation
+	listener := pq.NewListener(connString, l.config.MinReconnectInterval, l.config.MaxReconnectInterval, func(event pq.ListenerEventType, err error) {
+		logListenerEvent(event, err)
+		if connected != nil && (event == pq.ListenerEventConnected || event == pq.ListenerEventConnectionAttemptFailed) {
+			// it's buffered, only the first attempt is sent
+			select {
+			case connected <- err:
+			default:
+			}
+		}
+		switch event {
+		case pq.ListenerEventConnected, pq.ListenerEventReconnected:
+			atomic.StoreInt32(&l.failures, 0)
+			if event == pq.ListenerEventConnected && reopened {
+				// like pq does after reconnecting, the notifications sent while the previous
+				// listener was disconnected are lost
+				go l.send(nil)
+			}
+		case pq.ListenerEventConnectionAttemptFailed:
+			if l.provider != nil && isPermanentConnectError(err) {
+				select {
+				case l.rejected <- generation:
+				default:
+				}
+			}
+		}
+	})
+	go func() {
+		// the channel is closed when the listener is closed
+		for n := range listener.Notify {
+			l.send(n)
+		}
+	}()
+	return listener
+}
+
+func (l *Listener) send(n *pq.Notification) {
+	select {
+	case l.notify <- n:
+	case <-l.done:
+	}
+}
+
+// renewPassword reopens the listener with a new password when the current one is rejected
+func (l *Listener) renewPassword() {
+	for {
+		select {
+		case generation := <-l.rejected:
+			failures := int(atomic.AddInt32(&l.failures, 1))
+			timer := time.NewTimer(ExponentialBackoff(l.config.MinReconnectInterval, l.config.MaxReconnectInterval, failures))
+			select {
+			case <-timer.C:
+				l.reopen(generation)
+			case <-l.done:
+				timer.Stop()
+				return
+			}
+		case <-l.done:
+			return
+		}
+	}
+}
+
+func (l *Listener) reopen(generation int) {
+	password, err := l.provider.Password(context.Background())
+	if err != nil {
+		// the current listener keeps trying, and its next rejected attempt gets here again
+		logging.WithContext(nil).Warn("Failed to get database password for listener", zap.Error(err))
+		return
+	}
+
+	l.mu.Lock()
+	if l.closed || generation != l.generation {
+		l.mu.Unlock()
+		return
+	}
+	previous := l.listener
+	l.generation++
+	l.listener = l.open(l.connString+" "+connectionParam("password", password), true, nil)
+	listener, generation := l.listener, l.generation
+	channels := make([]string, 0, len(l.channels))
+	for channel := range l.channels {
+		channels = append(channels, channel)
+	}
+	l.mu.Unlock()
+
+	if err := previous.Close(); err != nil {
+		logging.WithContext(nil).Warn("Failed to close database listener", zap.Error(err))
+	}
+	// pq's Listen waits for the connection
+	for _, channel := range channels {
+		if err := listener.Listen(channel); err != nil && err != pq.ErrChannelAlreadyOpen && l.current(generation) {
+			logging.WithContext(nil).Error("Failed to listen to channel", zap.String("channel", channel), zap.Error(err))
+		}
+	}
+}
+
+// current reports whether the listener of the generation wasn't replaced or closed
+func (l *Listener) current(generation int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return !l.closed && generation == l.generation
+}
+
+func (l *Listener) currentListener() *pq.Listener {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.listener
+}
+
+// Listen subscribes to the channels
+func (l *Listener) Listen(channels ...string) error {
+	l.mu.Lock()
+	listener := l.listener
+	for _, channel := range channels {
+		l.channels[channel] = true
+	}
+	l.mu.Unlock()
+
+	for _, channel := range channels {
+		if err := listener.Listen(channel); err != nil && err != pq.ErrChannelAlreadyOpen {
+			return errors.Wrapf(err, "Failed to listen to channel %s", channel)
+		}
+	}
+	return nil
+}
+
+// Unlisten unsubscribes from the channels
+func (l *Listener) Unlisten(channels ...string) error {
+	l.mu.Lock()
+	listener := l.listener
+	for _, channel := range channels {
+		delete(l.channels, channel)
+	}
+	l.mu.Unlock()
+
+	for _, channel := range channels {
+		if err := listener.Unlisten(channel); err != nil && err != pq.ErrChannelNotOpen {
+			return errors.Wrapf(err, "Failed to unlisten channel %s", channel)
+		}
+	}
+	return nil
+}
+
+// Run passes the notifications to the handler until the context is cancelled or
+// the listener is closed. It returns the context's error after cancellation, and
+// nil after Close.
+func (l *Listener) Run(ctx context.Context, handler NotificationHandler) error {
+	ticker := time.NewTicker(l.config.PingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case n := <-l.notify:
+			// nil is sent after reconnecting
+			if n == nil {
+				if l.config.OnReconnect != nil {
+					l.config.OnReconnect(ctx)
+				}
+				continue
+			}
+			handler(ctx, Notification{Channel: n.Channel, Payload: n.Extra, PID: n.BePid})
+		case <-ticker.C:
+			listener := l.currentListener()
+			go func() {
+				if err := listener.Ping(); err != nil {
+					logging.WithContext(ctx).Warn("Database listener ping failed", zap.Error(err))
+				}
+			}()
+		case <-l.done:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Notifications delivers the notifications on a channel, which is closed when
+// the context is cancelled or the listener is closed
+func (l *Listener) Notifications(ctx context.Context) <-chan Notification {
+	notifications := make(chan Notification)
+	go func() {
+		defer close(notifications)
+		err := l.Run(ctx, func(ctx context.Context, notification Notification) {
+			select {
+			case notifications <- notification:
+			case <-ctx.Done():
+			}
+		})
+		if err != nil && err != ctx.Err() {
+			logging.WithContext(ctx).Error("Database listener stopped", zap.Error(err))
+		}
+	}()
+	return notifications
+}
+
+// Close closes the connection, Run returns after it
+func (l *Listener) Close() error {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return errors.New("Listener is already closed")
+	}
+	l.closed = true
+	close(l.done)
+	listener := l.listener
+	l.mu.Unlock()
+	return errors.WithStack(listener.Close())
+}
+
+func logListenerEvent(event pq.ListenerEventType, err error) {
+	logger := logging.WithContext(nil)
+	switch event {
+	case pq.ListenerEventDisconnected:
+		logger.Warn("Database listener disconnected", zap.Error(err))
+	case pq.ListenerEventReconnected:
+		logger.Info("Database listener reconnected")
+	case pq.ListenerEventConnectionAttemptFailed:
+		logger.Warn("Database listener failed to connect", zap.Error(err))
+	}
+}
+
+// Notify sends the payload encoded as JSON to the channel's listeners. Called with
+// a transaction the notification is sent when it's committed, and dropped if it's
+// rolled back.
+func Notify(db *gorm.DB, channel string, payload interface{}) error {
+	encoded, err := json.Marshal(payload)
+	if err != nil {
+		return errors.Wrap(err, "Failed to encode notification payload")
+	}
+	if len(encoded) >= maxNotifyPayloadSize {
+		return errors.Errorf("Notification payload is too large: %d bytes", len(encoded))
+	}
+	if err := db.Exec("SELECT pg_notify(?, ?)", channel, string(encoded)).Error; err != nil {
+		return errors.Wrapf(err, "Failed to notify channel %s", channel)
+	}
+	return nil
+}
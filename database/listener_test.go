@@ -0,0 +1,288 @@
+package database_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/bitrise-io/api-utils/database"
+	"github.com/bitrise-io/api-utils/database/databasetest"
+)
+
+type buildStatusChanged struct {
+	BuildID int64  `json:"build_id"`
+	Status  string `json:"status"`
+}
+
+func Test_Notification_Decode(t *testing.T) {
+	t.Log("ok")
+	{
+		event := buildStatusChanged{}
+		require.NoError(t, database.Notification{Channel: "builds", Payload: `{"build_id":42,"status":"success"}`}.Decode(&event))
+		require.Equal(t, buildStatusChanged{BuildID: 42, Status: "success"}, event)
+	}
+	t.Log("error - invalid payload")
+	{
+		err := database.Notification{Channel: "builds", Payload: "42"}.Decode(&buildStatusChanged{})
+		require.EqualError(t, err, "Failed to decode notification of channel builds: json: cannot unmarshal number into Go value of type database_test.buildStatusChanged")
+	}
+}
+
+func Test_Listener(t *testing.T) {
+	testDB := databasetest.New(t, databasetest.Config{Schema: true})
+	listener, err := database.NewListener(database.PostgresDatabase{}, database.ListenerConfig{})
+	require.NoError(t, err)
+	defer func() { require.NoError(t, listener.Close()) }()
+	require.NoError(t, listener.Listen("builds"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	notifications := listener.Notifications(ctx)
+
+	t.Log("ok - rolled back notification is dropped")
+	{
+		tx := testDB.DB().Begin()
+		require.NoError(t, database.Notify(tx, "builds", buildStatusChanged{BuildID: 1, Status: "failed"}))
+		require.NoError(t, tx.Rollback().Error)
+	}
+	t.Log("ok - committed notification is delivered")
+	{
+		tx := testDB.DB().Begin()
+		require.NoError(t, database.Notify(tx, "builds", buildStatusChanged{BuildID: 2, Status: "success"}))
+		require.NoError(t, tx.Commit().Error)
+
+		notification := <-notifications
+		event := buildStatusChanged{}
+		require.NoError(t, notification.Decode(&event))
+		require.Equal(t, buildStatusChanged{BuildID: 2, Status: "success"}, event)
+	}
+}
+
+func Test_Listener_PasswordRotation(t *testing.T) {
+	server := newListenServer(t, "token-1")
+	var mu sync.Mutex
+	token := "token-1"
+	reconnected := make(chan bool, 1)
+	listener, err := database.NewListener(server.config(database.PasswordProviderFunc(func(context.Context) (string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return token, nil
+	})), database.ListenerConfig{
+		MinReconnectInterval: 10 * time.Millisecond,
+		MaxReconnectInterval: 100 * time.Millisecond,
+		OnReconnect: func(context.Context) {
+			select {
+			case reconnected <- true:
+			default:
+			}
+		},
+	})
+	require.NoError(t, err)
+	defer func() { require.NoError(t, listener.Close()) }()
+	require.NoError(t, listener.Listen("builds"))
+	require.Equal(t, `LISTEN "builds"`, server.nextQuery(t))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	notifications := listener.Notifications(ctx)
+
+	t.Log("ok - notification is delivered")
+	{
+		server.notify(t, "builds", `{"build_id":1,"status":"success"}`)
+		require.Equal(t, `{"build_id":1,"status":"success"}`, (<-notifications).Payload)
+	}
+	t.Log("ok - listener is reopened with the new password after the old one is rejected")
+	{
+		mu.Lock()
+		token = "token-2"
+		mu.Unlock()
+		server.rotate("token-2")
+
+		require.Equal(t, `LISTEN "builds"`, server.nextQuery(t))
+		select {
+		case <-reconnected:
+		case <-ctx.Done():
+			t.Fatal("OnReconnect wasn't called")
+		}
+		server.notify(t, "builds", `{"build_id":2,"status":"success"}`)
+		require.Equal(t, `{"build_id":2,"status":"success"}`, (<-notifications).Payload)
+		require.True(t, server.rejectedCount() > 0)
+	}
+}
+
+func Test_NewListener_ConnectionFailed(t *testing.T) {
+	server := newListenServer(t, "token-1")
+
+	t.Log("error - password is rejected")
+	{
+		_, err := database.NewListener(server.config(database.PasswordProviderFunc(func(context.Context) (string, error) {
+			return "token-0", nil
+		})), database.ListenerConfig{})
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "Failed to connect database listener")
+		require.Equal(t, 1, server.rejectedCount())
+	}
+	t.Log("ok - connected")
+	{
+		listener, err := database.NewListener(server.config(database.PasswordProviderFunc(func(context.Context) (string, error) {
+			return "token-1", nil
+		})), database.ListenerConfig{})
+		require.NoError(t, err)
+		require.NoError(t, listener.Close())
+	}
+}
+
+// listenServer speaks enough of the Postgres protocol for a listener: it accepts
+// the connections with the current password, and answers every query
+type listenServer struct {
+	listener net.Listener
+	queries  chan string
+
+	mu       sync.Mutex
+	password string
+	conns    []net.Conn
+	rejected int
+}
+
+func newListenServer(t *testing.T, password string) *listenServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := &listenServer{listener: listener, queries: make(chan string, 10), password: password}
+	t.Cleanup(func() {
+		require.NoError(t, listener.Close())
+		s.rotate("")
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *listenServer) config(provider database.PasswordProvider) database.PostgresDatabase {
+	return database.PostgresDatabase{
+		Host: "127.0.0.1", Port: s.listener.Addr().(*net.TCPAddr).Port, User: "test", DBName: "test", SSLMode: "disable",
+		PasswordProvider: provider,
+	}
+}
+
+func (s *listenServer) serve(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	// startup message, without a type
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		_ = conn.Close()
+		return
+	}
+	if _, err := io.ReadFull(r, make([]byte, binary.BigEndian.Uint32(header)-4)); err != nil {
+		_ = conn.Close()
+		return
+	}
+	// cleartext password authentication
+	_, _ = conn.Write(listenServerMessage('R', 0, 0, 0, 3))
+	_, password, err := readListenServerMessage(r)
+	if err != nil {
+		_ = conn.Close()
+		return
+	}
+
+	s.mu.Lock()
+	if strings.TrimRight(password, "\x00") != s.password {
+		s.rejected++
+		s.mu.Unlock()
+		_, _ = conn.Write(listenServerMessage('E', []byte("SFATAL\x00C28P01\x00Mpassword authentication failed for user \"test\"\x00\x00")...))
+		_ = conn.Close()
+		return
+	}
+	s.conns = append(s.conns, conn)
+	_, _ = conn.Write(append(listenServerMessage('R', 0, 0, 0, 0), listenServerMessage('Z', 'I')...))
+	s.mu.Unlock()
+
+	for {
+		kind, body, err := readListenServerMessage(r)
+		if err != nil || kind == 'X' {
+			_ = conn.Close()
+			return
+		}
+		query := strings.TrimRight(body, "\x00")
+		response := listenServerMessage('I')
+		if query != "" {
+			s.queries <- query
+			response = listenServerMessage('C', []byte(strings.Fields(query)[0]+"\x00")...)
+		}
+		s.mu.Lock()
+		_, _ = conn.Write(append(response, listenServerMessage('Z', 'I')...))
+		s.mu.Unlock()
+	}
+}
+
+// nextQuery returns the next query of the clients
+func (s *listenServer) nextQuery(t *testing.T) string {
+	select {
+	case query := <-s.queries:
+		return query
+	case <-time.After(10 * time.Second):
+		t.Fatal("no query")
+		return ""
+	}
+}
+
+// notify sends the notification on the latest connection
+func (s *listenServer) notify(t *testing.T, channel, payload string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	require.NotEmpty(t, s.conns)
+	body := []byte{0, 0, 0, 42}
+	body = append(body, channel+"\x00"+payload+"\x00"...)
+	_, err := s.conns[len(s.conns)-1].Write(listenServerMessage('A', body...))
+	require.NoError(t, err)
+}
+
+// rotate changes the password and drops the connections
+func (s *listenServer) rotate(password string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.password = password
+	for _, conn := range s.conns {
+		_ = conn.Close()
+	}
+	s.conns = nil
+}
+
+func (s *listenServer) rejectedCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rejected
+}
+
+func listenServerMessage(kind byte, body ...byte) []byte {
+	message := make([]byte, 5, 5+len(body))
+	message[0] = kind
+	binary.BigEndian.PutUint32(message[1:], uint32(4+len(body)))
+	return append(message, body...)
+}
+
+func readListenServerMessage(r *bufio.Reader) (byte, string, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, "", err
+	}
+	body := make([]byte, binary.BigEndian.Uint32(header[1:])-4)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, "", err
+	}
+	return header[0], string(body), nil
+}
@@ -0,0 +1,382 @@
+package database
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/bitrise-io/api-utils/logging"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+const defaultMigrationsTableName = "schema_migrations"
+
+var migrationFileNamePattern = regexp.MustCompile(`^(\d+)_(.+)\.(up|down)\.sql$`)
+
+// Migration ...
+type Migration struct {
+	Version int64
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Checksum of the up SQL, it's recorded when the migration is applied
+func (m Migration) Checksum() string {
+	sum := sha256.Sum256([]byte(m.Up))
+	return hex.EncodeToString(sum[:])
+}
+
+// MigrationStatus ...
+type MigrationStatus struct {
+	Version   int64
+	Name      string
+	Applied   bool
+	AppliedAt time.Time
+	// Drifted is set if the migration was changed or removed after it was applied
+	Drifted bool
+}
+
+// MigrationDriftError is returned if an applied migration was changed or removed
+type MigrationDriftError struct {
+	Version int64
+	Reason  string
+}
+
+func (e *MigrationDriftError) Error() string {
+	return fmt.Sprintf("Migration %d drifted: %s", e.Version, e.Reason)
+}
+
+// LoadMigrations reads the migrations from the directory of the file system. The files
+// have to be named as <version>_<name>.up.sql and <version>_<name>.down.sql, the down
+// migration is optional.
+func LoadMigrations(fsys fs.FS, dir string) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to read migrations directory")
+	}
+
+	byVersion := map[int64]*Migration{}
+	for _, entry := range entries {
+		matches := migrationFileNamePattern.FindStringSubmatch(entry.Name())
+		if entry.IsDir() || matches == nil {
+			continue
+		}
+		version, err := strconv.ParseInt(matches[1], 10, 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid migration version: %s", entry.Name())
+		}
+		content, err := fs.ReadFile(fsys, path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to read migration: %s", entry.Name())
+		}
+
+		migration, ok := byVersion[version]
+		if !ok {
+			migration = &Migration{Version: version, Name: matches[2]}
+			byVersion[version] = migration
+		}
+		if migration.Name != matches[2] {
+			return nil, errors.Errorf("Multiple migrations with version %d", version)
+		}
+		if matches[3] == "up" {
+			migration.Up = string(content)
+		} else {
+			migration.Down = string(content)
+		}
+	}
+
+	migrations := []Migration{}
+	for _, migration := range byVersion {
+		if migration.Up == "" {
+			return nil, errors.Errorf("No up migration for version %d", migration.Version)
+		}
+		migrations = append(migrations, *migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// LoadMigrationsFromDir ...
+func LoadMigrationsFromDir(dir string) ([]Migration, error) {
+	return LoadMigrations(os.DirFS(dir), ".")
+}
+
+// MigratorConfig ...
+type MigratorConfig struct {
+	// TableName of the applied migrations, defaults to schema_migrations
+	TableName string
+	// LockKey of the advisory lock held while migrating, defaults to a hash of the table name
+	LockKey int64
+}
+
+// Migrator applies and rolls back the migrations. It holds a Postgres advisory
+// lock while running, so only one instance of a service migrates at a time.
+type Migrator struct {
+	conn       *Connection
+	migrations []Migration
+	config     MigratorConfig
+}
+
+type appliedMigration struct {
+	checksum  string
+	appliedAt time.Time
+}
+
+// NewMigrator ...
+func NewMigrator(conn *Connection, migrations []Migration, config MigratorConfig) *Migrator {
+	if config.TableName == "" {
+		config.TableName = defaultMigrationsTableName
+	}
+	if config.LockKey == 0 {
+		config.LockKey = AdvisoryLockKey("migrations:" + config.TableName)
+	}
+	sorted := append([]Migration{}, migrations...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Version < sorted[j].Version })
+	return &Migrator{
+		conn:       conn,
+		migrations: sorted,
+		config:     config,
+	}
+}
+
+// Up applies every pending migration
+func (m *Migrator) Up(ctx context.Context) error {
+	return m.withLock(ctx, func(conn *sql.Conn, applied map[int64]appliedMigration) error {
+		for _, migration := range m.migrations {
+			if _, ok := applied[migration.Version]; !ok {
+				if err := m.apply(ctx, conn, migration); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// Down rolls back the last n applied migrations
+func (m *Migrator) Down(ctx context.Context, n int) error {
+	return m.withLock(ctx, func(conn *sql.Conn, applied map[int64]appliedMigration) error {
+		for i := len(m.migrations) - 1; i >= 0 && n > 0; i-- {
+			if _, ok := applied[m.migrations[i].Version]; ok {
+				if err := m.rollback(ctx, conn, m.migrations[i]); err != nil {
+					return err
+				}
+				n--
+			}
+		}
+		return nil
+	})
+}
+
+// To applies the pending migrations up to and including the version, and rolls
+// back the applied ones above it
+func (m *Migrator) To(ctx context.Context, version int64) error {
+	return m.withLock(ctx, func(conn *sql.Conn, applied map[int64]appliedMigration) error {
+		for i := len(m.migrations) - 1; i >= 0; i-- {
+			if _, ok := applied[m.migrations[i].Version]; ok && m.migrations[i].Version > version {
+				if err := m.rollback(ctx, conn, m.migrations[i]); err != nil {
+					return err
+				}
+			}
+		}
+		for _, migration := range m.migrations {
+			if _, ok := applied[migration.Version]; !ok && migration.Version <= version {
+				if err := m.apply(ctx, conn, migration); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// Status returns the state of every known and applied migration, ordered by version.
+// It doesn't write the database, every migration is pending if the table doesn't exist.
+func (m *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	conn, err := m.conn.GetDB().DB().Conn(ctx)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer closeConn(conn)
+	exists, err := m.tableExists(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+	applied := map[int64]appliedMigration{}
+	if exists {
+		if applied, err = m.applied(ctx, conn); err != nil {
+			return nil, err
+		}
+	}
+
+	statuses := []MigrationStatus{}
+	for _, migration := range m.migrations {
+		status := MigrationStatus{Version: migration.Version, Name: migration.Name}
+		if a, ok := applied[migration.Version]; ok {
+			status.Applied = true
+			status.AppliedAt = a.appliedAt
+			status.Drifted = a.checksum != migration.Checksum()
+			delete(applied, migration.Version)
+		}
+		statuses = append(statuses, status)
+	}
+	for version, a := range applied {
+		statuses = append(statuses, MigrationStatus{Version: version, Applied: true, AppliedAt: a.appliedAt, Drifted: true})
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Version < statuses[j].Version })
+	return statuses, nil
+}
+
+func (m *Migrator) withLock(ctx context.Context, fn func(*sql.Conn, map[int64]appliedMigration) error) error {
+	// the migrations run in the session holding the lock
+	return m.conn.WithAdvisoryLock(ctx, m.config.LockKey, func(ctx context.Context, conn *sql.Conn) error {
+		if err := m.createTable(ctx, conn); err != nil {
+			return err
+		}
+		applied, err := m.applied(ctx, conn)
+		if err != nil {
+			return err
+		}
+		if err := m.checkDrift(applied); err != nil {
+			return err
+		}
+		return fn(conn, applied)
+	})
+}
+
+func (m *Migrator) createTable(ctx context.Context, conn *sql.Conn) error {
+	_, err := conn.ExecContext(ctx, fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+		version bigint PRIMARY KEY,
+		name text NOT NULL,
+		checksum text NOT NULL,
+		applied_at timestamptz NOT NULL DEFAULT now()
+	)`, pq.QuoteIdentifier(m.config.TableName)))
+	if err != nil {
+		return errors.Wrap(err, "Failed to create migrations table")
+	}
+	return nil
+}
+
+// tableExists looks up the table in the search path, like the other queries
+func (m *Migrator) tableExists(ctx context.Context, conn *sql.Conn) (bool, error) {
+	var exists bool
+	err := conn.QueryRowContext(ctx, "SELECT to_regclass($1) IS NOT NULL", pq.QuoteIdentifier(m.config.TableName)).Scan(&exists)
+	if err != nil {
+		return false, errors.Wrap(err, "Failed to look up migrations table")
+	}
+	return exists, nil
+}
+
+func (m *Migrator) applied(ctx context.Context, conn *sql.Conn) (map[int64]appliedMigration, error) {
+	rows, err := conn.QueryContext(ctx, fmt.Sprintf("SELECT version, checksum, applied_at FROM %s", pq.QuoteIdentifier(m.config.TableName)))
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to query applied migrations")
+	}
+	defer closeRows(rows)
+
+	applied := map[int64]appliedMigration{}
+	for rows.Next() {
+		var version int64
+		a := appliedMigration{}
+		if err := rows.Scan(&version, &a.checksum, &a.appliedAt); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		applied[version] = a
+	}
+	return applied, errors.WithStack(rows.Err())
+}
+
+func (m *Migrator) checkDrift(applied map[int64]appliedMigration) error {
+	known := map[int64]Migration{}
+	for _, migration := range m.migrations {
+		known[migration.Version] = migration
+	}
+	versions := []int64{}
+	for version := range applied {
+		versions = append(versions, version)
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i] < versions[j] })
+
+	for _, version := range versions {
+		migration, ok := known[version]
+		if !ok {
+			return &MigrationDriftError{Version: version, Reason: "applied migration is missing"}
+		}
+		if migration.Checksum() != applied[version].checksum {
+			return &MigrationDriftError{Version: version, Reason: "checksum mismatch"}
+		}
+	}
+	return nil
+}
+
+func (m *Migrator) apply(ctx context.Context, conn *sql.Conn, migration Migration) error {
+	err := inTx(ctx, conn, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, migration.Up); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, fmt.Sprintf("INSERT INTO %s (version, name, checksum) VALUES ($1, $2, $3)", pq.QuoteIdentifier(m.config.TableName)),
+			migration.Version, migration.Name, migration.Checksum())
+		return err
+	})
+	if err != nil {
+		return errors.Wrapf(err, "Failed to apply migration %d_%s", migration.Version, migration.Name)
+	}
+	logging.WithContext(ctx).Info("Migration applied", zap.Int64("version", migration.Version), zap.String("name", migration.Name))
+	return nil
+}
+
+func (m *Migrator) rollback(ctx context.Context, conn *sql.Conn, migration Migration) error {
+	if migration.Down == "" {
+		return errors.Errorf("No down migration for version %d", migration.Version)
+	}
+	err := inTx(ctx, conn, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, migration.Down); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE version = $1", pq.QuoteIdentifier(m.config.TableName)), migration.Version)
+		return err
+	})
+	if err != nil {
+		return errors.Wrapf(err, "Failed to roll back migration %d_%s", migration.Version, migration.Name)
+	}
+	logging.WithContext(ctx).Info("Migration rolled back", zap.Int64("version", migration.Version), zap.String("name", migration.Name))
+	return nil
+}
+
+func inTx(ctx context.Context, conn *sql.Conn, fn func(*sql.Tx) error) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if err := fn(tx); err != nil {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			logging.WithContext(ctx).Error("Failed to roll back transaction", zap.Error(rollbackErr))
+		}
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(tx.Commit())
+}
+
+func closeConn(conn *sql.Conn) {
+	if err := conn.Close(); err != nil {
+		logging.WithContext(nil).Error("Failed to close connection", zap.Error(err))
+	}
+}
+
+func closeRows(rows *sql.Rows) {
+	if err := rows.Close(); err != nil {
+		logging.WithContext(nil).Error("Failed to close rows", zap.Error(err))
+	}
+}
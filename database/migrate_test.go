@@ -0,0 +1,156 @@
+package database_test
+
+import (
+	"context"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/bitrise-io/api-utils/database"
+	"github.com/bitrise-io/api-utils/database/databasetest"
+)
+
+func Test_LoadMigrations(t *testing.T) {
+	t.Log("ok - sorted by version, down is optional")
+	{
+		fsys := fstest.MapFS{
+			"migrations/002_add_status.up.sql":     {Data: []byte("ALTER TABLE builds ADD COLUMN status text;")},
+			"migrations/002_add_status.down.sql":   {Data: []byte("ALTER TABLE builds DROP COLUMN status;")},
+			"migrations/001_create_builds.up.sql":  {Data: []byte("CREATE TABLE builds (id bigserial PRIMARY KEY);")},
+			"migrations/010_seed.up.sql":           {Data: []byte("INSERT INTO builds DEFAULT VALUES;")},
+			"migrations/README.md":                 {Data: []byte("not a migration")},
+			"migrations/nested/003_ignored.up.sql": {Data: []byte("SELECT 1;")},
+		}
+
+		migrations, err := database.LoadMigrations(fsys, "migrations")
+		require.NoError(t, err)
+		require.Equal(t, []database.Migration{
+			{Version: 1, Name: "create_builds", Up: "CREATE TABLE builds (id bigserial PRIMARY KEY);"},
+			{Version: 2, Name: "add_status", Up: "ALTER TABLE builds ADD COLUMN status text;", Down: "ALTER TABLE builds DROP COLUMN status;"},
+			{Version: 10, Name: "seed", Up: "INSERT INTO builds DEFAULT VALUES;"},
+		}, migrations)
+	}
+	t.Log("error - missing up migration")
+	{
+		fsys := fstest.MapFS{
+			"migrations/001_create_builds.down.sql": {Data: []byte("DROP TABLE builds;")},
+		}
+
+		_, err := database.LoadMigrations(fsys, "migrations")
+		require.EqualError(t, err, "No up migration for version 1")
+	}
+	t.Log("error - duplicated version")
+	{
+		fsys := fstest.MapFS{
+			"migrations/001_create_builds.up.sql": {Data: []byte("CREATE TABLE builds (id bigserial PRIMARY KEY);")},
+			"migrations/001_create_apps.up.sql":   {Data: []byte("CREATE TABLE apps (id bigserial PRIMARY KEY);")},
+		}
+
+		_, err := database.LoadMigrations(fsys, "migrations")
+		require.EqualError(t, err, "Multiple migrations with version 1")
+	}
+}
+
+var migratorTestMigrations = []database.Migration{
+	{Version: 1, Name: "create_builds", Up: "CREATE TABLE builds (id bigserial PRIMARY KEY);", Down: "DROP TABLE builds;"},
+	{Version: 2, Name: "add_status", Up: "ALTER TABLE builds ADD COLUMN status text;", Down: "ALTER TABLE builds DROP COLUMN status;"},
+	{Version: 3, Name: "create_apps", Up: "CREATE TABLE apps (id bigserial PRIMARY KEY);", Down: "DROP TABLE apps;"},
+}
+
+func appliedVersions(t *testing.T, migrator *database.Migrator) []int64 {
+	statuses, err := migrator.Status(context.Background())
+	require.NoError(t, err)
+	versions := []int64{}
+	for _, status := range statuses {
+		if status.Applied {
+			versions = append(versions, status.Version)
+		}
+	}
+	return versions
+}
+
+func tableExists(t *testing.T, testDB *databasetest.Database, table string) bool {
+	var exists bool
+	require.NoError(t, testDB.DB().Raw("SELECT to_regclass(?) IS NOT NULL", table).Row().Scan(&exists))
+	return exists
+}
+
+func Test_Migrator(t *testing.T) {
+	testDB := databasetest.New(t, databasetest.Config{Schema: true})
+	ctx := context.Background()
+	migrator := database.NewMigrator(testDB.Connection(), migratorTestMigrations, database.MigratorConfig{})
+
+	t.Log("ok - status without the migrations table doesn't create it")
+	{
+		statuses, err := migrator.Status(ctx)
+		require.NoError(t, err)
+		require.Equal(t, []database.MigrationStatus{
+			{Version: 1, Name: "create_builds"},
+			{Version: 2, Name: "add_status"},
+			{Version: 3, Name: "create_apps"},
+		}, statuses)
+		require.False(t, tableExists(t, testDB, "schema_migrations"))
+	}
+	t.Log("ok - up applies the pending migrations")
+	{
+		require.NoError(t, migrator.Up(ctx))
+		require.Equal(t, []int64{1, 2, 3}, appliedVersions(t, migrator))
+		require.True(t, tableExists(t, testDB, "apps"))
+
+		require.NoError(t, migrator.Up(ctx))
+		require.Equal(t, []int64{1, 2, 3}, appliedVersions(t, migrator))
+	}
+	t.Log("ok - down rolls back the last migrations")
+	{
+		require.NoError(t, migrator.Down(ctx, 2))
+		require.Equal(t, []int64{1}, appliedVersions(t, migrator))
+		require.False(t, tableExists(t, testDB, "apps"))
+		require.True(t, tableExists(t, testDB, "builds"))
+	}
+	t.Log("ok - to applies and rolls back up to the version")
+	{
+		require.NoError(t, migrator.To(ctx, 2))
+		require.Equal(t, []int64{1, 2}, appliedVersions(t, migrator))
+		require.False(t, tableExists(t, testDB, "apps"))
+
+		require.NoError(t, migrator.To(ctx, 3))
+		require.Equal(t, []int64{1, 2, 3}, appliedVersions(t, migrator))
+
+		require.NoError(t, migrator.To(ctx, 1))
+		require.Equal(t, []int64{1}, appliedVersions(t, migrator))
+		require.NoError(t, migrator.Up(ctx))
+	}
+	t.Log("error - changed applied migration")
+	{
+		changed := append([]database.Migration{}, migratorTestMigrations...)
+		changed[1].Up = "ALTER TABLE builds ADD COLUMN status text NOT NULL;"
+		changedMigrator := database.NewMigrator(testDB.Connection(), changed, database.MigratorConfig{})
+
+		err := changedMigrator.Up(ctx)
+		require.EqualError(t, err, "Migration 2 drifted: checksum mismatch")
+		statuses, err := changedMigrator.Status(ctx)
+		require.NoError(t, err)
+		require.True(t, statuses[1].Drifted)
+		require.False(t, statuses[0].Drifted)
+	}
+	t.Log("error - removed applied migration")
+	{
+		removedMigrator := database.NewMigrator(testDB.Connection(), migratorTestMigrations[:2], database.MigratorConfig{})
+
+		err := removedMigrator.Down(ctx, 1)
+		require.EqualError(t, err, "Migration 3 drifted: applied migration is missing")
+		require.Equal(t, []int64{1, 2, 3}, appliedVersions(t, migrator))
+	}
+	t.Log("error - missing down migration")
+	{
+		withoutDown := append([]database.Migration{}, migratorTestMigrations...)
+		withoutDown[2].Down = ""
+		withoutDownMigrator := database.NewMigrator(testDB.Connection(), withoutDown, database.MigratorConfig{})
+
+		err := withoutDownMigrator.Down(ctx, 1)
+		require.EqualError(t, err, "No down migration for version 3")
+		require.Equal(t, []int64{1, 2, 3}, appliedVersions(t, migrator))
+		require.True(t, tableExists(t, testDB, "apps"))
+	}
+}
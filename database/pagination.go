@@ -0,0 +1,290 @@
+package database
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/bitrise-io/api-utils/httpresponse"
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultPageLimit = 20
+	defaultMaxLimit  = 100
+
+	// LimitQueryParam ...
+	LimitQueryParam = "limit"
+)
+
+// SortColumn ...
+type SortColumn struct {
+	// Name of the column, it can be qualified with the table's name
+	Name string
+	Desc bool
+}
+
+// PaginationOptions ...
+type PaginationOptions struct {
+	// Columns to sort by, the last one has to be unique (e.g. the primary key)
+	// and none of them can be NULL
+	Columns []SortColumn
+	// Secret signs the cursors, so the clients can't forge or alter them
+	Secret []byte
+	Cursor string
+	// Limit of the page, defaults to 20
+	Limit int
+	// MaxLimit of the page, defaults to 100
+	MaxLimit int
+}
+
+// Page ...
+type Page struct {
+	// NextCursor and PrevCursor are empty on the last and on the first page
+	NextCursor string
+	PrevCursor string
+	Limit      int
+}
+
+// PagingInfo returns the paging of the httpresponse.RespondWithPage envelope
+func (p *Page) PagingInfo() httpresponse.PagingInfoRespModel {
+	return httpresponse.PagingInfoRespModel{Next: p.NextCursor, Prev: p.PrevCursor, Limit: p.Limit}
+}
+
+// PageRequestError is returned for invalid cursors and limits, these are errors of the client
+type PageRequestError struct {
+	Reason string
+}
+
+func (e *PageRequestError) Error() string {
+	return e.Reason
+}
+
+type cursor struct {
+	Prev   bool          `json:"p,omitempty"`
+	Sort   string        `json:"s"`
+	Values []interface{} `json:"v"`
+}
+
+// WithQuery returns the options with the cursor and limit of the query parameters
+func (o PaginationOptions) WithQuery(query url.Values) (PaginationOptions, error) {
+	o.Cursor = query.Get(httpresponse.CursorQueryParam)
+	if limit := query.Get(LimitQueryParam); limit != "" {
+		l, err := strconv.Atoi(limit)
+		if err != nil || l < 1 {
+			return o, &PageRequestError{Reason: "Invalid limit"}
+		}
+		o.Limit = l
+	}
+	return o, nil
+}
+
+// Paginate loads a page of the scope into dest, a pointer to a slice of models, using keyset
+// pagination: instead of an offset, the page starts after the sort values of the cursor's row.
+// The scope must not be ordered, the order is set by the Columns.
+func Paginate(scope *gorm.DB, dest interface{}, opts PaginationOptions) (*Page, error) {
+	if len(opts.Columns) == 0 {
+		return nil, errors.New("No sort columns specified")
+	}
+	if len(opts.Secret) == 0 {
+		return nil, errors.New("No cursor secret specified")
+	}
+	destValue := reflect.ValueOf(dest)
+	if destValue.Kind() != reflect.Ptr || destValue.Elem().Kind() != reflect.Slice {
+		return nil, errors.Errorf("Destination has to be a pointer to a slice, got %T", dest)
+	}
+	if opts.MaxLimit <= 0 {
+		opts.MaxLimit = defaultMaxLimit
+	}
+	if opts.Limit <= 0 {
+		opts.Limit = defaultPageLimit
+	}
+	if opts.Limit > opts.MaxLimit {
+		opts.Limit = opts.MaxLimit
+	}
+
+	sortKey := paginationSortKey(opts.Columns)
+	var current *cursor
+	if opts.Cursor != "" {
+		c, err := decodeCursor(opts.Cursor, opts.Secret)
+		if err != nil {
+			return nil, err
+		}
+		if c.Sort != sortKey || len(c.Values) != len(opts.Columns) {
+			return nil, &PageRequestError{Reason: "Invalid cursor"}
+		}
+		current = c
+	}
+	backward := current != nil && current.Prev
+
+	query := scope
+	if current != nil {
+		condition, values := keysetCondition(opts.Columns, current.Values, backward)
+		query = query.Where(condition, values...)
+	}
+	for _, column := range opts.Columns {
+		// the order is reversed when paging backward, and the rows are reversed after loading
+		if column.Desc != backward {
+			query = query.Order(column.Name + " DESC")
+		} else {
+			query = query.Order(column.Name + " ASC")
+		}
+	}
+	if err := query.Limit(opts.Limit + 1).Find(dest).Error; err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	rows := destValue.Elem()
+	hasMore := rows.Len() > opts.Limit
+	if hasMore {
+		rows.Set(rows.Slice(0, opts.Limit))
+	}
+	if backward {
+		swap := reflect.Swapper(rows.Interface())
+		for i, j := 0, rows.Len()-1; i < j; i, j = i+1, j-1 {
+			swap(i, j)
+		}
+	}
+
+	page := &Page{Limit: opts.Limit}
+	if rows.Len() == 0 {
+		return page, nil
+	}
+	hasNext, hasPrev := hasMore, current != nil
+	if backward {
+		hasNext, hasPrev = true, hasMore
+	}
+	var err error
+	if hasNext {
+		if page.NextCursor, err = encodeRowCursor(scope, rows.Index(rows.Len()-1), opts, sortKey, false); err != nil {
+			return nil, err
+		}
+	}
+	if hasPrev {
+		if page.PrevCursor, err = encodeRowCursor(scope, rows.Index(0), opts, sortKey, true); err != nil {
+			return nil, err
+		}
+	}
+	return page, nil
+}
+
+// keysetCondition selects the rows after the values in the sort order: a row comparison
+// if every column has the same direction, so it can use a multi-column index, and
+// (a > ?) OR (a = ? AND b > ?) ... otherwise
+func keysetCondition(columns []SortColumn, values []interface{}, backward bool) (string, []interface{}) {
+	operator := func(column SortColumn) string {
+		if column.Desc != backward {
+			return "<"
+		}
+		return ">"
+	}
+
+	sameDirection := true
+	for _, column := range columns[1:] {
+		if column.Desc != columns[0].Desc {
+			sameDirection = false
+		}
+	}
+	if sameDirection {
+		names := make([]string, 0, len(columns))
+		placeholders := make([]string, 0, len(columns))
+		for _, column := range columns {
+			names = append(names, column.Name)
+			placeholders = append(placeholders, "?")
+		}
+		return "(" + strings.Join(names, ", ") + ") " + operator(columns[0]) + " (" + strings.Join(placeholders, ", ") + ")", values
+	}
+
+	conditions := []string{}
+	args := []interface{}{}
+	for i, column := range columns {
+		parts := []string{}
+		for j := 0; j < i; j++ {
+			parts = append(parts, columns[j].Name+" = ?")
+			args = append(args, values[j])
+		}
+		parts = append(parts, column.Name+" "+operator(column)+" ?")
+		args = append(args, values[i])
+		conditions = append(conditions, "("+strings.Join(parts, " AND ")+")")
+	}
+	return "(" + strings.Join(conditions, " OR ") + ")", args
+}
+
+func paginationSortKey(columns []SortColumn) string {
+	parts := make([]string, 0, len(columns))
+	for _, column := range columns {
+		if column.Desc {
+			parts = append(parts, column.Name+" desc")
+		} else {
+			parts = append(parts, column.Name)
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+func encodeRowCursor(scope *gorm.DB, row reflect.Value, opts PaginationOptions, sortKey string, prev bool) (string, error) {
+	if row.Kind() != reflect.Ptr {
+		row = row.Addr()
+	}
+	rowScope := scope.NewScope(row.Interface())
+	values := make([]interface{}, 0, len(opts.Columns))
+	for _, column := range opts.Columns {
+		name := column.Name
+		if i := strings.LastIndex(name, "."); i >= 0 {
+			name = name[i+1:]
+		}
+		field, ok := rowScope.FieldByName(name)
+		if !ok {
+			return "", errors.Errorf("No field for sort column %s", column.Name)
+		}
+		values = append(values, field.Field.Interface())
+	}
+	return encodeCursor(cursor{Prev: prev, Sort: sortKey, Values: values}, opts.Secret)
+}
+
+// encodeCursor returns the base64 encoded JSON payload and its HMAC-SHA256 signature
+func encodeCursor(c cursor, secret []byte) (string, error) {
+	payload, err := json.Marshal(c)
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to encode cursor")
+	}
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(cursorSignature(payload, secret)), nil
+}
+
+func decodeCursor(encoded string, secret []byte) (*cursor, error) {
+	invalid := &PageRequestError{Reason: "Invalid cursor"}
+	parts := strings.Split(encoded, ".")
+	if len(parts) != 2 {
+		return nil, invalid
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, invalid
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(signature, cursorSignature(payload, secret)) {
+		return nil, invalid
+	}
+
+	// numbers are kept as strings, so big IDs don't lose precision as floats
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber()
+	c := &cursor{}
+	if err := decoder.Decode(c); err != nil {
+		return nil, invalid
+	}
+	return c, nil
+}
+
+func cursorSignature(payload, secret []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
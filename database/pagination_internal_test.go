@@ -0,0 +1,58 @@
+package database
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_keysetCondition(t *testing.T) {
+	t.Log("ok - same direction uses a row comparison")
+	{
+		condition, args := keysetCondition([]SortColumn{{Name: "created_at", Desc: true}, {Name: "id", Desc: true}}, []interface{}{"2020-01-01", 42}, false)
+		require.Equal(t, "(created_at, id) < (?, ?)", condition)
+		require.Equal(t, []interface{}{"2020-01-01", 42}, args)
+
+		condition, _ = keysetCondition([]SortColumn{{Name: "created_at", Desc: true}, {Name: "id", Desc: true}}, []interface{}{"2020-01-01", 42}, true)
+		require.Equal(t, "(created_at, id) > (?, ?)", condition)
+	}
+	t.Log("ok - mixed directions")
+	{
+		condition, args := keysetCondition([]SortColumn{{Name: "status"}, {Name: "builds.id", Desc: true}}, []interface{}{"running", 42}, false)
+		require.Equal(t, "((status > ?) OR (status = ? AND builds.id < ?))", condition)
+		require.Equal(t, []interface{}{"running", "running", 42}, args)
+	}
+}
+
+func Test_cursor(t *testing.T) {
+	secret := []byte("secret")
+	encoded, err := encodeCursor(cursor{Prev: true, Sort: "id desc", Values: []interface{}{int64(9007199254740993)}}, secret)
+	require.NoError(t, err)
+
+	t.Log("ok - round trip keeps big numbers")
+	{
+		c, err := decodeCursor(encoded, secret)
+		require.NoError(t, err)
+		require.Equal(t, &cursor{Prev: true, Sort: "id desc", Values: []interface{}{json.Number("9007199254740993")}}, c)
+	}
+	t.Log("error - other secret")
+	{
+		_, err := decodeCursor(encoded, []byte("other"))
+		require.Equal(t, &PageRequestError{Reason: "Invalid cursor"}, err)
+	}
+	t.Log("error - tampered payload")
+	{
+		tampered, err := encodeCursor(cursor{Sort: "id desc", Values: []interface{}{1}}, secret)
+		require.NoError(t, err)
+		tampered = strings.Split(tampered, ".")[0] + "." + strings.Split(encoded, ".")[1]
+		_, err = decodeCursor(tampered, secret)
+		require.Equal(t, &PageRequestError{Reason: "Invalid cursor"}, err)
+	}
+	t.Log("error - malformed")
+	{
+		_, err := decodeCursor("not-a-cursor", secret)
+		require.Equal(t, &PageRequestError{Reason: "Invalid cursor"}, err)
+	}
+}
@@ -0,0 +1,98 @@
+package database_test
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/bitrise-io/api-utils/database"
+	"github.com/bitrise-io/api-utils/database/databasetest"
+)
+
+type paginatedBuild struct {
+	ID        int64
+	Status    string
+	CreatedAt time.Time
+}
+
+func (paginatedBuild) TableName() string {
+	return "builds"
+}
+
+func Test_PaginationOptions_WithQuery(t *testing.T) {
+	t.Log("ok - cursor and limit")
+	{
+		opts, err := database.PaginationOptions{Limit: 10}.WithQuery(url.Values{"cursor": {"abc"}, "limit": {"50"}})
+		require.NoError(t, err)
+		require.Equal(t, database.PaginationOptions{Cursor: "abc", Limit: 50}, opts)
+	}
+	t.Log("ok - default limit")
+	{
+		opts, err := database.PaginationOptions{Limit: 10}.WithQuery(url.Values{})
+		require.NoError(t, err)
+		require.Equal(t, database.PaginationOptions{Limit: 10}, opts)
+	}
+	t.Log("error - invalid limit")
+	{
+		_, err := database.PaginationOptions{}.WithQuery(url.Values{"limit": {"-1"}})
+		require.EqualError(t, err, "Invalid limit")
+	}
+}
+
+func Test_Paginate(t *testing.T) {
+	testDB := databasetest.New(t, databasetest.Config{
+		Schema:     true,
+		Rollback:   true,
+		Migrations: []database.Migration{{Version: 1, Name: "create_builds", Up: "CREATE TABLE builds (id bigserial PRIMARY KEY, status text NOT NULL, created_at timestamptz NOT NULL);"}},
+	})
+	createdAt := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		// two builds per timestamp, so the id breaks the ties
+		require.NoError(t, testDB.DB().Create(&paginatedBuild{Status: "success", CreatedAt: createdAt.Add(time.Duration(i/2) * time.Hour)}).Error)
+	}
+	opts := database.PaginationOptions{
+		Columns: []database.SortColumn{{Name: "created_at", Desc: true}, {Name: "id", Desc: true}},
+		Secret:  []byte("secret"),
+		Limit:   2,
+	}
+	ids := func(builds []paginatedBuild) []int64 {
+		result := []int64{}
+		for _, build := range builds {
+			result = append(result, build.ID)
+		}
+		return result
+	}
+
+	var builds []paginatedBuild
+	first, err := database.Paginate(testDB.DB(), &builds, opts)
+	require.NoError(t, err)
+	require.Equal(t, []int64{5, 4}, ids(builds))
+	require.Empty(t, first.PrevCursor)
+
+	builds = nil
+	opts.Cursor = first.NextCursor
+	second, err := database.Paginate(testDB.DB(), &builds, opts)
+	require.NoError(t, err)
+	require.Equal(t, []int64{3, 2}, ids(builds))
+
+	builds = nil
+	opts.Cursor = second.NextCursor
+	last, err := database.Paginate(testDB.DB(), &builds, opts)
+	require.NoError(t, err)
+	require.Equal(t, []int64{1}, ids(builds))
+	require.Empty(t, last.NextCursor)
+
+	builds = nil
+	opts.Cursor = last.PrevCursor
+	prev, err := database.Paginate(testDB.DB(), &builds, opts)
+	require.NoError(t, err)
+	require.Equal(t, []int64{3, 2}, ids(builds))
+	require.NotEmpty(t, prev.PrevCursor)
+	require.NotEmpty(t, prev.NextCursor)
+
+	opts.Columns = []database.SortColumn{{Name: "id"}}
+	_, err = database.Paginate(testDB.DB(), &builds, opts)
+	require.EqualError(t, err, "Invalid cursor")
+}
@@ -0,0 +1,117 @@
+package database
+
+import (
+	"context"
+	"database/sql/driver"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+// PasswordProvider returns the current password of the database user. It's called
+// for every new connection of the pool, so the credential can change while the pool
+// is open, e.g. with short-lived tokens.
+type PasswordProvider interface {
+	Password(ctx context.Context) (string, error)
+}
+
+// TLSPasswordProvider is a PasswordProvider whose passwords must only be sent over
+// an encrypted connection, e.g. RDS IAM tokens, so sslmode=disable is refused with it
+type TLSPasswordProvider interface {
+	PasswordProvider
+	RequiresTLS() bool
+}
+
+// PasswordProviderFunc ...
+type PasswordProviderFunc func(ctx context.Context) (string, error)
+
+// Password ...
+func (f PasswordProviderFunc) Password(ctx context.Context) (string, error) {
+	return f(ctx)
+}
+
+// EnvPasswordProvider reads the password from an environment variable, DB_PWD if
+// Key isn't specified
+type EnvPasswordProvider struct {
+	Key string
+}
+
+// Password ...
+func (p EnvPasswordProvider) Password(ctx context.Context) (string, error) {
+	key := p.Key
+	if key == "" {
+		key = "DB_PWD"
+	}
+	password := os.Getenv(key)
+	if password == "" {
+		return "", errors.Errorf("No database password in %s", key)
+	}
+	return password, nil
+}
+
+// FilePasswordProvider reads the password from a file, e.g. a mounted Kubernetes
+// secret. The file is read again when it's modified, the trailing newline is trimmed.
+type FilePasswordProvider struct {
+	path string
+
+	mu       sync.Mutex
+	modTime  time.Time
+	size     int64
+	password string
+}
+
+// NewFilePasswordProvider ...
+func NewFilePasswordProvider(path string) *FilePasswordProvider {
+	return &FilePasswordProvider{path: path}
+}
+
+// Password ...
+func (p *FilePasswordProvider) Password(ctx context.Context) (string, error) {
+	info, err := os.Stat(p.path)
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to read database password file")
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.password != "" && info.ModTime().Equal(p.modTime) && info.Size() == p.size {
+		return p.password, nil
+	}
+	content, err := ioutil.ReadFile(p.path)
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to read database password file")
+	}
+	password := strings.TrimRight(string(content), "\r\n")
+	if password == "" {
+		return "", errors.Errorf("Database password file %s is empty", p.path)
+	}
+	p.password, p.modTime, p.size = password, info.ModTime(), info.Size()
+	return password, nil
+}
+
+// passwordConnector opens the connections with the current password of the provider
+type passwordConnector struct {
+	connString string
+	provider   PasswordProvider
+}
+
+func (c *passwordConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	password, err := c.provider.Password(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to get database password")
+	}
+	connector, err := pq.NewConnector(c.connString + " " + connectionParam("password", password))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return connector.Connect(ctx)
+}
+
+func (c *passwordConnector) Driver() driver.Driver {
+	return &pq.Driver{}
+}
@@ -0,0 +1,81 @@
+package database
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_EnvPasswordProvider(t *testing.T) {
+	t.Log("ok - DB_PWD by default")
+	{
+		require.NoError(t, os.Setenv("DB_PWD", "secret"))
+		defer os.Unsetenv("DB_PWD")
+
+		password, err := EnvPasswordProvider{}.Password(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, "secret", password)
+	}
+	t.Log("not ok - not set")
+	{
+		_, err := EnvPasswordProvider{Key: "DB_PWD_NOT_SET"}.Password(context.Background())
+		require.EqualError(t, err, "No database password in DB_PWD_NOT_SET")
+	}
+}
+
+func Test_FilePasswordProvider(t *testing.T) {
+	dir, err := ioutil.TempDir("", "password")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "password")
+	provider := NewFilePasswordProvider(path)
+
+	t.Log("not ok - missing file")
+	{
+		_, err := provider.Password(context.Background())
+		require.Error(t, err)
+	}
+	t.Log("ok - trailing newline is trimmed")
+	{
+		require.NoError(t, ioutil.WriteFile(path, []byte("secret\n"), 0600))
+		password, err := provider.Password(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, "secret", password)
+	}
+	t.Log("ok - reloaded when modified")
+	{
+		require.NoError(t, ioutil.WriteFile(path, []byte("rotated\n"), 0600))
+		require.NoError(t, os.Chtimes(path, time.Now().Add(time.Minute), time.Now().Add(time.Minute)))
+		password, err := provider.Password(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, "rotated", password)
+	}
+	t.Log("not ok - empty file")
+	{
+		require.NoError(t, ioutil.WriteFile(path, []byte("\n"), 0600))
+		require.NoError(t, os.Chtimes(path, time.Now().Add(2*time.Minute), time.Now().Add(2*time.Minute)))
+		_, err := provider.Password(context.Background())
+		require.EqualError(t, err, "Database password file "+path+" is empty")
+	}
+}
+
+func Test_NewConnection_PasswordProvider(t *testing.T) {
+	t.Log("not ok - the provider is asked for the connection")
+	{
+		calls := 0
+		provider := PasswordProviderFunc(func(ctx context.Context) (string, error) {
+			calls++
+			return "", errors.New("token expired")
+		})
+		_, err := NewConnection(PostgresDatabase{Host: "127.0.0.1", Port: 1, User: "test", DBName: "test", PasswordProvider: provider}, true)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "Failed to get database password: token expired")
+		require.True(t, calls > 0)
+	}
+}
@@ -1,10 +1,13 @@
 package database
 
 import (
-	"fmt"
 	"log"
 	"os"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
 
 	"github.com/jinzhu/gorm"
 	"github.com/pkg/errors"
@@ -15,10 +18,14 @@ import (
 
 const (
 	dbDialect string = "postgres"
+
+	defaultConnectTimeout = 10 * time.Second
 )
 
 var (
-	sqlDB *gorm.DB
+	// the connection of the deprecated PostgresDatabase methods
+	defaultConnectionLock sync.RWMutex
+	defaultConnection     *Connection
 )
 
 // PostgresDatabase ...
@@ -28,51 +35,83 @@ type PostgresDatabase struct {
 	DBName   string
 	Password string
 	SSLMode  string
+
+	// PasswordProvider is used instead of Password if it's set, it's asked for the
+	// password of every new connection
+	PasswordProvider PasswordProvider
+
+	// optionals
+	Port             int
+	ConnectTimeout   time.Duration // defaults to 10 seconds
+	StatementTimeout time.Duration // not applied through PgBouncer, see connectionString
+	ApplicationName  string
+	SearchPath       string
+	SSLRootCert      string
+	SSLCert          string
+	SSLKey           string
+
+	// connection pool, zero values keep the database/sql defaults
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+
+	// query logging, the bound parameters are redacted unless LogQueryParams is set
+	LogQueries         bool
+	LogQueryParams     bool
+	SlowQueryThreshold time.Duration
 }
 
-// GetDB ...
+// GetDB returns the connection opened by InitializeConnection
+//
+// Deprecated: use NewConnection and the returned Connection instead.
 func (psql PostgresDatabase) GetDB() *gorm.DB {
-	return sqlDB
+	defaultConnectionLock.RLock()
+	defer defaultConnectionLock.RUnlock()
+	if defaultConnection == nil {
+		return nil
+	}
+	return defaultConnection.GetDB()
 }
 
-// Close ...
+// Close closes the connection opened by InitializeConnection
+//
+// Deprecated: use NewConnection and the returned Connection instead.
 func (psql PostgresDatabase) Close() {
-	closeDB(sqlDB)
-	setDB(nil)
+	defaultConnectionLock.Lock()
+	defer defaultConnectionLock.Unlock()
+	if defaultConnection != nil {
+		if err := defaultConnection.Close(); err != nil {
+			log.Printf(" [!] Exception: Failed to close DB: %+v", err)
+		}
+		defaultConnection = nil
+	}
 }
 
-// InitializeConnection ...
+// InitializeConnection opens the connection returned by GetDB, it's shared by
+// every PostgresDatabase in the process. The connection of a previous call is
+// closed, so the *gorm.DB values returned by GetDB before can't be used anymore.
+//
+// Deprecated: use NewConnection and the returned Connection instead.
 func (psql PostgresDatabase) InitializeConnection(withDB bool) error {
-	connString, err := psql.connectionString(withDB)
+	conn, err := NewConnection(psql, withDB)
 	if err != nil {
 		return errors.WithStack(err)
 	}
-	db, err := gorm.Open(dbDialect, connString)
-	if err != nil {
-		return errors.Wrap(err, "Failed to open database")
-	}
-	setDB(db)
-	if err = sqlDB.DB().Ping(); err != nil {
-		closeDB(sqlDB)
-		return errors.Wrap(err, "Failed to ping database")
-	}
-	isLogModeEnabled, err := strconv.ParseBool(os.Getenv("GORM_LOG_MODE_ENABLED"))
-	if err == nil && isLogModeEnabled {
-		sqlDB.LogMode(true)
-	}
+	setDefaultConnection(conn)
 	return nil
 }
 
-func setDB(sdb *gorm.DB) {
-	sqlDB = sdb
-}
-
-func closeDB(dbToClose *gorm.DB) {
-	if dbToClose != nil {
-		if err := dbToClose.Close(); err != nil {
+// setDefaultConnection replaces the connection of the deprecated methods and
+// closes the previous one
+func setDefaultConnection(conn *Connection) {
+	defaultConnectionLock.Lock()
+	defer defaultConnectionLock.Unlock()
+	if defaultConnection != nil {
+		if err := defaultConnection.Close(); err != nil {
 			log.Printf(" [!] Exception: Failed to close DB: %+v", err)
 		}
 	}
+	defaultConnection = conn
 }
 
 func (psql PostgresDatabase) validate() error {
@@ -85,13 +124,17 @@ func (psql PostgresDatabase) validate() error {
 	if psql.User == "" {
 		return errors.New("No database user specified")
 	}
-	if psql.Password == "" {
+	if psql.Password == "" && psql.PasswordProvider == nil {
 		return errors.New("No database password specified")
 	}
+	// pq uses require if sslmode isn't set
+	if provider, ok := psql.PasswordProvider.(TLSPasswordProvider); ok && provider.RequiresTLS() && psql.SSLMode == "disable" {
+		return errors.New("Database password provider requires TLS, sslmode=disable isn't supported")
+	}
 	return nil
 }
 
-func (psql PostgresDatabase) connectionString(withDB bool) (string, error) {
+func (psql PostgresDatabase) withEnvFallbacks() (PostgresDatabase, error) {
 	if psql.Host == "" {
 		psql.Host = os.Getenv("DB_HOST")
 	}
@@ -101,23 +144,183 @@ func (psql PostgresDatabase) connectionString(withDB bool) (string, error) {
 	if psql.User == "" {
 		psql.User = os.Getenv("DB_USER")
 	}
-	if psql.Password == "" {
+	if psql.Password == "" && psql.PasswordProvider == nil {
 		psql.Password = os.Getenv("DB_PWD")
+		if path := os.Getenv("DB_PWD_FILE"); psql.Password == "" && path != "" {
+			psql.PasswordProvider = NewFilePasswordProvider(path)
+		}
 	}
 	if psql.SSLMode == "" {
 		psql.SSLMode = os.Getenv("DB_SSL_MODE")
 	}
+	if psql.ApplicationName == "" {
+		psql.ApplicationName = os.Getenv("DB_APPLICATION_NAME")
+	}
+	if psql.SearchPath == "" {
+		psql.SearchPath = os.Getenv("DB_SEARCH_PATH")
+	}
+	if psql.SSLRootCert == "" {
+		psql.SSLRootCert = os.Getenv("DB_SSL_ROOT_CERT")
+	}
+	if psql.SSLCert == "" {
+		psql.SSLCert = os.Getenv("DB_SSL_CERT")
+	}
+	if psql.SSLKey == "" {
+		psql.SSLKey = os.Getenv("DB_SSL_KEY")
+	}
+
+	if !psql.LogQueries {
+		// invalid values are ignored, as they were when this enabled gorm's LogMode
+		psql.LogQueries, _ = strconv.ParseBool(os.Getenv("GORM_LOG_MODE_ENABLED"))
+	}
+
+	var err error
+	if !psql.LogQueryParams {
+		if psql.LogQueryParams, err = boolFromEnv("DB_LOG_QUERY_PARAMS"); err != nil {
+			return psql, err
+		}
+	}
+	if psql.Port == 0 {
+		if psql.Port, err = intFromEnv("DB_PORT"); err != nil {
+			return psql, err
+		}
+	}
+	if psql.MaxOpenConns == 0 {
+		if psql.MaxOpenConns, err = intFromEnv("DB_MAX_OPEN_CONNS"); err != nil {
+			return psql, err
+		}
+	}
+	if psql.MaxIdleConns == 0 {
+		if psql.MaxIdleConns, err = intFromEnv("DB_MAX_IDLE_CONNS"); err != nil {
+			return psql, err
+		}
+	}
+	if psql.ConnectTimeout == 0 {
+		if psql.ConnectTimeout, err = durationFromEnv("DB_CONNECT_TIMEOUT"); err != nil {
+			return psql, err
+		}
+	}
+	if psql.StatementTimeout == 0 {
+		if psql.StatementTimeout, err = durationFromEnv("DB_STATEMENT_TIMEOUT"); err != nil {
+			return psql, err
+		}
+	}
+	if psql.ConnMaxLifetime == 0 {
+		if psql.ConnMaxLifetime, err = durationFromEnv("DB_CONN_MAX_LIFETIME"); err != nil {
+			return psql, err
+		}
+	}
+	if psql.SlowQueryThreshold == 0 {
+		if psql.SlowQueryThreshold, err = durationFromEnv("DB_SLOW_QUERY_THRESHOLD"); err != nil {
+			return psql, err
+		}
+	}
+	return psql, nil
+}
+
+func boolFromEnv(key string) (bool, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, errors.Wrapf(err, "Invalid %s", key)
+	}
+	return b, nil
+}
+
+func intFromEnv(key string) (int, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return 0, nil
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, errors.Wrapf(err, "Invalid %s", key)
+	}
+	return i, nil
+}
+
+// durationFromEnv parses Go duration strings, e.g. 30s or 5m
+func durationFromEnv(key string) (time.Duration, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, errors.Wrapf(err, "Invalid %s", key)
+	}
+	return d, nil
+}
+
+func (psql PostgresDatabase) connectionString(withDB bool) (string, error) {
+	psql, err := psql.withEnvFallbacks()
+	if err != nil {
+		return "", err
+	}
 	if err := psql.validate(); err != nil {
 		return "", err
 	}
-	connString := fmt.Sprintf("host=%s user=%s password=%s",
-		psql.Host, psql.User, psql.Password)
+	params := []string{
+		connectionParam("host", psql.Host),
+		connectionParam("user", psql.User),
+	}
+	// with a provider the password is added for every connection by passwordConnector
+	if psql.PasswordProvider == nil {
+		params = append(params, connectionParam("password", psql.Password))
+	}
 	if withDB {
-		connString += " dbname=" + psql.DBName
+		params = append(params, connectionParam("dbname", psql.DBName))
 	}
 	// optionals
+	if psql.Port != 0 {
+		params = append(params, connectionParam("port", strconv.Itoa(psql.Port)))
+	}
 	if psql.SSLMode != "" {
-		connString += " sslmode=" + psql.SSLMode
+		params = append(params, connectionParam("sslmode", psql.SSLMode))
+	}
+	if psql.SSLRootCert != "" {
+		params = append(params, connectionParam("sslrootcert", psql.SSLRootCert))
+	}
+	if psql.SSLCert != "" {
+		params = append(params, connectionParam("sslcert", psql.SSLCert))
+	}
+	if psql.SSLKey != "" {
+		params = append(params, connectionParam("sslkey", psql.SSLKey))
+	}
+	if psql.ApplicationName != "" {
+		params = append(params, connectionParam("application_name", psql.ApplicationName))
+	}
+	if psql.SearchPath != "" {
+		params = append(params, connectionParam("search_path", psql.SearchPath))
+	}
+	connectTimeout := psql.ConnectTimeout
+	if connectTimeout <= 0 {
+		connectTimeout = defaultConnectTimeout
+	}
+	// in seconds, it's rounded up as 0 would mean waiting indefinitely
+	seconds := int64((connectTimeout + time.Second - 1) / time.Second)
+	params = append(params, connectionParam("connect_timeout", strconv.FormatInt(seconds, 10)))
+	if psql.StatementTimeout > 0 {
+		// in milliseconds, passed in the options startup parameter as PgBouncer rejects
+		// the unknown statement_timeout one. PgBouncer only accepts options if it's in
+		// its ignore_startup_parameters, which drops it, so behind PgBouncer the timeout
+		// has to be set on the database role instead.
+		milliseconds := strconv.FormatInt(int64(psql.StatementTimeout/time.Millisecond), 10)
+		params = append(params, connectionParam("options", "-c statement_timeout="+milliseconds))
+	}
+	return strings.Join(params, " "), nil
+}
+
+// connectionParam quotes the value if it's needed, following the libpq
+// keyword/value connection string format
+func connectionParam(key, value string) string {
+	if value != "" && !strings.ContainsAny(value, `'\`) && strings.IndexFunc(value, unicode.IsSpace) == -1 {
+		return key + "=" + value
 	}
-	return connString, nil
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, `'`, `\'`, -1)
+	return key + "='" + value + "'"
 }
@@ -0,0 +1,59 @@
+package database
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_PostgresDatabase_connectionString(t *testing.T) {
+	t.Log("ok - required values only")
+	{
+		connString, err := PostgresDatabase{Host: "localhost", User: "postgres", DBName: "app", Password: "secret"}.connectionString(true)
+		require.NoError(t, err)
+		require.Equal(t, "host=localhost user=postgres password=secret dbname=app connect_timeout=10", connString)
+	}
+	t.Log("ok - optionals and escaped values")
+	{
+		connString, err := PostgresDatabase{
+			Host:             "localhost",
+			User:             "postgres",
+			DBName:           "app",
+			Password:         `it's a \secret`,
+			SSLMode:          "verify-full",
+			Port:             6432,
+			ConnectTimeout:   1500 * time.Millisecond,
+			StatementTimeout: 30 * time.Second,
+			ApplicationName:  "build api",
+			SSLRootCert:      "/etc/ssl/root.crt",
+		}.connectionString(false)
+		require.NoError(t, err)
+		require.Equal(t, `host=localhost user=postgres password='it\'s a \\secret' port=6432 sslmode=verify-full sslrootcert=/etc/ssl/root.crt application_name='build api' connect_timeout=2 options='-c statement_timeout=30000'`, connString)
+	}
+	t.Log("ok - password provider")
+	{
+		psql := PostgresDatabase{Host: "localhost", User: "postgres", DBName: "app", PasswordProvider: EnvPasswordProvider{}}
+		connString, err := psql.connectionString(true)
+		require.NoError(t, err)
+		require.Equal(t, "host=localhost user=postgres dbname=app connect_timeout=10", connString)
+	}
+	t.Log("ok - password file from environment")
+	{
+		require.NoError(t, os.Setenv("DB_PWD_FILE", "/run/secrets/db-password"))
+		defer os.Unsetenv("DB_PWD_FILE")
+
+		psql, err := PostgresDatabase{Host: "localhost", User: "postgres", DBName: "app"}.withEnvFallbacks()
+		require.NoError(t, err)
+		require.Equal(t, NewFilePasswordProvider("/run/secrets/db-password"), psql.PasswordProvider)
+	}
+	t.Log("error - invalid environment value")
+	{
+		require.NoError(t, os.Setenv("DB_STATEMENT_TIMEOUT", "30"))
+		defer os.Unsetenv("DB_STATEMENT_TIMEOUT")
+
+		_, err := PostgresDatabase{Host: "localhost", User: "postgres", DBName: "app", Password: "secret"}.connectionString(true)
+		require.EqualError(t, err, `Invalid DB_STATEMENT_TIMEOUT: time: missing unit in duration "30"`)
+	}
+}
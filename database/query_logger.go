@@ -0,0 +1,124 @@
+package database
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"reflect"
+	"time"
+	"unicode/utf8"
+
+	"github.com/bitrise-io/api-utils/logging"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// queryLogger is a gorm logger writing to the logging package's context logger,
+// so the queries end up in the structured logs with the request's fields
+type queryLogger struct {
+	ctx           context.Context
+	logQueries    bool
+	logParams     bool
+	slowThreshold time.Duration
+}
+
+func newQueryLogger(psql PostgresDatabase) queryLogger {
+	return queryLogger{
+		logQueries:    psql.LogQueries,
+		logParams:     psql.LogQueryParams,
+		slowThreshold: psql.SlowQueryThreshold,
+	}
+}
+
+// detailed reports whether gorm has to pass every query to the logger
+func (l queryLogger) detailed() bool {
+	return l.logQueries || l.slowThreshold > 0
+}
+
+func (l queryLogger) withContext(ctx context.Context) queryLogger {
+	l.ctx = ctx
+	return l
+}
+
+// Print is called by gorm with the values of a query ("sql", source, duration, sql,
+// vars, rows) or of an error ("log" or "error", source, values...)
+func (l queryLogger) Print(values ...interface{}) {
+	level, msg, fields, ok := l.entry(values...)
+	if !ok {
+		return
+	}
+	if ce := logging.WithContext(l.ctx).Check(level, msg); ce != nil {
+		ce.Write(fields...)
+	}
+}
+
+func (l queryLogger) entry(values ...interface{}) (zapcore.Level, string, []zap.Field, bool) {
+	if len(values) < 2 {
+		return 0, "", nil, false
+	}
+	source := zap.String("source", fmt.Sprint(values[1]))
+
+	if values[0] != "sql" || len(values) < 6 {
+		fields := []zap.Field{source}
+		for _, value := range values[2:] {
+			if err, ok := value.(error); ok {
+				fields = append(fields, zap.Error(err))
+			} else {
+				fields = append(fields, zap.Any("details", value))
+			}
+		}
+		return zapcore.ErrorLevel, "Database error", fields, true
+	}
+
+	duration, _ := values[2].(time.Duration)
+	query, _ := values[3].(string)
+	vars, _ := values[4].([]interface{})
+	rows, _ := values[5].(int64)
+
+	level, msg := zapcore.InfoLevel, "Database query"
+	if l.slowThreshold > 0 && duration >= l.slowThreshold {
+		level, msg = zapcore.WarnLevel, "Slow database query"
+	} else if !l.logQueries {
+		return 0, "", nil, false
+	}
+
+	fields := []zap.Field{
+		zap.String("sql", query),
+		zap.Duration("duration", duration),
+		zap.Int64("rows", rows),
+		source,
+	}
+	if l.logParams {
+		fields = append(fields, zap.Strings("params", formatQueryParams(vars)))
+	} else {
+		fields = append(fields, zap.Int("params", len(vars)))
+	}
+	return level, msg, fields, true
+}
+
+func formatQueryParams(vars []interface{}) []string {
+	params := make([]string, 0, len(vars))
+	for _, v := range vars {
+		value := reflect.Indirect(reflect.ValueOf(v))
+		if !value.IsValid() {
+			params = append(params, "NULL")
+			continue
+		}
+		param := value.Interface()
+		if valuer, ok := param.(driver.Valuer); ok {
+			if param, _ = valuer.Value(); param == nil {
+				params = append(params, "NULL")
+				continue
+			}
+		}
+		if b, ok := param.([]byte); ok {
+			if !utf8.Valid(b) {
+				params = append(params, "<binary>")
+				continue
+			}
+			param = string(b)
+		}
+		params = append(params, fmt.Sprint(param))
+	}
+	return params
+}
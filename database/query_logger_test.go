@@ -0,0 +1,69 @@
+package database
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+func Test_queryLogger_entry(t *testing.T) {
+	secret := "s3cr3t"
+	query := []interface{}{"sql", "models/user.go:42", 20 * time.Millisecond, `SELECT * FROM "users" WHERE (email = $1 AND password = $2)`, []interface{}{"user@example.com", &secret}, int64(1)}
+
+	t.Log("ok - parameters are redacted by default")
+	{
+		level, msg, fields, ok := queryLogger{logQueries: true}.entry(query...)
+		require.True(t, ok)
+		require.Equal(t, zapcore.InfoLevel, level)
+		require.Equal(t, "Database query", msg)
+		require.Equal(t, []zap.Field{
+			zap.String("sql", `SELECT * FROM "users" WHERE (email = $1 AND password = $2)`),
+			zap.Duration("duration", 20*time.Millisecond),
+			zap.Int64("rows", 1),
+			zap.String("source", "models/user.go:42"),
+			zap.Int("params", 2),
+		}, fields)
+	}
+
+	t.Log("ok - parameters are logged when enabled")
+	{
+		_, _, fields, ok := queryLogger{logQueries: true, logParams: true}.entry(query...)
+		require.True(t, ok)
+		require.Equal(t, zap.Strings("params", []string{"user@example.com", "s3cr3t"}), fields[len(fields)-1])
+	}
+
+	t.Log("ok - slow query")
+	{
+		level, msg, _, ok := queryLogger{slowThreshold: 10 * time.Millisecond}.entry(query...)
+		require.True(t, ok)
+		require.Equal(t, zapcore.WarnLevel, level)
+		require.Equal(t, "Slow database query", msg)
+	}
+
+	t.Log("ok - fast query without query logging")
+	{
+		_, _, _, ok := queryLogger{slowThreshold: time.Second}.entry(query...)
+		require.False(t, ok)
+	}
+
+	t.Log("ok - error")
+	{
+		err := errors.New("relation \"users\" does not exist")
+		level, _, fields, ok := queryLogger{}.entry("error", "models/user.go:42", err)
+		require.True(t, ok)
+		require.Equal(t, zapcore.ErrorLevel, level)
+		require.Equal(t, []zap.Field{zap.String("source", "models/user.go:42"), zap.Error(err)}, fields)
+	}
+}
+
+func Test_formatQueryParams(t *testing.T) {
+	var nilString *string
+	require.Equal(t,
+		[]string{"1", "NULL", "text", "<binary>", "NULL"},
+		formatQueryParams([]interface{}{1, nilString, []byte("text"), []byte{0xff, 0xfe}, nil}),
+	)
+}
@@ -0,0 +1,92 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"github.com/bitrise-io/api-utils/logging"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultConnectMaxAttempts = 10
+	defaultConnectMinBackoff  = 500 * time.Millisecond
+	defaultConnectMaxBackoff  = 30 * time.Second
+)
+
+// RetryConfig of connecting to the database
+type RetryConfig struct {
+	// MaxAttempts of connecting, defaults to 10
+	MaxAttempts int
+	// MinBackoff is the wait after the first failed attempt, it's doubled after every
+	// further one up to MaxBackoff. Defaults to 500 milliseconds and 30 seconds.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+// NewConnectionWithRetry is NewConnection retried with exponential backoff while the
+// database isn't reachable, e.g. during its restart. Invalid configuration and rejected
+// credentials aren't retried, and the waiting is stopped when the context is cancelled.
+func NewConnectionWithRetry(ctx context.Context, psql PostgresDatabase, withDB bool, config RetryConfig) (*Connection, error) {
+	if config.MaxAttempts <= 0 {
+		config.MaxAttempts = defaultConnectMaxAttempts
+	}
+	if config.MinBackoff == 0 {
+		config.MinBackoff = defaultConnectMinBackoff
+	}
+	if config.MaxBackoff == 0 {
+		config.MaxBackoff = defaultConnectMaxBackoff
+	}
+	if _, err := psql.connectionString(withDB); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	for attempt := 1; ; attempt++ {
+		conn, err := newConnection(ctx, psql, withDB)
+		if err == nil {
+			return conn, nil
+		}
+		if isPermanentConnectError(err) {
+			return nil, errors.Wrap(err, "Failed to connect to database")
+		}
+		if attempt >= config.MaxAttempts {
+			return nil, errors.Wrapf(err, "Failed to connect to database in %d attempts", attempt)
+		}
+		backoff := ExponentialBackoff(config.MinBackoff, config.MaxBackoff, attempt)
+		logging.WithContext(ctx).Warn("Failed to connect to database, retrying",
+			zap.Int("attempt", attempt), zap.Duration("backoff", backoff), zap.Error(err))
+		sleep(ctx, backoff)
+		if ctx.Err() != nil {
+			return nil, errors.Wrap(err, "Failed to connect to database")
+		}
+	}
+}
+
+// isPermanentConnectError reports whether the server rejected the credentials,
+// retrying wouldn't help
+func isPermanentConnectError(err error) bool {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return false
+	}
+	switch pqErr.Code {
+	case "28P01", "28000": // invalid_password, invalid_authorization_specification
+		return true
+	}
+	return false
+}
+
+// InitializeConnectionWithRetry is InitializeConnection retried like NewConnectionWithRetry,
+// the connection of a previous call is closed as well
+//
+// Deprecated: use NewConnectionWithRetry and the returned Connection instead.
+func (psql PostgresDatabase) InitializeConnectionWithRetry(ctx context.Context, withDB bool, config RetryConfig) error {
+	conn, err := NewConnectionWithRetry(ctx, psql, withDB, config)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	setDefaultConnection(conn)
+	return nil
+}
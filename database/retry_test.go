@@ -0,0 +1,87 @@
+package database_test
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/bitrise-io/api-utils/database"
+)
+
+func Test_NewConnectionWithRetry(t *testing.T) {
+	t.Log("not ok - invalid configuration isn't retried")
+	{
+		_, err := database.NewConnectionWithRetry(context.Background(), database.PostgresDatabase{Host: "localhost", DBName: "test", User: "test"},
+			true, database.RetryConfig{MaxAttempts: 3, MinBackoff: time.Minute, MaxBackoff: time.Minute})
+		require.EqualError(t, err, "No database password specified")
+	}
+	t.Log("not ok - rejected credentials aren't retried")
+	{
+		psql, connections := newAuthRejectingServer(t)
+		_, err := database.NewConnectionWithRetry(context.Background(), psql, true, database.RetryConfig{MaxAttempts: 3, MinBackoff: time.Minute, MaxBackoff: time.Minute})
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "password authentication failed")
+		require.Equal(t, int32(1), atomic.LoadInt32(connections))
+	}
+	t.Log("not ok - gives up after the attempts")
+	{
+		_, err := database.NewConnectionWithRetry(context.Background(), unreachableDatabase, true, database.RetryConfig{MaxAttempts: 3, MinBackoff: time.Millisecond})
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "Failed to connect to database in 3 attempts")
+	}
+	t.Log("not ok - stops waiting when the context is cancelled")
+	{
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		_, err := database.NewConnectionWithRetry(ctx, unreachableDatabase, true, database.RetryConfig{MinBackoff: time.Minute, MaxBackoff: time.Minute})
+		require.Error(t, err)
+		require.True(t, time.Since(start) < 10*time.Second)
+	}
+}
+
+// newAuthRejectingServer answers every startup message like Postgres does to a wrong
+// password, and counts the connections
+func newAuthRejectingServer(t *testing.T) (database.PostgresDatabase, *int32) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, listener.Close()) })
+
+	var connections int32
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&connections, 1)
+			go rejectStartup(conn)
+		}
+	}()
+
+	addr := listener.Addr().(*net.TCPAddr)
+	return database.PostgresDatabase{Host: "127.0.0.1", Port: addr.Port, User: "test", Password: "wrong", DBName: "test", SSLMode: "disable"}, &connections
+}
+
+func rejectStartup(conn net.Conn) {
+	defer func() { _ = conn.Close() }()
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return
+	}
+	if _, err := io.ReadFull(conn, make([]byte, binary.BigEndian.Uint32(header)-4)); err != nil {
+		return
+	}
+
+	fields := "SFATAL\x00C28P01\x00Mpassword authentication failed for user \"test\"\x00\x00"
+	message := make([]byte, 5, 5+len(fields))
+	message[0] = 'E'
+	binary.BigEndian.PutUint32(message[1:], uint32(4+len(fields)))
+	_, _ = conn.Write(append(message, fields...))
+}
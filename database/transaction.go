@@ -0,0 +1,181 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/bitrise-io/api-utils/logging"
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultTxMaxRetries   = 3
+	txRetryBaseBackoff    = 10 * time.Millisecond
+	txRetryMaxBackoff     = time.Second
+	pqSerializationFailed = "40001"
+	pqDeadlockDetected    = "40P01"
+)
+
+type txContextKey struct{}
+
+type txState struct {
+	conn  *Connection
+	tx    *gorm.DB
+	depth int
+}
+
+// TxOptions ...
+type TxOptions struct {
+	Isolation sql.IsolationLevel
+	ReadOnly  bool
+	// MaxRetries on serialization failures and deadlocks, defaults to 3.
+	// Set it to a negative value to disable retrying.
+	MaxRetries int
+}
+
+// TxFunc is called with the transaction and with a context holding it, nested
+// WithTransaction calls with this context create savepoints.
+type TxFunc func(ctx context.Context, tx *gorm.DB) error
+
+// ContextWithTransaction returns a context in which WithTransaction of the connection
+// creates savepoints in tx, a transaction begun on the connection, e.g. to run a test
+// in a transaction which is rolled back
+func (c *Connection) ContextWithTransaction(ctx context.Context, tx *gorm.DB) context.Context {
+	return context.WithValue(ctx, txContextKey{}, &txState{conn: c, tx: tx})
+}
+
+// TxFromContext returns the transaction started by WithTransaction
+func TxFromContext(ctx context.Context) (*gorm.DB, bool) {
+	state, ok := ctx.Value(txContextKey{}).(*txState)
+	if !ok {
+		return nil, false
+	}
+	return state.tx, true
+}
+
+// WithTransaction runs fn in a transaction. It's committed if fn returns nil, and rolled
+// back if it returns an error or panics. Serialization failures and deadlocks are
+// retried with jittered backoff, so fn has to be safe to run multiple times. If ctx
+// already holds a transaction of this connection a savepoint is created instead,
+// and the options are ignored.
+func (c *Connection) WithTransaction(ctx context.Context, opts *TxOptions, fn TxFunc) error {
+	if state, ok := ctx.Value(txContextKey{}).(*txState); ok && state.conn == c {
+		return withSavepoint(ctx, state, fn)
+	}
+
+	if opts == nil {
+		opts = &TxOptions{}
+	}
+	maxRetries := opts.MaxRetries
+	if maxRetries == 0 {
+		maxRetries = defaultTxMaxRetries
+	}
+
+	for attempt := 0; ; attempt++ {
+		err := c.runTransaction(ctx, opts, fn)
+		if err == nil || attempt >= maxRetries || !isRetryableTxError(err) {
+			return err
+		}
+
+		backoff := txRetryBaseBackoff << uint(attempt)
+		if backoff > txRetryMaxBackoff {
+			backoff = txRetryMaxBackoff
+		}
+		backoff = time.Duration(rand.Int63n(int64(backoff)) + 1)
+		logging.WithContext(ctx).Warn("Retrying transaction", zap.Int("attempt", attempt+1), zap.Duration("backoff", backoff), zap.Error(err))
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return errors.WithStack(ctx.Err())
+		}
+	}
+}
+
+func (c *Connection) runTransaction(ctx context.Context, opts *TxOptions, fn TxFunc) (err error) {
+	tx := c.WithContext(ctx).BeginTx(ctx, &sql.TxOptions{Isolation: opts.Isolation, ReadOnly: opts.ReadOnly})
+	if tx.Error != nil {
+		return errors.Wrap(tx.Error, "Failed to begin transaction")
+	}
+
+	committed := false
+	defer func() {
+		if committed {
+			return
+		}
+		if rollbackErr := tx.Rollback().Error; rollbackErr != nil {
+			logging.WithContext(ctx).Error("Failed to roll back transaction", zap.Error(rollbackErr))
+		}
+		if r := recover(); r != nil {
+			panic(r)
+		}
+	}()
+
+	txCtx := context.WithValue(ctx, txContextKey{}, &txState{conn: c, tx: tx})
+	if err := fn(txCtx, tx); err != nil {
+		return err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return errors.Wrap(err, "Failed to commit transaction")
+	}
+	committed = true
+	return nil
+}
+
+func withSavepoint(ctx context.Context, parent *txState, fn TxFunc) (err error) {
+	state := &txState{conn: parent.conn, tx: parent.tx, depth: parent.depth + 1}
+	savepoint := fmt.Sprintf("sp_%d", state.depth)
+	if err := state.tx.Exec("SAVEPOINT " + savepoint).Error; err != nil {
+		return errors.Wrap(err, "Failed to create savepoint")
+	}
+
+	released := false
+	defer func() {
+		if released {
+			return
+		}
+		if rollbackErr := state.tx.Exec("ROLLBACK TO SAVEPOINT " + savepoint).Error; rollbackErr != nil {
+			logging.WithContext(ctx).Error("Failed to roll back to savepoint", zap.Error(rollbackErr))
+		}
+		if r := recover(); r != nil {
+			panic(r)
+		}
+	}()
+
+	if err := fn(context.WithValue(ctx, txContextKey{}, state), state.tx); err != nil {
+		return err
+	}
+	if err := state.tx.Exec("RELEASE SAVEPOINT " + savepoint).Error; err != nil {
+		return errors.Wrap(err, "Failed to release savepoint")
+	}
+	released = true
+	return nil
+}
+
+func isRetryableTxError(err error) bool {
+	var gormErrs gorm.Errors
+	if errors.As(err, &gormErrs) {
+		for _, e := range gormErrs {
+			if isRetryableTxError(e) {
+				return true
+			}
+		}
+		return false
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pqErr.Code == pqSerializationFailed || pqErr.Code == pqDeadlockDetected
+	}
+	return false
+}
+
+// WithTransaction runs the transaction on the primary, see Connection.WithTransaction
+func (c *Cluster) WithTransaction(ctx context.Context, opts *TxOptions, fn TxFunc) error {
+	c.WriteDB(ctx)
+	return c.primary.WithTransaction(ctx, opts, fn)
+}
@@ -0,0 +1,25 @@
+package database
+
+import (
+	"testing"
+
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_isRetryableTxError(t *testing.T) {
+	t.Log("ok - serialization failure and deadlock")
+	{
+		require.True(t, isRetryableTxError(&pq.Error{Code: "40001"}))
+		require.True(t, isRetryableTxError(errors.Wrap(&pq.Error{Code: "40P01"}, "Failed to commit transaction")))
+		require.True(t, isRetryableTxError(gorm.Errors{errors.New("other"), &pq.Error{Code: "40001"}}))
+	}
+	t.Log("ok - other errors")
+	{
+		require.False(t, isRetryableTxError(&pq.Error{Code: "23505"}))
+		require.False(t, isRetryableTxError(errors.New("Record not found")))
+		require.False(t, isRetryableTxError(gorm.Errors{errors.New("other")}))
+	}
+}
@@ -0,0 +1,153 @@
+package database_test
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bitrise-io/api-utils/database"
+	"github.com/bitrise-io/api-utils/database/databasetest"
+)
+
+func Test_Connection_WithTransaction(t *testing.T) {
+	testDB := databasetest.New(t, databasetest.Config{
+		Schema:     true,
+		Migrations: []database.Migration{{Version: 1, Name: "create_builds", Up: "CREATE TABLE builds (id integer PRIMARY KEY);"}},
+	})
+	conn := testDB.Connection()
+	ctx := context.Background()
+
+	insert := func(tx *gorm.DB, id int) error {
+		return tx.Exec("INSERT INTO builds (id) VALUES (?)", id).Error
+	}
+	buildIDs := func() []int {
+		ids := []int{}
+		require.NoError(t, testDB.DB().Table("builds").Order("id").Pluck("id", &ids).Error)
+		require.NoError(t, testDB.DB().Exec("DELETE FROM builds").Error)
+		return ids
+	}
+
+	t.Log("ok - committed")
+	{
+		err := conn.WithTransaction(ctx, nil, func(ctx context.Context, tx *gorm.DB) error {
+			current, ok := database.TxFromContext(ctx)
+			require.True(t, ok)
+			require.Equal(t, tx, current)
+			return insert(tx, 1)
+		})
+		require.NoError(t, err)
+		require.Equal(t, []int{1}, buildIDs())
+	}
+	t.Log("error - rolled back")
+	{
+		err := conn.WithTransaction(ctx, nil, func(ctx context.Context, tx *gorm.DB) error {
+			require.NoError(t, insert(tx, 1))
+			return errors.New("validation failed")
+		})
+		require.EqualError(t, err, "validation failed")
+		require.Empty(t, buildIDs())
+	}
+	t.Log("error - rolled back and panicked again")
+	{
+		require.PanicsWithValue(t, "boom", func() {
+			_ = conn.WithTransaction(ctx, nil, func(ctx context.Context, tx *gorm.DB) error {
+				require.NoError(t, insert(tx, 1))
+				panic("boom")
+			})
+		})
+		require.Empty(t, buildIDs())
+	}
+	t.Log("ok - nested calls roll back to their savepoint")
+	{
+		err := conn.WithTransaction(ctx, nil, func(ctx context.Context, tx *gorm.DB) error {
+			require.NoError(t, insert(tx, 1))
+			err := conn.WithTransaction(ctx, nil, func(ctx context.Context, tx *gorm.DB) error {
+				require.NoError(t, insert(tx, 2))
+				return errors.New("nested failed")
+			})
+			require.EqualError(t, err, "nested failed")
+			require.NoError(t, conn.WithTransaction(ctx, nil, func(ctx context.Context, tx *gorm.DB) error {
+				return insert(tx, 3)
+			}))
+			return nil
+		})
+		require.NoError(t, err)
+		require.Equal(t, []int{1, 3}, buildIDs())
+	}
+	t.Log("ok - serialization failure is retried")
+	{
+		attempts := 0
+		err := conn.WithTransaction(ctx, nil, func(ctx context.Context, tx *gorm.DB) error {
+			attempts++
+			require.NoError(t, insert(tx, attempts))
+			if attempts == 1 {
+				return &pq.Error{Code: "40001"}
+			}
+			return nil
+		})
+		require.NoError(t, err)
+		require.Equal(t, 2, attempts)
+		require.Equal(t, []int{2}, buildIDs())
+	}
+	t.Log("error - deadlock after the retries")
+	{
+		attempts := 0
+		err := conn.WithTransaction(ctx, &database.TxOptions{MaxRetries: 2}, func(ctx context.Context, tx *gorm.DB) error {
+			attempts++
+			return &pq.Error{Code: "40P01"}
+		})
+		require.Error(t, err)
+		require.Equal(t, 3, attempts)
+	}
+	t.Log("error - retrying is stopped when the context is cancelled")
+	{
+		cancelled, cancel := context.WithCancel(ctx)
+		attempts := 0
+		err := conn.WithTransaction(cancelled, nil, func(ctx context.Context, tx *gorm.DB) error {
+			attempts++
+			cancel()
+			return &pq.Error{Code: "40001"}
+		})
+		require.True(t, errors.Is(err, context.Canceled), "%v", err)
+		require.Equal(t, 1, attempts)
+	}
+	t.Log("error - other errors aren't retried")
+	{
+		attempts := 0
+		err := conn.WithTransaction(ctx, nil, func(ctx context.Context, tx *gorm.DB) error {
+			attempts++
+			return insert(tx, 1)
+		})
+		require.NoError(t, err)
+		err = conn.WithTransaction(ctx, nil, func(ctx context.Context, tx *gorm.DB) error {
+			attempts++
+			return insert(tx, 1)
+		})
+		require.Error(t, err)
+		require.Equal(t, 2, attempts)
+		require.Equal(t, []int{1}, buildIDs())
+	}
+	t.Log("error - read only")
+	{
+		err := conn.WithTransaction(ctx, &database.TxOptions{ReadOnly: true}, func(ctx context.Context, tx *gorm.DB) error {
+			return insert(tx, 1)
+		})
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "read-only transaction")
+	}
+	t.Log("ok - isolation level")
+	{
+		err := conn.WithTransaction(ctx, &database.TxOptions{Isolation: sql.LevelSerializable}, func(ctx context.Context, tx *gorm.DB) error {
+			var isolation string
+			require.NoError(t, tx.Raw("SHOW transaction_isolation").Row().Scan(&isolation))
+			require.Equal(t, "serializable", isolation)
+			return nil
+		})
+		require.NoError(t, err)
+	}
+}
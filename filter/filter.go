@@ -0,0 +1,330 @@
+package filter
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bitrise-io/api-utils/database"
+	"github.com/bitrise-io/api-utils/httpresponse"
+	"github.com/bitrise-io/api-utils/structs"
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+const (
+	// SortParam is the query parameter of the sort fields, e.g. sort=-created_at,title
+	SortParam = "sort"
+
+	filterTag  = "filter"
+	sortOption = "sort"
+)
+
+// Operator ...
+type Operator string
+
+// The supported operators, in the query as field[operator]=value. A field without an
+// operator is an equality filter, and "in" takes a comma separated list.
+const (
+	Eq   Operator = "eq"
+	In   Operator = "in"
+	Gt   Operator = "gt"
+	Lt   Operator = "lt"
+	Like Operator = "like"
+)
+
+var filterParamPattern = regexp.MustCompile(`^([^\[\]]+)(?:\[([a-z]+)\])?$`)
+
+// Error is an invalid filter or sort of the request, it should be a 400 response
+type Error struct {
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Condition ...
+type Condition struct {
+	Column   string
+	Operator Operator
+	Value    interface{}
+}
+
+// Sort ...
+type Sort struct {
+	Column string
+	Desc   bool
+}
+
+// Query is the parsed filters and sorting of a request
+type Query struct {
+	Conditions []Condition
+	Sorts      []Sort
+}
+
+type field struct {
+	column    string
+	kind      reflect.Type
+	operators map[Operator]bool
+	sortable  bool
+}
+
+// Whitelist holds the filterable and sortable fields of a model
+type Whitelist struct {
+	fields  map[string]field
+	ignored map[string]bool
+}
+
+// NewWhitelist reads the fields from the filter tags of the model, which list the allowed
+// operators and "sort" if it's sortable, e.g. `json:"status" filter:"eq,in,sort"`. The
+// fields are named by their json tags in the query, and by their db tags or gorm's
+// naming in the database.
+func NewWhitelist(model interface{}) (*Whitelist, error) {
+	t := reflect.TypeOf(model)
+	if t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == nil || t.Kind() != reflect.Struct {
+		return nil, errors.New("The model have different type than struct")
+	}
+
+	w := &Whitelist{
+		fields:  map[string]field{},
+		ignored: map[string]bool{httpresponse.CursorQueryParam: true, database.LimitQueryParam: true},
+	}
+	// the structs helpers take the model's value
+	value := reflect.New(t).Elem().Interface()
+	for i := 0; i < t.NumField(); i++ {
+		structField := t.Field(i)
+		tag, err := structs.GetFieldNameByAttributeNameAndTag(value, structField.Name, filterTag)
+		if errors.Is(err, structs.ErrTagMissing) {
+			continue
+		}
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		name, err := fieldName(value, structField.Name, "json")
+		if err != nil {
+			return nil, err
+		}
+		column, err := fieldName(value, structField.Name, "db")
+		if err != nil {
+			return nil, err
+		}
+		f := field{column: column, kind: structField.Type, operators: map[Operator]bool{}}
+		for _, option := range strings.Split(tag, ",") {
+			switch option := Operator(strings.TrimSpace(option)); option {
+			case Eq, In, Gt, Lt, Like:
+				f.operators[option] = true
+			case sortOption:
+				f.sortable = true
+			default:
+				return nil, errors.Errorf("Invalid filter option %s of %s", option, structField.Name)
+			}
+		}
+		w.fields[name] = f
+	}
+	return w, nil
+}
+
+// fieldName returns the name of the attribute in the tag, or gorm's naming if it isn't set
+func fieldName(model interface{}, attribute, tag string) (string, error) {
+	name, err := structs.GetFieldNameByAttributeNameAndTag(model, attribute, tag)
+	if err != nil && !errors.Is(err, structs.ErrTagMissing) {
+		return "", errors.WithStack(err)
+	}
+	name = strings.Split(name, ",")[0]
+	if name == "" || name == "-" {
+		return gorm.ToColumnName(attribute), nil
+	}
+	return name, nil
+}
+
+// Ignore skips query parameters which aren't filters, cursor and limit are skipped by default
+func (w *Whitelist) Ignore(params ...string) *Whitelist {
+	for _, param := range params {
+		w.ignored[param] = true
+	}
+	return w
+}
+
+// Parse validates the filters and sorting of the query against the whitelist
+func (w *Whitelist) Parse(query url.Values) (*Query, error) {
+	q := &Query{}
+	for param, values := range query {
+		if param == SortParam || w.ignored[param] {
+			continue
+		}
+		match := filterParamPattern.FindStringSubmatch(param)
+		if match == nil {
+			return nil, &Error{Message: fmt.Sprintf("Invalid filter: %s", param)}
+		}
+		name, operator := match[1], Operator(match[2])
+		if operator == "" {
+			operator = Eq
+		}
+		f, ok := w.fields[name]
+		if !ok {
+			return nil, &Error{Message: fmt.Sprintf("Unknown filter field: %s", name)}
+		}
+		if !f.operators[operator] {
+			return nil, &Error{Message: fmt.Sprintf("Unsupported filter of %s: %s", name, operator)}
+		}
+		if len(values) > 1 {
+			return nil, &Error{Message: fmt.Sprintf("Multiple values of filter: %s", param)}
+		}
+
+		var value interface{}
+		if operator == In {
+			parsed := []interface{}{}
+			for _, v := range strings.Split(values[0], ",") {
+				p, err := parseValue(f.kind, v)
+				if err != nil {
+					return nil, &Error{Message: fmt.Sprintf("Invalid value of filter %s: %s", param, v)}
+				}
+				parsed = append(parsed, p)
+			}
+			value = parsed
+		} else if operator == Like {
+			value = values[0]
+		} else {
+			p, err := parseValue(f.kind, values[0])
+			if err != nil {
+				return nil, &Error{Message: fmt.Sprintf("Invalid value of filter %s: %s", param, values[0])}
+			}
+			value = p
+		}
+		q.Conditions = append(q.Conditions, Condition{Column: f.column, Operator: operator, Value: value})
+	}
+	// the map is iterated randomly, the order is kept stable for the query plans and logs
+	sort.Slice(q.Conditions, func(i, j int) bool {
+		a, b := q.Conditions[i], q.Conditions[j]
+		return a.Column < b.Column || (a.Column == b.Column && a.Operator < b.Operator)
+	})
+
+	if sortParam := query.Get(SortParam); sortParam != "" {
+		seen := map[string]bool{}
+		for _, name := range strings.Split(sortParam, ",") {
+			s := Sort{}
+			if strings.HasPrefix(name, "-") {
+				name, s.Desc = name[1:], true
+			}
+			f, ok := w.fields[name]
+			if !ok || !f.sortable {
+				return nil, &Error{Message: fmt.Sprintf("Unknown sort field: %s", name)}
+			}
+			if seen[name] {
+				return nil, &Error{Message: fmt.Sprintf("Duplicate sort field: %s", name)}
+			}
+			seen[name] = true
+			s.Column = f.column
+			q.Sorts = append(q.Sorts, s)
+		}
+	}
+	return q, nil
+}
+
+// Scope applies the filters and the sorting, e.g. db.Scopes(query.Scope)
+func (q *Query) Scope(db *gorm.DB) *gorm.DB {
+	return q.SortScope(q.FilterScope(db))
+}
+
+// FilterScope applies the filters only, e.g. for counting or paginating
+func (q *Query) FilterScope(db *gorm.DB) *gorm.DB {
+	for _, c := range q.Conditions {
+		column := quoteColumn(c.Column)
+		switch c.Operator {
+		case Eq:
+			db = db.Where(column+" = ?", c.Value)
+		case In:
+			db = db.Where(column+" IN (?)", c.Value)
+		case Gt:
+			db = db.Where(column+" > ?", c.Value)
+		case Lt:
+			db = db.Where(column+" < ?", c.Value)
+		case Like:
+			db = db.Where(column+` ILIKE ? ESCAPE '\'`, "%"+escapeLike(fmt.Sprint(c.Value))+"%")
+		}
+	}
+	return db
+}
+
+// SortScope applies the sorting only
+func (q *Query) SortScope(db *gorm.DB) *gorm.DB {
+	for _, s := range q.Sorts {
+		if s.Desc {
+			db = db.Order(quoteColumn(s.Column) + " DESC")
+		} else {
+			db = db.Order(quoteColumn(s.Column) + " ASC")
+		}
+	}
+	return db
+}
+
+// SortColumns returns the sorting for database.Paginate, followed by the tie breaker
+// columns, which should end with a unique one
+func (q *Query) SortColumns(tieBreakers ...database.SortColumn) []database.SortColumn {
+	columns := []database.SortColumn{}
+	seen := map[string]bool{}
+	for _, s := range q.Sorts {
+		columns = append(columns, database.SortColumn{Name: s.Column, Desc: s.Desc})
+		seen[s.Column] = true
+	}
+	for _, column := range tieBreakers {
+		if !seen[column.Name] {
+			columns = append(columns, column)
+		}
+	}
+	return columns
+}
+
+// RespondWithError responds with 400 to an *Error, and with 500 to any other error
+func RespondWithError(w http.ResponseWriter, err error) error {
+	var filterErr *Error
+	if errors.As(err, &filterErr) {
+		return httpresponse.RespondWithBadRequestError(w, filterErr.Message)
+	}
+	httpresponse.RespondWithInternalServerError(w, err)
+	return nil
+}
+
+func parseValue(t reflect.Type, value string) (interface{}, error) {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == reflect.TypeOf(time.Time{}) {
+		return time.Parse(time.RFC3339, value)
+	}
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.ParseInt(value, 10, 64)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.ParseUint(value, 10, 64)
+	case reflect.Float32, reflect.Float64:
+		return strconv.ParseFloat(value, 64)
+	case reflect.Bool:
+		return strconv.ParseBool(value)
+	}
+	return value, nil
+}
+
+func quoteColumn(column string) string {
+	parts := strings.Split(column, ".")
+	for i, part := range parts {
+		parts[i] = pq.QuoteIdentifier(part)
+	}
+	return strings.Join(parts, ".")
+}
+
+func escapeLike(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(value)
+}
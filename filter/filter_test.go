@@ -0,0 +1,150 @@
+package filter_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bitrise-io/api-utils/database"
+	"github.com/bitrise-io/api-utils/filter"
+)
+
+type build struct {
+	ID        int64     `json:"id" filter:"eq,in,sort"`
+	Status    string    `json:"status" filter:"eq,in"`
+	Title     string    `json:"title" db:"build_title" filter:"like,sort"`
+	Pinned    bool      `json:"pinned" filter:"eq"`
+	CreatedAt time.Time `json:"created_at" filter:"gt,lt,sort"`
+	Secret    string    `json:"secret"`
+}
+
+func parse(t *testing.T, query string) (*filter.Query, error) {
+	whitelist, err := filter.NewWhitelist(&build{})
+	require.NoError(t, err)
+	values, err := url.ParseQuery(query)
+	require.NoError(t, err)
+	return whitelist.Parse(values)
+}
+
+func Test_NewWhitelist(t *testing.T) {
+	t.Log("ok - model value or pointer")
+	{
+		_, err := filter.NewWhitelist(build{})
+		require.NoError(t, err)
+	}
+	t.Log("ok - names without json and db tags")
+	{
+		whitelist, err := filter.NewWhitelist(struct {
+			RepoSlug string `json:"-" filter:"eq"`
+		}{})
+		require.NoError(t, err)
+		query, err := whitelist.Parse(url.Values{"repo_slug": {"api-utils"}})
+		require.NoError(t, err)
+		require.Equal(t, []filter.Condition{{Column: "repo_slug", Operator: filter.Eq, Value: "api-utils"}}, query.Conditions)
+	}
+	t.Log("not ok - not a struct")
+	{
+		_, err := filter.NewWhitelist("build")
+		require.EqualError(t, err, "The model have different type than struct")
+	}
+	t.Log("not ok - invalid option")
+	{
+		_, err := filter.NewWhitelist(struct {
+			Status string `filter:"eq,regexp"`
+		}{})
+		require.EqualError(t, err, "Invalid filter option regexp of Status")
+	}
+}
+
+func Test_Whitelist_Parse(t *testing.T) {
+	t.Log("ok - filters and sorting")
+	{
+		query, err := parse(t, "status[in]=running,failed&created_at[gt]=2020-01-02T10:00:00Z&title[like]=fix&pinned=true&id=3&sort=-created_at,id&cursor=abc&limit=2")
+		require.NoError(t, err)
+		require.Equal(t, []filter.Condition{
+			{Column: "build_title", Operator: filter.Like, Value: "fix"},
+			{Column: "created_at", Operator: filter.Gt, Value: time.Date(2020, 1, 2, 10, 0, 0, 0, time.UTC)},
+			{Column: "id", Operator: filter.Eq, Value: int64(3)},
+			{Column: "pinned", Operator: filter.Eq, Value: true},
+			{Column: "status", Operator: filter.In, Value: []interface{}{"running", "failed"}},
+		}, query.Conditions)
+		require.Equal(t, []filter.Sort{{Column: "created_at", Desc: true}, {Column: "id"}}, query.Sorts)
+	}
+	t.Log("ok - empty query")
+	{
+		query, err := parse(t, "")
+		require.NoError(t, err)
+		require.Empty(t, query.Conditions)
+		require.Empty(t, query.Sorts)
+	}
+	t.Log("ok - ignored parameters")
+	{
+		whitelist, err := filter.NewWhitelist(&build{})
+		require.NoError(t, err)
+		query, err := whitelist.Ignore("page").Parse(url.Values{"page": {"2"}})
+		require.NoError(t, err)
+		require.Empty(t, query.Conditions)
+	}
+
+	for query, message := range map[string]string{
+		"secret=x":                 "Unknown filter field: secret",
+		"unknown=x":                "Unknown filter field: unknown",
+		"status[gt]=x":             "Unsupported filter of status: gt",
+		"status[regexp]=x":         "Unsupported filter of status: regexp",
+		"status[in=x":              "Invalid filter: status[in",
+		"status=a&status=b":        "Multiple values of filter: status",
+		"id=abc":                   "Invalid value of filter id: abc",
+		"id[in]=1,b":               "Invalid value of filter id[in]: b",
+		"created_at[lt]=yesterday": "Invalid value of filter created_at[lt]: yesterday",
+		"sort=status":              "Unknown sort field: status",
+		"sort=-secret":             "Unknown sort field: secret",
+		"sort=id,-id":              "Duplicate sort field: id",
+		"sort=id,":                 "Unknown sort field: ",
+	} {
+		t.Log("not ok - " + query)
+		{
+			_, err := parse(t, query)
+			filterErr := &filter.Error{}
+			require.True(t, errors.As(err, &filterErr))
+			require.Equal(t, message, filterErr.Message)
+		}
+	}
+}
+
+func Test_Query_SortColumns(t *testing.T) {
+	t.Log("ok - sorting followed by the tie breakers")
+	{
+		query, err := parse(t, "sort=-created_at")
+		require.NoError(t, err)
+		require.Equal(t, []database.SortColumn{{Name: "created_at", Desc: true}, {Name: "id"}},
+			query.SortColumns(database.SortColumn{Name: "id"}))
+	}
+	t.Log("ok - tie breakers only")
+	{
+		query, err := parse(t, "")
+		require.NoError(t, err)
+		require.Equal(t, []database.SortColumn{{Name: "id", Desc: true}}, query.SortColumns(database.SortColumn{Name: "id", Desc: true}))
+	}
+}
+
+func Test_RespondWithError(t *testing.T) {
+	t.Log("ok - filter error is a bad request")
+	{
+		_, err := parse(t, "unknown=x")
+		w := httptest.NewRecorder()
+		require.NoError(t, filter.RespondWithError(w, err))
+		require.Equal(t, http.StatusBadRequest, w.Code)
+		require.JSONEq(t, `{"message":"Unknown filter field: unknown"}`, w.Body.String())
+	}
+	t.Log("ok - other errors are internal")
+	{
+		w := httptest.NewRecorder()
+		require.NoError(t, filter.RespondWithError(w, errors.New("connection refused")))
+		require.Equal(t, http.StatusInternalServerError, w.Code)
+	}
+}
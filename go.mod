@@ -1,10 +1,10 @@
 module github.com/bitrise-io/api-utils
 
-go 1.13
+go 1.16
 
 require (
 	github.com/aws/aws-sdk-go v1.29.1
-	github.com/blendle/zapdriver v1.3.1 // indirect
+	github.com/blendle/zapdriver v1.3.1
 	github.com/dgrijalva/jwt-go v3.2.0+incompatible
 	github.com/gomodule/redigo v2.0.0+incompatible
 	github.com/gorilla/mux v1.7.4
@@ -0,0 +1,46 @@
+package httpresponse
+
+import (
+	"net/http"
+	"strings"
+)
+
+// CursorQueryParam is the query parameter of the page cursor in the Link URLs
+const CursorQueryParam = "cursor"
+
+// PageRespModel ...
+type PageRespModel struct {
+	Data   interface{}         `json:"data"`
+	Paging PagingInfoRespModel `json:"paging"`
+}
+
+// PagingInfoRespModel ...
+type PagingInfoRespModel struct {
+	Next  string `json:"next,omitempty"`
+	Prev  string `json:"prev,omitempty"`
+	Limit int    `json:"limit"`
+}
+
+// RespondWithPage responds with the page in an envelope, and with Link headers to the
+// next and previous pages, which are the request's URL with the cursor replaced
+func RespondWithPage(w http.ResponseWriter, r *http.Request, data interface{}, paging PagingInfoRespModel) error {
+	links := []string{}
+	if paging.Next != "" {
+		links = append(links, `<`+pageURL(r, paging.Next)+`>; rel="next"`)
+	}
+	if paging.Prev != "" {
+		links = append(links, `<`+pageURL(r, paging.Prev)+`>; rel="prev"`)
+	}
+	if len(links) > 0 {
+		w.Header().Set("Link", strings.Join(links, ", "))
+	}
+	return RespondWithSuccess(w, PageRespModel{Data: data, Paging: paging})
+}
+
+func pageURL(r *http.Request, cursor string) string {
+	u := *r.URL
+	query := u.Query()
+	query.Set(CursorQueryParam, cursor)
+	u.RawQuery = query.Encode()
+	return u.RequestURI()
+}
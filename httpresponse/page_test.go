@@ -0,0 +1,33 @@
+package httpresponse_test
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/bitrise-io/api-utils/httpresponse"
+)
+
+func Test_RespondWithPage(t *testing.T) {
+	t.Log("ok - links keep the other query parameters")
+	{
+		r := httptest.NewRequest("GET", "/apps/123/builds?cursor=current&limit=2&status=running", nil)
+		w := httptest.NewRecorder()
+
+		err := httpresponse.RespondWithPage(w, r, []string{"build-1", "build-2"}, httpresponse.PagingInfoRespModel{Next: "next", Prev: "prev", Limit: 2})
+		require.NoError(t, err)
+		require.Equal(t, `</apps/123/builds?cursor=next&limit=2&status=running>; rel="next", </apps/123/builds?cursor=prev&limit=2&status=running>; rel="prev"`, w.Header().Get("Link"))
+		require.JSONEq(t, `{"data":["build-1","build-2"],"paging":{"next":"next","prev":"prev","limit":2}}`, w.Body.String())
+	}
+	t.Log("ok - single page")
+	{
+		r := httptest.NewRequest("GET", "/apps/123/builds", nil)
+		w := httptest.NewRecorder()
+
+		err := httpresponse.RespondWithPage(w, r, []string{}, httpresponse.PagingInfoRespModel{Limit: 20})
+		require.NoError(t, err)
+		require.Empty(t, w.Header().Get("Link"))
+		require.JSONEq(t, `{"data":[],"paging":{"limit":20}}`, w.Body.String())
+	}
+}
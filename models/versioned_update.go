@@ -0,0 +1,276 @@
+package models
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bitrise-io/api-utils/database"
+	"github.com/bitrise-io/api-utils/logging"
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultVersionColumn  = "version"
+	defaultAuditTableName = "audit_log"
+)
+
+// ConflictError is returned when the row was updated since the model was loaded
+type ConflictError struct {
+	Table           string
+	ID              interface{}
+	ExpectedVersion int64
+	CurrentVersion  int64
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("%s %v was modified concurrently: expected version %d, found %d", e.Table, e.ID, e.ExpectedVersion, e.CurrentVersion)
+}
+
+// VersionedUpdateOptions ...
+type VersionedUpdateOptions struct {
+	// VersionColumn of the model, an integer incremented on every update, defaults to version
+	VersionColumn string
+	// Audit records the old and new values of the changed fields in the audit table
+	Audit bool
+	// Actor who made the change, e.g. the user's ID
+	Actor string
+	// AuditTableName defaults to audit_log
+	AuditTableName string
+}
+
+// AuditChange ...
+type AuditChange struct {
+	Old interface{} `json:"old"`
+	New interface{} `json:"new"`
+}
+
+// AuditLogMigration creates the audit table, the table name defaults to audit_log
+func AuditLogMigration(version int64, tableName string) database.Migration {
+	if tableName == "" {
+		tableName = defaultAuditTableName
+	}
+	table := pq.QuoteIdentifier(tableName)
+	return database.Migration{
+		Version: version,
+		Name:    "create_" + tableName,
+		Up: fmt.Sprintf(`CREATE TABLE %s (
+	id bigserial PRIMARY KEY,
+	table_name text NOT NULL,
+	record_id text NOT NULL,
+	actor text NOT NULL,
+	changes jsonb NOT NULL,
+	created_at timestamptz NOT NULL DEFAULT now()
+);
+CREATE INDEX %s ON %s (table_name, record_id);`, table, pq.QuoteIdentifier(tableName+"_record_idx"), table),
+		Down: fmt.Sprintf("DROP TABLE %s;", table),
+	}
+}
+
+// UpdateWithVersion saves the whitelisted attributes of object, a pointer to a model, if its
+// row still has the version of the model, and increments the version. It returns a
+// *ConflictError if the row was updated in the meantime. Unless db is a transaction,
+// the update and the audit record are written in a new one.
+func (u *UpdatableModelService) UpdateWithVersion(db *gorm.DB, object interface{}, whiteList []string, opts VersionedUpdateOptions) error {
+	if reflect.ValueOf(object).Kind() != reflect.Ptr {
+		return errors.New("The model has to be a pointer")
+	}
+	if opts.VersionColumn == "" {
+		opts.VersionColumn = defaultVersionColumn
+	}
+	if opts.AuditTableName == "" {
+		opts.AuditTableName = defaultAuditTableName
+	}
+	updateData, err := u.UpdateData(reflect.ValueOf(object).Elem().Interface(), whiteList)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if _, ok := db.CommonDB().(*sql.Tx); ok {
+		return u.updateWithVersion(db, object, updateData, opts)
+	}
+	return errors.WithStack(db.Transaction(func(tx *gorm.DB) error {
+		return u.updateWithVersion(tx, object, updateData, opts)
+	}))
+}
+
+func (u *UpdatableModelService) updateWithVersion(tx *gorm.DB, object interface{}, updateData map[string]interface{}, opts VersionedUpdateOptions) error {
+	scope := tx.NewScope(object)
+	versionField, ok := scope.FieldByName(opts.VersionColumn)
+	if !ok {
+		return errors.Errorf("No version column %s in the model", opts.VersionColumn)
+	}
+	switch versionField.Field.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+	default:
+		return errors.Errorf("Version column %s has to be an integer", opts.VersionColumn)
+	}
+	version := versionField.Field.Int()
+	primaryField := scope.PrimaryField()
+	if primaryField == nil {
+		return errors.New("The model has no primary key")
+	}
+	id := primaryField.Field.Interface()
+
+	// the audited values are keyed by column, like gorm maps the keys of the update,
+	// the version and the update time change every time so they are left out
+	columns := []string{}
+	newValues := map[string]interface{}{}
+	for key, value := range updateData {
+		if field, ok := scope.FieldByName(key); ok && field.DBName != versionField.DBName && field.Name != "UpdatedAt" {
+			columns = append(columns, field.DBName)
+			newValues[field.DBName] = value
+		}
+	}
+	sort.Strings(columns)
+
+	var oldValues map[string]interface{}
+	if opts.Audit && len(columns) > 0 {
+		var err error
+		if oldValues, err = selectForUpdate(tx, scope, columns, primaryField.DBName, id, versionField.DBName, version); err != nil {
+			return err
+		}
+		if oldValues == nil {
+			return versionConflict(tx, scope, primaryField.DBName, id, versionField.DBName, version)
+		}
+	}
+
+	// not through tx.Model(object), it would change the model even if the version doesn't match
+	now := gorm.NowFunc()
+	updatedAtField, hasUpdatedAt := scope.FieldByName("UpdatedAt")
+	if hasUpdatedAt {
+		updateData[updatedAtField.DBName] = now
+	}
+	updateData[versionField.DBName] = version + 1
+	result := tx.Table(scope.TableName()).
+		Where(fmt.Sprintf("%s = ? AND %s = ?", scope.Quote(primaryField.DBName), scope.Quote(versionField.DBName)), id, version).
+		UpdateColumns(updateData)
+	if result.Error != nil {
+		return errors.WithStack(result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return versionConflict(tx, scope, primaryField.DBName, id, versionField.DBName, version)
+	}
+
+	if oldValues != nil {
+		if err := writeAuditRecord(tx, scope, id, columns, oldValues, newValues, opts); err != nil {
+			return err
+		}
+	}
+	if err := versionField.Set(version + 1); err != nil {
+		return errors.WithStack(err)
+	}
+	if hasUpdatedAt {
+		if err := updatedAtField.Set(now); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
+// writeAuditRecord records the columns which were changed by the update
+func writeAuditRecord(tx *gorm.DB, scope *gorm.Scope, id interface{}, columns []string, oldValues, newValues map[string]interface{}, opts VersionedUpdateOptions) error {
+	changes := map[string]AuditChange{}
+	for _, column := range columns {
+		oldValue, newValue := auditValue(oldValues[column]), auditValue(newValues[column])
+		oldJSON, err := json.Marshal(oldValue)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		newJSON, err := json.Marshal(newValue)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if string(oldJSON) != string(newJSON) {
+			changes[column] = AuditChange{Old: oldValue, New: newValue}
+		}
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+	encodedChanges, err := json.Marshal(changes)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	err = tx.Exec(fmt.Sprintf("INSERT INTO %s (table_name, record_id, actor, changes) VALUES (?, ?, ?, ?)", pq.QuoteIdentifier(opts.AuditTableName)),
+		scope.TableName(), fmt.Sprint(id), opts.Actor, string(encodedChanges)).Error
+	if err != nil {
+		return errors.Wrap(err, "Failed to write audit record")
+	}
+	return nil
+}
+
+// selectForUpdate returns the values of the columns, or nil if the row doesn't have the version
+func selectForUpdate(tx *gorm.DB, scope *gorm.Scope, columns []string, primaryKey string, id interface{}, versionColumn string, version int64) (map[string]interface{}, error) {
+	quoted := make([]string, 0, len(columns))
+	for _, column := range columns {
+		quoted = append(quoted, scope.Quote(column))
+	}
+	rows, err := tx.Raw(fmt.Sprintf("SELECT %s FROM %s WHERE %s = ? AND %s = ? FOR UPDATE",
+		strings.Join(quoted, ", "), scope.QuotedTableName(), scope.Quote(primaryKey), scope.Quote(versionColumn)), id, version).Rows()
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to load current values")
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			logging.WithContext(nil).Error("Failed to close rows", zap.Error(err))
+		}
+	}()
+	if !rows.Next() {
+		return nil, errors.WithStack(rows.Err())
+	}
+
+	values := make([]interface{}, len(columns))
+	pointers := make([]interface{}, len(columns))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+	if err := rows.Scan(pointers...); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	oldValues := map[string]interface{}{}
+	for i, column := range columns {
+		oldValues[column] = values[i]
+	}
+	return oldValues, nil
+}
+
+// versionConflict returns a *ConflictError with the current version of the row,
+// or an error wrapping gorm.ErrRecordNotFound if it doesn't exist
+func versionConflict(tx *gorm.DB, scope *gorm.Scope, primaryKey string, id interface{}, versionColumn string, version int64) error {
+	var current struct {
+		Version int64
+	}
+	err := tx.Raw(fmt.Sprintf("SELECT %s AS version FROM %s WHERE %s = ?",
+		scope.Quote(versionColumn), scope.QuotedTableName(), scope.Quote(primaryKey)), id).Scan(&current).Error
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return &ConflictError{Table: scope.TableName(), ID: id, ExpectedVersion: version, CurrentVersion: current.Version}
+}
+
+// auditValue makes the database and the model values comparable as JSON
+func auditValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case []byte:
+		if json.Valid(v) {
+			return json.RawMessage(v)
+		}
+		return string(v)
+	case time.Time:
+		return v.UTC()
+	case *time.Time:
+		if v == nil {
+			return nil
+		}
+		return v.UTC()
+	}
+	return value
+}
@@ -0,0 +1,79 @@
+package models_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bitrise-io/api-utils/database"
+	"github.com/bitrise-io/api-utils/database/databasetest"
+	"github.com/bitrise-io/api-utils/models"
+)
+
+type versionedApp struct {
+	ID        int64     `json:"id"`
+	Title     string    `json:"title"`
+	Version   int64     `json:"version"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func (versionedApp) TableName() string {
+	return "apps"
+}
+
+func Test_ConflictError(t *testing.T) {
+	err := &models.ConflictError{Table: "apps", ID: int64(1), ExpectedVersion: 1, CurrentVersion: 2}
+	require.EqualError(t, err, "apps 1 was modified concurrently: expected version 1, found 2")
+}
+
+func Test_UpdatableModelService_UpdateWithVersion(t *testing.T) {
+	testDB := databasetest.New(t, databasetest.Config{
+		Schema: true,
+		Migrations: []database.Migration{
+			{Version: 1, Name: "create_apps", Up: "CREATE TABLE apps (id bigserial PRIMARY KEY, title text NOT NULL, version bigint NOT NULL DEFAULT 1, updated_at timestamptz NOT NULL DEFAULT now());"},
+			models.AuditLogMigration(2, ""),
+		},
+	})
+	db := testDB.DB()
+	service := models.UpdatableModelService{}
+	require.NoError(t, db.Create(&versionedApp{Title: "first", Version: 1}).Error)
+
+	t.Log("ok - version is incremented and the change audited")
+	{
+		app := versionedApp{}
+		require.NoError(t, db.First(&app).Error)
+		app.Title = "second"
+		require.NoError(t, service.UpdateWithVersion(db, &app, []string{"Title"}, models.VersionedUpdateOptions{Audit: true, Actor: "user-1"}))
+		require.Equal(t, int64(2), app.Version)
+
+		var audit struct {
+			TableName string
+			RecordID  string
+			Actor     string
+			Changes   string
+		}
+		require.NoError(t, db.Raw("SELECT table_name, record_id, actor, changes::text AS changes FROM audit_log").Scan(&audit).Error)
+		require.Equal(t, "apps", audit.TableName)
+		require.Equal(t, "1", audit.RecordID)
+		require.Equal(t, "user-1", audit.Actor)
+		require.JSONEq(t, `{"title":{"old":"first","new":"second"}}`, audit.Changes)
+	}
+	t.Log("error - stale version")
+	{
+		stale := versionedApp{ID: 1, Title: "third", Version: 1}
+		err := service.UpdateWithVersion(db, &stale, []string{"Title"}, models.VersionedUpdateOptions{})
+		var conflictErr *models.ConflictError
+		require.True(t, errors.As(err, &conflictErr))
+		require.Equal(t, &models.ConflictError{Table: "apps", ID: int64(1), ExpectedVersion: 1, CurrentVersion: 2}, conflictErr)
+		require.Equal(t, int64(1), stale.Version)
+	}
+	t.Log("error - missing record")
+	{
+		missing := versionedApp{ID: 2, Title: "third", Version: 1}
+		err := service.UpdateWithVersion(db, &missing, []string{"Title"}, models.VersionedUpdateOptions{})
+		require.True(t, errors.Is(err, gorm.ErrRecordNotFound))
+	}
+}
@@ -0,0 +1,306 @@
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/bitrise-io/api-utils/database"
+	"github.com/bitrise-io/api-utils/logging"
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultTableName    = "outbox_events"
+	defaultBatchSize    = 100
+	defaultPollInterval = time.Second
+	defaultMaxAttempts  = 10
+	defaultMinBackoff   = time.Second
+	defaultMaxBackoff   = 10 * time.Minute
+	defaultRetention    = 7 * 24 * time.Hour
+	pruneInterval       = time.Hour
+)
+
+// Event ...
+type Event struct {
+	Topic string
+	// Key groups the related events, e.g. it's the message group of FIFO SQS queues.
+	// The events of a key are relayed in order, an event isn't relayed while an earlier
+	// one of its key is retried. Once the earlier one runs out of attempts the later
+	// ones are relayed.
+	Key string
+	// Payload is encoded as JSON
+	Payload interface{}
+	Headers map[string]string
+}
+
+// Config ...
+type Config struct {
+	// TableName of the outbox, defaults to outbox_events
+	TableName string
+	// BatchSize of the relayed events, defaults to 100
+	BatchSize int
+	// PollInterval of the relay when there are no pending events, defaults to 1 second
+	PollInterval time.Duration
+	// MaxAttempts of publishing an event, defaults to 10. The failed events are kept
+	// in the table until they are pruned.
+	MaxAttempts int
+	// MinBackoff is the wait after the first failed attempt, it's doubled after every
+	// further one up to MaxBackoff. Defaults to 1 second and 10 minutes.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// Retention of the delivered and failed events, defaults to 7 days
+	Retention time.Duration
+	// LockKey of the advisory lock held by the relay, defaults to a hash of the table name
+	LockKey int64
+}
+
+// Outbox stores the events in the transaction of the change they are about, and relays
+// them to the publisher after the commit. The events are delivered at least once: if the
+// relay stops after publishing an event but before marking it, it's published again.
+type Outbox struct {
+	conn      *database.Connection
+	publisher Publisher
+	config    Config
+}
+
+// New ...
+func New(conn *database.Connection, publisher Publisher, config Config) *Outbox {
+	if config.TableName == "" {
+		config.TableName = defaultTableName
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = defaultBatchSize
+	}
+	if config.PollInterval == 0 {
+		config.PollInterval = defaultPollInterval
+	}
+	if config.MaxAttempts <= 0 {
+		config.MaxAttempts = defaultMaxAttempts
+	}
+	if config.MinBackoff == 0 {
+		config.MinBackoff = defaultMinBackoff
+	}
+	if config.MaxBackoff == 0 {
+		config.MaxBackoff = defaultMaxBackoff
+	}
+	if config.Retention == 0 {
+		config.Retention = defaultRetention
+	}
+	if config.LockKey == 0 {
+		config.LockKey = database.AdvisoryLockKey("outbox:" + config.TableName)
+	}
+	return &Outbox{conn: conn, publisher: publisher, config: config}
+}
+
+// Migration creates the outbox table, it should be added to the service's migrations.
+// The table name defaults to outbox_events.
+func Migration(version int64, tableName string) database.Migration {
+	if tableName == "" {
+		tableName = defaultTableName
+	}
+	table := pq.QuoteIdentifier(tableName)
+	index := pq.QuoteIdentifier(tableName + "_pending_idx")
+	keyIndex := pq.QuoteIdentifier(tableName + "_pending_key_idx")
+	return database.Migration{
+		Version: version,
+		Name:    "create_" + tableName,
+		Up: fmt.Sprintf(`CREATE TABLE %s (
+	id bigserial PRIMARY KEY,
+	topic text NOT NULL,
+	key text NOT NULL DEFAULT '',
+	payload jsonb NOT NULL,
+	headers jsonb NOT NULL DEFAULT '{}',
+	attempts integer NOT NULL DEFAULT 0,
+	last_error text,
+	next_attempt_at timestamptz NOT NULL DEFAULT now(),
+	delivered_at timestamptz,
+	created_at timestamptz NOT NULL DEFAULT now()
+);
+CREATE INDEX %s ON %s (next_attempt_at) WHERE delivered_at IS NULL;
+CREATE INDEX %s ON %s (key, id) WHERE delivered_at IS NULL;`, table, index, table, keyIndex, table),
+		Down: fmt.Sprintf("DROP TABLE %s;", table),
+	}
+}
+
+// Write stores the events, tx should be the transaction of the change they are about
+func (o *Outbox) Write(tx *gorm.DB, events ...Event) error {
+	for _, event := range events {
+		if event.Topic == "" {
+			return errors.New("No event topic specified")
+		}
+		payload, err := json.Marshal(event.Payload)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to encode %s event payload", event.Topic)
+		}
+		headers := event.Headers
+		if headers == nil {
+			headers = map[string]string{}
+		}
+		encodedHeaders, err := json.Marshal(headers)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to encode %s event headers", event.Topic)
+		}
+		err = tx.Exec(fmt.Sprintf("INSERT INTO %s (topic, key, payload, headers) VALUES (?, ?, ?, ?)", pq.QuoteIdentifier(o.config.TableName)),
+			event.Topic, event.Key, string(payload), string(encodedHeaders)).Error
+		if err != nil {
+			return errors.Wrapf(err, "Failed to write %s event to outbox", event.Topic)
+		}
+	}
+	return nil
+}
+
+// Run relays the events until the context is cancelled, and returns its error. Only
+// the instance holding the advisory lock relays, the others wait for it.
+func (o *Outbox) Run(ctx context.Context) error {
+	for {
+		if err := o.relayWithLock(ctx); err != nil && ctx.Err() == nil {
+			logging.WithContext(ctx).Error("Outbox relay failed", zap.Error(err))
+		}
+		select {
+		case <-time.After(o.config.PollInterval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (o *Outbox) relayWithLock(ctx context.Context) error {
+	_, err := o.conn.TryAdvisoryLock(ctx, o.config.LockKey, func(ctx context.Context, lockConn *sql.Conn) error {
+		var lastPrune time.Time
+		for {
+			if time.Since(lastPrune) >= pruneInterval {
+				if _, err := o.Prune(ctx); err != nil {
+					return err
+				}
+				lastPrune = time.Now()
+			}
+			relayed, err := o.RelayBatch(ctx)
+			if err != nil {
+				return err
+			}
+			if relayed < o.config.BatchSize {
+				select {
+				case <-time.After(o.config.PollInterval):
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+			// the lock is gone with the connection
+			if err := lockConn.PingContext(ctx); err != nil {
+				return errors.Wrap(err, "Lost outbox lock connection")
+			}
+		}
+	})
+	return err
+}
+
+// RelayBatch publishes a batch of the pending events, and returns the number of the
+// ones it selected. It can be called concurrently, the rows being relayed are skipped,
+// as are the later events of their keys. After a failed event the later ones of its
+// key aren't published in the batch.
+func (o *Outbox) RelayBatch(ctx context.Context) (int, error) {
+	table := pq.QuoteIdentifier(o.config.TableName)
+	attempted := 0
+	err := o.conn.WithTransaction(ctx, &database.TxOptions{MaxRetries: -1}, func(ctx context.Context, tx *gorm.DB) error {
+		messages, err := o.pending(tx)
+		if err != nil {
+			return err
+		}
+		attempted = len(messages)
+
+		failedKeys := map[string]bool{}
+		for _, message := range messages {
+			if message.Key != "" && failedKeys[message.Key] {
+				continue
+			}
+			if err := o.publisher.Publish(ctx, message); err != nil {
+				if message.Key != "" {
+					failedKeys[message.Key] = true
+				}
+				backoff := database.ExponentialBackoff(o.config.MinBackoff, o.config.MaxBackoff, message.Attempts+1)
+				logging.WithContext(ctx).Warn("Failed to publish outbox event",
+					zap.Int64("id", message.ID), zap.String("topic", message.Topic), zap.Int("attempt", message.Attempts+1), zap.Error(err))
+				err = tx.Exec(fmt.Sprintf(`UPDATE %s SET attempts = attempts + 1, last_error = ?,
+					next_attempt_at = now() + ? * interval '1 millisecond' WHERE id = ?`, table),
+					err.Error(), int64(backoff/time.Millisecond), message.ID).Error
+				if err != nil {
+					return errors.Wrap(err, "Failed to record outbox event failure")
+				}
+				continue
+			}
+			err := tx.Exec(fmt.Sprintf("UPDATE %s SET attempts = attempts + 1, last_error = NULL, delivered_at = now() WHERE id = ?", table), message.ID).Error
+			if err != nil {
+				return errors.Wrap(err, "Failed to mark outbox event as delivered")
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return attempted, nil
+}
+
+// pending locks a batch of the pending events, without the ones which have an earlier
+// event of their key outside of the batch that's still retried, e.g. it's waiting
+// for its backoff or it's locked by another relay
+func (o *Outbox) pending(tx *gorm.DB) ([]Message, error) {
+	table := pq.QuoteIdentifier(o.config.TableName)
+	rows, err := tx.Raw(fmt.Sprintf(`WITH batch AS (
+			SELECT id FROM %s
+			WHERE delivered_at IS NULL AND next_attempt_at <= now() AND attempts < ?
+			ORDER BY id LIMIT ? FOR UPDATE SKIP LOCKED
+		)
+		SELECT e.id, e.topic, e.key, e.payload, e.headers, e.attempts, e.created_at FROM %s e
+		WHERE e.id IN (SELECT id FROM batch) AND (e.key = '' OR NOT EXISTS (
+			SELECT 1 FROM %s earlier
+			WHERE earlier.key = e.key AND earlier.id < e.id AND earlier.delivered_at IS NULL
+				AND earlier.attempts < ? AND earlier.id NOT IN (SELECT id FROM batch)
+		))
+		ORDER BY e.id`, table, table, table),
+		o.config.MaxAttempts, o.config.BatchSize, o.config.MaxAttempts).Rows()
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to query pending outbox events")
+	}
+	defer closeRows(rows)
+
+	messages := []Message{}
+	for rows.Next() {
+		message := Message{}
+		var payload, headers []byte
+		if err := rows.Scan(&message.ID, &message.Topic, &message.Key, &payload, &headers, &message.Attempts, &message.CreatedAt); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		message.Payload = json.RawMessage(payload)
+		if err := json.Unmarshal(headers, &message.Headers); err != nil {
+			return nil, errors.Wrapf(err, "Failed to decode headers of outbox event %d", message.ID)
+		}
+		messages = append(messages, message)
+	}
+	return messages, errors.WithStack(rows.Err())
+}
+
+// Prune deletes the delivered events and the ones which ran out of attempts
+// after the retention period, and returns their number
+func (o *Outbox) Prune(ctx context.Context) (int64, error) {
+	cutoff := time.Now().Add(-o.config.Retention)
+	result := o.conn.WithContext(ctx).Exec(fmt.Sprintf(`DELETE FROM %s
+		WHERE delivered_at < ? OR (delivered_at IS NULL AND attempts >= ? AND created_at < ?)`, pq.QuoteIdentifier(o.config.TableName)),
+		cutoff, o.config.MaxAttempts, cutoff)
+	if result.Error != nil {
+		return 0, errors.Wrap(result.Error, "Failed to prune outbox")
+	}
+	return result.RowsAffected, nil
+}
+
+func closeRows(rows *sql.Rows) {
+	if err := rows.Close(); err != nil {
+		logging.WithContext(nil).Error("Failed to close rows", zap.Error(err))
+	}
+}
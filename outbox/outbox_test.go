@@ -0,0 +1,110 @@
+package outbox_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bitrise-io/api-utils/database"
+	"github.com/bitrise-io/api-utils/database/databasetest"
+	"github.com/bitrise-io/api-utils/outbox"
+)
+
+func Test_Outbox(t *testing.T) {
+	published := []outbox.Message{}
+	var publishErr error
+	failingTopic := ""
+	publisher := outbox.PublisherFunc(func(ctx context.Context, message outbox.Message) error {
+		if publishErr != nil {
+			return publishErr
+		}
+		if message.Topic == failingTopic {
+			return errors.New("rejected")
+		}
+		published = append(published, message)
+		return nil
+	})
+	testDB := databasetest.New(t, databasetest.Config{Schema: true, Migrations: []database.Migration{outbox.Migration(1, "")}})
+	// retried right away
+	o := outbox.New(testDB.Connection(), publisher, outbox.Config{MinBackoff: time.Nanosecond})
+	ctx := context.Background()
+
+	t.Log("ok - rolled back events are not relayed")
+	{
+		err := testDB.Connection().WithTransaction(ctx, nil, func(ctx context.Context, tx *gorm.DB) error {
+			require.NoError(t, o.Write(tx, outbox.Event{Topic: "build.started", Payload: map[string]string{"build_id": "build-1"}}))
+			return errors.New("rolled back")
+		})
+		require.Error(t, err)
+
+		relayed, err := o.RelayBatch(ctx)
+		require.NoError(t, err)
+		require.Equal(t, 0, relayed)
+	}
+	t.Log("ok - failed events are retried")
+	{
+		err := testDB.Connection().WithTransaction(ctx, nil, func(ctx context.Context, tx *gorm.DB) error {
+			return o.Write(tx, outbox.Event{Topic: "build.finished", Key: "app-1", Payload: map[string]string{"build_id": "build-1"}})
+		})
+		require.NoError(t, err)
+
+		publishErr = errors.New("unavailable")
+		relayed, err := o.RelayBatch(ctx)
+		require.NoError(t, err)
+		require.Equal(t, 1, relayed)
+		require.Empty(t, published)
+
+		publishErr = nil
+		relayed, err = o.RelayBatch(ctx)
+		require.NoError(t, err)
+		require.Equal(t, 1, relayed)
+		require.Len(t, published, 1)
+		require.Equal(t, "build.finished", published[0].Topic)
+		require.Equal(t, 1, published[0].Attempts)
+		require.JSONEq(t, `{"build_id":"build-1"}`, string(published[0].Payload))
+
+		relayed, err = o.RelayBatch(ctx)
+		require.NoError(t, err)
+		require.Equal(t, 0, relayed)
+	}
+	t.Log("ok - the events of a key are relayed in order")
+	{
+		published = []outbox.Message{}
+		// the failed events wait for an hour
+		delayed := outbox.New(testDB.Connection(), publisher, outbox.Config{MinBackoff: time.Hour})
+		err := testDB.Connection().WithTransaction(ctx, nil, func(ctx context.Context, tx *gorm.DB) error {
+			return delayed.Write(tx,
+				outbox.Event{Topic: "build.started", Key: "app-2", Payload: map[string]string{"build_id": "build-2"}},
+				outbox.Event{Topic: "build.finished", Key: "app-2", Payload: map[string]string{"build_id": "build-2"}},
+				outbox.Event{Topic: "app.updated", Key: "app-3", Payload: map[string]string{"app_slug": "app-3"}},
+			)
+		})
+		require.NoError(t, err)
+
+		failingTopic = "build.started"
+		relayed, err := delayed.RelayBatch(ctx)
+		require.NoError(t, err)
+		require.Equal(t, 3, relayed)
+		require.Len(t, published, 1)
+		require.Equal(t, "app.updated", published[0].Topic)
+
+		// the later event of the key isn't relayed while the failed one waits
+		failingTopic = ""
+		relayed, err = delayed.RelayBatch(ctx)
+		require.NoError(t, err)
+		require.Equal(t, 0, relayed)
+		require.Len(t, published, 1)
+
+		require.NoError(t, testDB.DB().Exec("UPDATE outbox_events SET next_attempt_at = now()").Error)
+		relayed, err = delayed.RelayBatch(ctx)
+		require.NoError(t, err)
+		require.Equal(t, 2, relayed)
+		require.Len(t, published, 3)
+		require.Equal(t, "build.started", published[1].Topic)
+		require.Equal(t, "build.finished", published[2].Topic)
+	}
+}
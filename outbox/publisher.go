@@ -0,0 +1,160 @@
+package outbox
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bitrise-io/api-utils/httpresponse"
+	"github.com/bitrise-io/api-utils/providers"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultWebhookTimeout = 10 * time.Second
+
+	// WebhookSignatureHeader holds the sha256=<hex HMAC> signature of the body,
+	// it can be checked with security.SignatureVerifier
+	WebhookSignatureHeader = "X-Outbox-Signature"
+	// WebhookIDHeader holds the ID of the event, to deduplicate the deliveries
+	WebhookIDHeader = "X-Outbox-Event-ID"
+	// WebhookTopicHeader ...
+	WebhookTopicHeader = "X-Outbox-Topic"
+	// WebhookKeyHeader ...
+	WebhookKeyHeader = "X-Outbox-Key"
+)
+
+// Message is a stored event being relayed
+type Message struct {
+	// ID is unique and increasing, the consumers can deduplicate with it
+	ID        int64
+	Topic     string
+	Key       string
+	Payload   json.RawMessage
+	Headers   map[string]string
+	Attempts  int
+	CreatedAt time.Time
+}
+
+// Publisher delivers the events to the consumers. The event is retried if it returns an error.
+type Publisher interface {
+	Publish(ctx context.Context, message Message) error
+}
+
+// PublisherFunc ...
+type PublisherFunc func(ctx context.Context, message Message) error
+
+// Publish ...
+func (f PublisherFunc) Publish(ctx context.Context, message Message) error {
+	return f(ctx, message)
+}
+
+// RedisStreamClient is implemented by redis.Client
+type RedisStreamClient interface {
+	XAdd(stream string, maxLen int64, fields map[string]string) (string, error)
+}
+
+// RedisStreamPublisher adds the events to the stream named after their topic
+type RedisStreamPublisher struct {
+	Client RedisStreamClient
+	// StreamPrefix is prepended to the topic
+	StreamPrefix string
+	// MaxLen trims the streams to about this many entries if it's set
+	MaxLen int64
+}
+
+// Publish ...
+func (p *RedisStreamPublisher) Publish(ctx context.Context, message Message) error {
+	headers, err := json.Marshal(message.Headers)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	_, err = p.Client.XAdd(p.StreamPrefix+message.Topic, p.MaxLen, map[string]string{
+		"id":      strconv.FormatInt(message.ID, 10),
+		"key":     message.Key,
+		"payload": string(message.Payload),
+		"headers": string(headers),
+	})
+	return errors.Wrapf(err, "Failed to add event to stream %s", p.StreamPrefix+message.Topic)
+}
+
+// SQSPublisher sends the events to a queue, with the topic and the headers as message
+// attributes. For FIFO queues the key is the message group and the ID deduplicates.
+type SQSPublisher struct {
+	Provider providers.SQSInterface
+	FIFO     bool
+}
+
+// Publish ...
+func (p *SQSPublisher) Publish(ctx context.Context, message Message) error {
+	attributes := map[string]string{"topic": message.Topic}
+	for name, value := range message.Headers {
+		attributes[name] = value
+	}
+	sqsMessage := providers.SQSMessage{Body: string(message.Payload), Attributes: attributes}
+	if p.FIFO {
+		sqsMessage.GroupID = message.Key
+		if sqsMessage.GroupID == "" {
+			sqsMessage.GroupID = message.Topic
+		}
+		sqsMessage.DeduplicationID = strconv.FormatInt(message.ID, 10)
+	}
+	return errors.WithStack(p.Provider.SendMessages(ctx, []providers.SQSMessage{sqsMessage}))
+}
+
+// WebhookPublisher posts the payloads to a URL, with the event's headers and the
+// X-Outbox-* headers. Any response other than 2xx is a failure.
+type WebhookPublisher struct {
+	URL string
+	// Secret signs the body in the WebhookSignatureHeader if it's set
+	Secret string
+	// Client defaults to an http.Client with a 10 seconds timeout
+	Client *http.Client
+}
+
+// Publish ...
+func (p *WebhookPublisher) Publish(ctx context.Context, message Message) error {
+	req, err := http.NewRequest(http.MethodPost, p.URL, bytes.NewReader(message.Payload))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	req = req.WithContext(ctx)
+	for name, value := range message.Headers {
+		req.Header.Set(name, value)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookIDHeader, strconv.FormatInt(message.ID, 10))
+	req.Header.Set(WebhookTopicHeader, message.Topic)
+	if message.Key != "" {
+		req.Header.Set(WebhookKeyHeader, message.Key)
+	}
+	if p.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(p.Secret))
+		mac.Write(message.Payload)
+		req.Header.Set(WebhookSignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	client := p.Client
+	if client == nil {
+		client = &http.Client{Timeout: defaultWebhookTimeout}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "Failed to post event")
+	}
+	defer httpresponse.BodyCloseWithErrorLog(resp)
+	// drained, so the connection can be reused
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.Errorf("Webhook responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package outbox_test
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/bitrise-io/api-utils/outbox"
+	"github.com/bitrise-io/api-utils/providers"
+	"github.com/bitrise-io/api-utils/redis"
+	"github.com/bitrise-io/api-utils/security"
+)
+
+var testMessage = outbox.Message{
+	ID:      42,
+	Topic:   "build.finished",
+	Key:     "app-1",
+	Payload: json.RawMessage(`{"build_id":"build-1","status":"success"}`),
+	Headers: map[string]string{"trace-id": "abc"},
+}
+
+func Test_RedisStreamPublisher(t *testing.T) {
+	var stream string
+	var fields map[string]string
+	client := &redis.ClientMock{XAddFn: func(s string, maxLen int64, f map[string]string) (string, error) {
+		require.Equal(t, int64(1000), maxLen)
+		stream, fields = s, f
+		return "1-0", nil
+	}}
+
+	err := (&outbox.RedisStreamPublisher{Client: client, StreamPrefix: "events:", MaxLen: 1000}).Publish(context.Background(), testMessage)
+	require.NoError(t, err)
+	require.Equal(t, "events:build.finished", stream)
+	require.Equal(t, map[string]string{
+		"id":      "42",
+		"key":     "app-1",
+		"payload": `{"build_id":"build-1","status":"success"}`,
+		"headers": `{"trace-id":"abc"}`,
+	}, fields)
+}
+
+func Test_SQSPublisher(t *testing.T) {
+	var sent []providers.SQSMessage
+	provider := &providers.SQSMock{SendMessagesFn: func(ctx context.Context, messages []providers.SQSMessage) error {
+		sent = messages
+		return nil
+	}}
+
+	err := (&outbox.SQSPublisher{Provider: provider, FIFO: true}).Publish(context.Background(), testMessage)
+	require.NoError(t, err)
+	require.Equal(t, []providers.SQSMessage{{
+		Body:            `{"build_id":"build-1","status":"success"}`,
+		Attributes:      map[string]string{"topic": "build.finished", "trace-id": "abc"},
+		GroupID:         "app-1",
+		DeduplicationID: "42",
+	}}, sent)
+}
+
+func Test_WebhookPublisher(t *testing.T) {
+	status := http.StatusNoContent
+	var received *http.Request
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r
+		var err error
+		body, err = ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+	publisher := &outbox.WebhookPublisher{URL: server.URL, Secret: "secret"}
+
+	t.Log("ok - signed")
+	{
+		require.NoError(t, publisher.Publish(context.Background(), testMessage))
+		require.Equal(t, http.MethodPost, received.Method)
+		require.Equal(t, `{"build_id":"build-1","status":"success"}`, string(body))
+		require.Equal(t, "42", received.Header.Get(outbox.WebhookIDHeader))
+		require.Equal(t, "build.finished", received.Header.Get(outbox.WebhookTopicHeader))
+		require.Equal(t, "app-1", received.Header.Get(outbox.WebhookKeyHeader))
+		require.Equal(t, "abc", received.Header.Get("Trace-Id"))
+
+		verifier := security.NewSignatureVerifier("secret", string(body), received.Header.Get(outbox.WebhookSignatureHeader))
+		require.True(t, verifier.Verify())
+	}
+	t.Log("error - not 2xx")
+	{
+		status = http.StatusBadGateway
+		require.EqualError(t, publisher.Publish(context.Background(), testMessage), "Webhook responded with status 502")
+	}
+}
@@ -3,7 +3,9 @@ package providers
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"log"
 	"net/http"
 	"time"
 
@@ -17,14 +19,23 @@ import (
 
 // AWSInterface ...
 type AWSInterface interface {
-	GeneratePresignedGETURL(key string, expiresIn time.Duration) (string, error)
+	PresignedGETURLGenerator
 	GeneratePresignedPUTURL(key string, expiresIn time.Duration, fileSize int64) (string, error)
+	GeneratePresignedPUTURLWithChecksum(key string, expiresIn time.Duration, fileSize int64, checksum Checksum) (string, error)
 	GetObject(key string) (string, error)
+	GetObjectStream(key string, expected Checksum) (io.ReadCloser, error)
 	GetConfig() AWSConfig
 	PutObject(key string, objectBytes []byte) error
+	PutObjectWithChecksum(key string, objectBytes []byte, algorithm ChecksumAlgorithm) (Checksum, error)
 	CopyObject(from string, to string) error
 	MoveObject(from string, to string) error
 	DeleteObject(path string) error
+	GetObjectTagging(key string) (map[string]string, error)
+	PutObjectTagging(key string, tags map[string]string) error
+	DeleteObjectTagging(key string) error
+	GetObjectMetadata(key string) (map[string]string, error)
+	UpdateObjectMetadata(key string, metadata map[string]string) error
+	PutLifecycleRules(rules []LifecycleRule) error
 }
 
 // AWSConfig ...
@@ -33,6 +44,9 @@ type AWSConfig struct {
 	AccessKeyID     string
 	SecretAccessKey string
 	Bucket          string
+	// Endpoint is optional, it can be used to connect to an AWS compatible
+	// service (e.g. a local MinIO). Path style addressing is used for S3 with it.
+	Endpoint string
 }
 
 // AWS ...
@@ -45,17 +59,30 @@ func (p *AWS) GetConfig() AWSConfig {
 	return p.Config
 }
 
-func (p *AWS) createS3Client() (svc *s3.S3, err error) {
-	sess, err := session.NewSession(&aws.Config{
+func (c AWSConfig) newSession() (*session.Session, error) {
+	config := &aws.Config{
 		Credentials: credentials.NewStaticCredentials(
-			p.Config.AccessKeyID,
-			p.Config.SecretAccessKey,
+			c.AccessKeyID,
+			c.SecretAccessKey,
 			""),
-		Region: aws.String(p.Config.Region),
-	})
+		Region: aws.String(c.Region),
+	}
+	if c.Endpoint != "" {
+		config.Endpoint = aws.String(c.Endpoint)
+		config.S3ForcePathStyle = aws.Bool(true)
+	}
+	sess, err := session.NewSession(config)
 	if err != nil {
 		return nil, errors.Wrap(err, "Session creation failed")
 	}
+	return sess, nil
+}
+
+func (p *AWS) createS3Client() (svc *s3.S3, err error) {
+	sess, err := p.Config.newSession()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
 
 	svc = s3.New(sess)
 	return
@@ -98,6 +125,32 @@ func (p *AWS) GeneratePresignedPUTURL(key string, expiresIn time.Duration, fileS
 	return presignedURL, nil
 }
 
+// GeneratePresignedPUTURLWithChecksum generates a presigned PUT URL which
+// only accepts content matching the given checksum. The X-Amz-Checksum-* value
+// is signed in the query of the URL, so the uploader doesn't have to send it.
+// In case of MD5 the uploader has to send the Content-MD5 header with the same value.
+func (p *AWS) GeneratePresignedPUTURLWithChecksum(key string, expiresIn time.Duration, fileSize int64, checksum Checksum) (string, error) {
+	if _, err := newChecksumHash(checksum.Algorithm); err != nil {
+		return "", errors.WithStack(err)
+	}
+	svc, err := p.createS3Client()
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	req, _ := svc.PutObjectRequest(&s3.PutObjectInput{
+		Bucket:        aws.String(p.Config.Bucket),
+		Key:           aws.String(key),
+		ContentLength: aws.Int64(fileSize),
+	})
+	checksum.setHeaders(req.HTTPRequest.Header)
+	presignedURL, err := req.Presign(expiresIn)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	return presignedURL, nil
+}
+
 // GetObject ...
 func (p *AWS) GetObject(key string) (string, error) {
 	presignedURL, err := p.GeneratePresignedGETURL(key, 10*time.Minute)
@@ -139,6 +192,63 @@ func (p *AWS) PutObject(key string, objectBytes []byte) error {
 	return nil
 }
 
+// PutObjectWithChecksum uploads the object with the checksum header of the given
+// algorithm, so S3 rejects the upload if the content gets corrupted on the way.
+func (p *AWS) PutObjectWithChecksum(key string, objectBytes []byte, algorithm ChecksumAlgorithm) (Checksum, error) {
+	checksum, err := ComputeChecksum(algorithm, objectBytes)
+	if err != nil {
+		return Checksum{}, errors.WithStack(err)
+	}
+	svc, err := p.createS3Client()
+	if err != nil {
+		return Checksum{}, errors.WithStack(err)
+	}
+
+	req, _ := svc.PutObjectRequest(&s3.PutObjectInput{
+		Bucket: aws.String(p.Config.Bucket),
+		Key:    aws.String(key),
+		Body:   bytes.NewReader(objectBytes),
+	})
+	checksum.setHeaders(req.HTTPRequest.Header)
+	if err := req.Send(); err != nil {
+		return Checksum{}, errors.WithStack(err)
+	}
+	return checksum, nil
+}
+
+// GetObjectStream returns the content of the object as a stream which verifies
+// the checksum while it's read. When the expected checksum has no value it's taken
+// from the response headers. On mismatch the final Read returns a *ChecksumMismatchError.
+func (p *AWS) GetObjectStream(key string, expected Checksum) (io.ReadCloser, error) {
+	if _, err := newChecksumHash(expected.Algorithm); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	svc, err := p.createS3Client()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	req, out := svc.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(p.Config.Bucket),
+		Key:    aws.String(key),
+	})
+	req.HTTPRequest.Header.Set(checksumModeHeader, "ENABLED")
+	if err := req.Send(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	if expected.Value == "" {
+		expected, err = checksumFromHeaders(expected.Algorithm, req.HTTPResponse.Header)
+		if err != nil {
+			if cerr := out.Body.Close(); cerr != nil {
+				log.Printf(" [!] Exception: Failed to close object body: %+v", cerr)
+			}
+			return nil, errors.WithStack(err)
+		}
+	}
+	return newChecksumVerifyingReader(out.Body, expected)
+}
+
 // CopyObject ...
 func (p *AWS) CopyObject(from string, to string) error {
 	svc, err := p.createS3Client()
@@ -191,3 +301,140 @@ func (p *AWS) DeleteObject(path string) error {
 
 	return nil
 }
+
+// GetObjectTagging ...
+func (p *AWS) GetObjectTagging(key string) (map[string]string, error) {
+	svc, err := p.createS3Client()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	out, err := svc.GetObjectTagging(&s3.GetObjectTaggingInput{
+		Bucket: aws.String(p.Config.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	tags := map[string]string{}
+	for _, tag := range out.TagSet {
+		tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+	}
+	return tags, nil
+}
+
+// PutObjectTagging replaces the whole tag set of the object
+func (p *AWS) PutObjectTagging(key string, tags map[string]string) error {
+	svc, err := p.createS3Client()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	_, err = svc.PutObjectTagging(&s3.PutObjectTaggingInput{
+		Bucket:  aws.String(p.Config.Bucket),
+		Key:     aws.String(key),
+		Tagging: &s3.Tagging{TagSet: s3Tags(tags)},
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return nil
+}
+
+// DeleteObjectTagging ...
+func (p *AWS) DeleteObjectTagging(key string) error {
+	svc, err := p.createS3Client()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	_, err = svc.DeleteObjectTagging(&s3.DeleteObjectTaggingInput{
+		Bucket: aws.String(p.Config.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return nil
+}
+
+// GetObjectMetadata returns the user defined (x-amz-meta-*) metadata of the object
+func (p *AWS) GetObjectMetadata(key string) (map[string]string, error) {
+	svc, err := p.createS3Client()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	out, err := svc.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(p.Config.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return aws.StringValueMap(out.Metadata), nil
+}
+
+// UpdateObjectMetadata replaces the user defined metadata of the object. S3 objects
+// are immutable, so it's done by copying the object onto itself. The content type
+// and the tags are kept, the ACL is reset to the bucket default as with any copy.
+func (p *AWS) UpdateObjectMetadata(key string, metadata map[string]string) error {
+	svc, err := p.createS3Client()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	head, err := svc.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(p.Config.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	_, err = svc.CopyObject(&s3.CopyObjectInput{
+		Bucket:            aws.String(p.Config.Bucket),
+		Key:               aws.String(key),
+		CopySource:        aws.String(fmt.Sprintf("%s/%s", p.Config.Bucket, key)),
+		ContentType:       head.ContentType,
+		Metadata:          aws.StringMap(metadata),
+		MetadataDirective: aws.String(s3.MetadataDirectiveReplace),
+		TaggingDirective:  aws.String(s3.TaggingDirectiveCopy),
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return nil
+}
+
+// PutLifecycleRules replaces the lifecycle configuration of the bucket with the given rules
+func (p *AWS) PutLifecycleRules(rules []LifecycleRule) error {
+	lifecycleRules := []*s3.LifecycleRule{}
+	for _, rule := range rules {
+		lifecycleRule, err := rule.s3LifecycleRule()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		lifecycleRules = append(lifecycleRules, lifecycleRule)
+	}
+
+	svc, err := p.createS3Client()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	_, err = svc.PutBucketLifecycleConfiguration(&s3.PutBucketLifecycleConfigurationInput{
+		Bucket:                 aws.String(p.Config.Bucket),
+		LifecycleConfiguration: &s3.BucketLifecycleConfiguration{Rules: lifecycleRules},
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return nil
+}
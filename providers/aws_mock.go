@@ -1,6 +1,9 @@
 package providers
 
-import "time"
+import (
+	"io"
+	"time"
+)
 
 // AWSMock ...
 type AWSMock struct {
@@ -12,6 +15,17 @@ type AWSMock struct {
 	MoveObjectFn              func(string, string) error
 	CopyObjectFn              func(string, string) error
 	DeleteObjectFn            func(string) error
+
+	GeneratePresignedPUTURLWithChecksumFn func(string, time.Duration, int64, Checksum) (string, error)
+	GetObjectStreamFn                     func(string, Checksum) (io.ReadCloser, error)
+	PutObjectWithChecksumFn               func(string, []byte, ChecksumAlgorithm) (Checksum, error)
+
+	GetObjectTaggingFn     func(string) (map[string]string, error)
+	PutObjectTaggingFn     func(string, map[string]string) error
+	DeleteObjectTaggingFn  func(string) error
+	GetObjectMetadataFn    func(string) (map[string]string, error)
+	UpdateObjectMetadataFn func(string, map[string]string) error
+	PutLifecycleRulesFn    func([]LifecycleRule) error
 }
 
 // GetConfig ...
@@ -74,3 +88,75 @@ func (m *AWSMock) DeleteObject(path string) error {
 	}
 	return m.DeleteObjectFn(path)
 }
+
+// GeneratePresignedPUTURLWithChecksum ...
+func (m *AWSMock) GeneratePresignedPUTURLWithChecksum(key string, expiresIn time.Duration, fileSize int64, checksum Checksum) (string, error) {
+	if m.GeneratePresignedPUTURLWithChecksumFn == nil {
+		panic("You have to override GeneratePresignedPUTURLWithChecksum function in tests")
+	}
+	return m.GeneratePresignedPUTURLWithChecksumFn(key, expiresIn, fileSize, checksum)
+}
+
+// GetObjectStream ...
+func (m *AWSMock) GetObjectStream(key string, expected Checksum) (io.ReadCloser, error) {
+	if m.GetObjectStreamFn == nil {
+		panic("You have to override GetObjectStream function in tests")
+	}
+	return m.GetObjectStreamFn(key, expected)
+}
+
+// PutObjectWithChecksum ...
+func (m *AWSMock) PutObjectWithChecksum(key string, objectBytes []byte, algorithm ChecksumAlgorithm) (Checksum, error) {
+	if m.PutObjectWithChecksumFn == nil {
+		panic("You have to override PutObjectWithChecksum function in tests")
+	}
+	return m.PutObjectWithChecksumFn(key, objectBytes, algorithm)
+}
+
+// GetObjectTagging ...
+func (m *AWSMock) GetObjectTagging(key string) (map[string]string, error) {
+	if m.GetObjectTaggingFn == nil {
+		panic("You have to override GetObjectTagging function in tests")
+	}
+	return m.GetObjectTaggingFn(key)
+}
+
+// PutObjectTagging ...
+func (m *AWSMock) PutObjectTagging(key string, tags map[string]string) error {
+	if m.PutObjectTaggingFn == nil {
+		panic("You have to override PutObjectTagging function in tests")
+	}
+	return m.PutObjectTaggingFn(key, tags)
+}
+
+// DeleteObjectTagging ...
+func (m *AWSMock) DeleteObjectTagging(key string) error {
+	if m.DeleteObjectTaggingFn == nil {
+		panic("You have to override DeleteObjectTagging function in tests")
+	}
+	return m.DeleteObjectTaggingFn(key)
+}
+
+// GetObjectMetadata ...
+func (m *AWSMock) GetObjectMetadata(key string) (map[string]string, error) {
+	if m.GetObjectMetadataFn == nil {
+		panic("You have to override GetObjectMetadata function in tests")
+	}
+	return m.GetObjectMetadataFn(key)
+}
+
+// UpdateObjectMetadata ...
+func (m *AWSMock) UpdateObjectMetadata(key string, metadata map[string]string) error {
+	if m.UpdateObjectMetadataFn == nil {
+		panic("You have to override UpdateObjectMetadata function in tests")
+	}
+	return m.UpdateObjectMetadataFn(key, metadata)
+}
+
+// PutLifecycleRules ...
+func (m *AWSMock) PutLifecycleRules(rules []LifecycleRule) error {
+	if m.PutLifecycleRulesFn == nil {
+		panic("You have to override PutLifecycleRules function in tests")
+	}
+	return m.PutLifecycleRulesFn(rules)
+}
@@ -0,0 +1,161 @@
+package providers_test
+
+import (
+	"encoding/xml"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/bitrise-io/api-utils/providers"
+)
+
+func Test_AWS_ObjectTagging(t *testing.T) {
+	server, awsProvider := newS3TestServer()
+	defer server.Close()
+	require.NoError(t, awsProvider.PutObject("artifacts/app.apk", []byte("content")))
+
+	t.Log("ok - put and get tags")
+	{
+		tags := map[string]string{"app_slug": "app-slug-1", "build_id": "build-1", "retention": "short"}
+		require.NoError(t, awsProvider.PutObjectTagging("artifacts/app.apk", tags))
+
+		storedTags, err := awsProvider.GetObjectTagging("artifacts/app.apk")
+		require.NoError(t, err)
+		require.Equal(t, tags, storedTags)
+	}
+	t.Log("ok - delete tags")
+	{
+		require.NoError(t, awsProvider.DeleteObjectTagging("artifacts/app.apk"))
+
+		storedTags, err := awsProvider.GetObjectTagging("artifacts/app.apk")
+		require.NoError(t, err)
+		require.Equal(t, map[string]string{}, storedTags)
+	}
+	t.Log("error - object doesn't exist")
+	{
+		_, err := awsProvider.GetObjectTagging("artifacts/missing.apk")
+		require.Error(t, err)
+	}
+}
+
+func Test_AWS_ObjectMetadata(t *testing.T) {
+	server, awsProvider := newS3TestServer()
+	defer server.Close()
+	require.NoError(t, awsProvider.PutObject("artifacts/app.apk", []byte("content")))
+	require.NoError(t, awsProvider.PutObjectTagging("artifacts/app.apk", map[string]string{"retention": "long"}))
+
+	t.Log("ok - no metadata")
+	{
+		metadata, err := awsProvider.GetObjectMetadata("artifacts/app.apk")
+		require.NoError(t, err)
+		require.Equal(t, map[string]string{}, metadata)
+	}
+	t.Log("ok - update keeps the content and the tags")
+	{
+		require.NoError(t, awsProvider.UpdateObjectMetadata("artifacts/app.apk", map[string]string{"Build-Id": "build-1"}))
+
+		metadata, err := awsProvider.GetObjectMetadata("artifacts/app.apk")
+		require.NoError(t, err)
+		require.Equal(t, map[string]string{"Build-Id": "build-1"}, metadata)
+
+		tags, err := awsProvider.GetObjectTagging("artifacts/app.apk")
+		require.NoError(t, err)
+		require.Equal(t, map[string]string{"retention": "long"}, tags)
+
+		stream, err := awsProvider.GetObjectStream("artifacts/app.apk", providers.Checksum{Algorithm: providers.ChecksumAlgorithmMD5})
+		require.NoError(t, err)
+		content, err := ioutil.ReadAll(stream)
+		require.NoError(t, err)
+		require.Equal(t, "content", string(content))
+	}
+	t.Log("error - object doesn't exist")
+	{
+		require.Error(t, awsProvider.UpdateObjectMetadata("artifacts/missing.apk", map[string]string{"Build-Id": "build-1"}))
+	}
+}
+
+func Test_AWS_PutLifecycleRules(t *testing.T) {
+	type filter struct {
+		Prefix    *string     `xml:"Prefix"`
+		Tag       *s3TestTag  `xml:"Tag"`
+		AndPrefix *string     `xml:"And>Prefix"`
+		AndTags   []s3TestTag `xml:"And>Tag"`
+	}
+	type rule struct {
+		ID             string `xml:"ID"`
+		Status         string `xml:"Status"`
+		Filter         filter `xml:"Filter"`
+		ExpirationDays int64  `xml:"Expiration>Days"`
+	}
+	type lifecycleConfiguration struct {
+		Rules []rule `xml:"Rule"`
+	}
+	prefix := func(s string) *string { return &s }
+
+	t.Log("ok - expire by prefix, tag and both")
+	{
+		server, awsProvider := newS3TestServer()
+		defer server.Close()
+
+		require.NoError(t, awsProvider.PutLifecycleRules([]providers.LifecycleRule{
+			{ID: "tmp", Prefix: "tmp/", ExpirationDays: 1},
+			{ID: "short-retention", Tags: map[string]string{"retention": "short"}, ExpirationDays: 7},
+			{ID: "pull-request-artifacts", Prefix: "artifacts/", Tags: map[string]string{"retention": "short", "pr": "true"}, ExpirationDays: 3},
+		}))
+
+		config := lifecycleConfiguration{}
+		require.NoError(t, xml.Unmarshal(server.lifecycle, &config))
+		require.Equal(t, lifecycleConfiguration{Rules: []rule{
+			{ID: "tmp", Status: "Enabled", Filter: filter{Prefix: prefix("tmp/")}, ExpirationDays: 1},
+			{ID: "short-retention", Status: "Enabled", Filter: filter{Tag: &s3TestTag{Key: "retention", Value: "short"}}, ExpirationDays: 7},
+			{ID: "pull-request-artifacts", Status: "Enabled", Filter: filter{
+				AndPrefix: prefix("artifacts/"),
+				AndTags:   []s3TestTag{{Key: "pr", Value: "true"}, {Key: "retention", Value: "short"}},
+			}, ExpirationDays: 3},
+		}}, config)
+	}
+	t.Log("ok - expire all objects")
+	{
+		server, awsProvider := newS3TestServer()
+		defer server.Close()
+
+		require.NoError(t, awsProvider.PutLifecycleRules([]providers.LifecycleRule{{ID: "all", AllObjects: true, ExpirationDays: 30}}))
+
+		config := lifecycleConfiguration{}
+		require.NoError(t, xml.Unmarshal(server.lifecycle, &config))
+		require.Equal(t, lifecycleConfiguration{Rules: []rule{
+			{ID: "all", Status: "Enabled", Filter: filter{Prefix: prefix("")}, ExpirationDays: 30},
+		}}, config)
+	}
+	t.Log("error - no prefix and tags")
+	{
+		server, awsProvider := newS3TestServer()
+		defer server.Close()
+
+		err := awsProvider.PutLifecycleRules([]providers.LifecycleRule{
+			{ID: "tmp", Prefix: "tmp/", ExpirationDays: 1},
+			{ID: "everything", ExpirationDays: 1},
+		})
+		require.EqualError(t, err, "No prefix or tags specified for lifecycle rule everything")
+		require.Nil(t, server.lifecycle)
+	}
+	t.Log("error - prefix for all objects")
+	{
+		server, awsProvider := newS3TestServer()
+		defer server.Close()
+
+		err := awsProvider.PutLifecycleRules([]providers.LifecycleRule{{ID: "tmp", Prefix: "tmp/", AllObjects: true, ExpirationDays: 1}})
+		require.EqualError(t, err, "Lifecycle rule tmp has a prefix or tags, but it's for all objects")
+		require.Nil(t, server.lifecycle)
+	}
+	t.Log("error - invalid expiration")
+	{
+		server, awsProvider := newS3TestServer()
+		defer server.Close()
+
+		err := awsProvider.PutLifecycleRules([]providers.LifecycleRule{{ID: "tmp", Prefix: "tmp/"}})
+		require.EqualError(t, err, "Invalid expiration days for lifecycle rule tmp: 0")
+		require.Nil(t, server.lifecycle)
+	}
+}
@@ -0,0 +1,165 @@
+package providers
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ChecksumAlgorithm ...
+type ChecksumAlgorithm string
+
+const (
+	// ChecksumAlgorithmMD5 ...
+	ChecksumAlgorithmMD5 ChecksumAlgorithm = "MD5"
+	// ChecksumAlgorithmCRC32C ...
+	ChecksumAlgorithmCRC32C ChecksumAlgorithm = "CRC32C"
+	// ChecksumAlgorithmSHA256 ...
+	ChecksumAlgorithmSHA256 ChecksumAlgorithm = "SHA256"
+)
+
+const (
+	contentMD5Header        = "Content-MD5"
+	checksumModeHeader      = "X-Amz-Checksum-Mode"
+	checksumAlgorithmHeader = "X-Amz-Sdk-Checksum-Algorithm"
+)
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrChecksumNotAvailable ...
+var ErrChecksumNotAvailable = errors.New("No checksum available for the object")
+
+// ChecksumMismatchError is returned when the downloaded content doesn't match
+// the expected checksum.
+type ChecksumMismatchError struct {
+	Algorithm ChecksumAlgorithm
+	Expected  string
+	Actual    string
+}
+
+func (e *ChecksumMismatchError) Error() string {
+	return fmt.Sprintf("%s checksum mismatch: expected %s, got %s", e.Algorithm, e.Expected, e.Actual)
+}
+
+// Checksum holds a base64 encoded checksum value, as it is sent in
+// the S3 request and response headers.
+type Checksum struct {
+	Algorithm ChecksumAlgorithm
+	Value     string
+}
+
+// ComputeChecksum ...
+func ComputeChecksum(algorithm ChecksumAlgorithm, data []byte) (Checksum, error) {
+	h, err := newChecksumHash(algorithm)
+	if err != nil {
+		return Checksum{}, errors.WithStack(err)
+	}
+	if _, err := h.Write(data); err != nil {
+		return Checksum{}, errors.WithStack(err)
+	}
+	return Checksum{
+		Algorithm: algorithm,
+		Value:     base64.StdEncoding.EncodeToString(h.Sum(nil)),
+	}, nil
+}
+
+func newChecksumHash(algorithm ChecksumAlgorithm) (hash.Hash, error) {
+	switch algorithm {
+	case ChecksumAlgorithmMD5:
+		return md5.New(), nil
+	case ChecksumAlgorithmCRC32C:
+		return crc32.New(crc32cTable), nil
+	case ChecksumAlgorithmSHA256:
+		return sha256.New(), nil
+	}
+	return nil, errors.Errorf("Unsupported checksum algorithm: %s", algorithm)
+}
+
+// headerName returns the header S3 uses to transfer the checksum
+func (c Checksum) headerName() string {
+	if c.Algorithm == ChecksumAlgorithmMD5 {
+		return contentMD5Header
+	}
+	return "X-Amz-Checksum-" + strings.ToLower(string(c.Algorithm))
+}
+
+func (c Checksum) setHeaders(h http.Header) {
+	h.Set(c.headerName(), c.Value)
+	if c.Algorithm != ChecksumAlgorithmMD5 {
+		h.Set(checksumAlgorithmHeader, string(c.Algorithm))
+	}
+}
+
+// checksumFromHeaders looks up the checksum of the given algorithm in
+// the response headers. For MD5 the ETag is used, which only holds the
+// MD5 of the content for objects that weren't uploaded in multiple parts.
+// The other checksums of multipart uploads are composite ones, the checksum
+// of the part checksums with a -<parts> suffix, so they can't be verified
+// against the content either.
+func checksumFromHeaders(algorithm ChecksumAlgorithm, h http.Header) (Checksum, error) {
+	checksum := Checksum{Algorithm: algorithm}
+	if algorithm == ChecksumAlgorithmMD5 {
+		etag := strings.Trim(h.Get("ETag"), `"`)
+		if etag == "" || strings.Contains(etag, "-") {
+			return Checksum{}, ErrChecksumNotAvailable
+		}
+		sum, err := hex.DecodeString(etag)
+		if err != nil {
+			return Checksum{}, ErrChecksumNotAvailable
+		}
+		checksum.Value = base64.StdEncoding.EncodeToString(sum)
+		return checksum, nil
+	}
+	checksum.Value = h.Get(checksum.headerName())
+	if checksum.Value == "" || strings.Contains(checksum.Value, "-") {
+		return Checksum{}, ErrChecksumNotAvailable
+	}
+	return checksum, nil
+}
+
+// checksumVerifyingReader calculates the checksum of the content while it is
+// read and compares it to the expected one when the underlying reader is drained.
+type checksumVerifyingReader struct {
+	body     io.ReadCloser
+	hash     hash.Hash
+	expected Checksum
+}
+
+func newChecksumVerifyingReader(body io.ReadCloser, expected Checksum) (io.ReadCloser, error) {
+	h, err := newChecksumHash(expected.Algorithm)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &checksumVerifyingReader{body: body, hash: h, expected: expected}, nil
+}
+
+func (r *checksumVerifyingReader) Read(p []byte) (int, error) {
+	n, err := r.body.Read(p)
+	if n > 0 {
+		r.hash.Write(p[:n])
+	}
+	if err == io.EOF {
+		actual := base64.StdEncoding.EncodeToString(r.hash.Sum(nil))
+		if actual != r.expected.Value {
+			return n, &ChecksumMismatchError{
+				Algorithm: r.expected.Algorithm,
+				Expected:  r.expected.Value,
+				Actual:    actual,
+			}
+		}
+	}
+	return n, err
+}
+
+func (r *checksumVerifyingReader) Close() error {
+	return r.body.Close()
+}
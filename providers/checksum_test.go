@@ -0,0 +1,210 @@
+package providers_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bitrise-io/api-utils/providers"
+)
+
+func Test_ComputeChecksum(t *testing.T) {
+	content := []byte("hello world")
+
+	t.Log("ok - MD5")
+	{
+		checksum, err := providers.ComputeChecksum(providers.ChecksumAlgorithmMD5, content)
+		require.NoError(t, err)
+		require.Equal(t, providers.Checksum{Algorithm: providers.ChecksumAlgorithmMD5, Value: "XrY7u+Ae7tCTyyK7j1rNww=="}, checksum)
+	}
+	t.Log("ok - CRC32C")
+	{
+		checksum, err := providers.ComputeChecksum(providers.ChecksumAlgorithmCRC32C, content)
+		require.NoError(t, err)
+		require.Equal(t, providers.Checksum{Algorithm: providers.ChecksumAlgorithmCRC32C, Value: "yZRlqg=="}, checksum)
+	}
+	t.Log("ok - SHA256")
+	{
+		checksum, err := providers.ComputeChecksum(providers.ChecksumAlgorithmSHA256, content)
+		require.NoError(t, err)
+		require.Equal(t, providers.Checksum{Algorithm: providers.ChecksumAlgorithmSHA256, Value: "uU0nuZNNPgilLlLX2n2r+sSE7+N6U4DukIj3rOLvzek="}, checksum)
+	}
+	t.Log("error - unsupported algorithm")
+	{
+		_, err := providers.ComputeChecksum("CRC64", content)
+		require.EqualError(t, err, "Unsupported checksum algorithm: CRC64")
+	}
+}
+
+func Test_AWS_PutObjectWithChecksum(t *testing.T) {
+	server, awsProvider := newS3TestServer()
+	defer server.Close()
+
+	t.Log("ok - SHA256")
+	{
+		checksum, err := awsProvider.PutObjectWithChecksum("artifacts/app.apk", []byte("hello world"), providers.ChecksumAlgorithmSHA256)
+		require.NoError(t, err)
+		require.Equal(t, providers.Checksum{Algorithm: providers.ChecksumAlgorithmSHA256, Value: "uU0nuZNNPgilLlLX2n2r+sSE7+N6U4DukIj3rOLvzek="}, checksum)
+		require.Equal(t, []byte("hello world"), server.objects["artifacts/app.apk"].body)
+		require.Equal(t, checksum.Value, server.objects["artifacts/app.apk"].checksums["X-Amz-Checksum-sha256"])
+	}
+	t.Log("ok - MD5")
+	{
+		checksum, err := awsProvider.PutObjectWithChecksum("artifacts/app.ipa", []byte("hello world"), providers.ChecksumAlgorithmMD5)
+		require.NoError(t, err)
+		require.Equal(t, providers.Checksum{Algorithm: providers.ChecksumAlgorithmMD5, Value: "XrY7u+Ae7tCTyyK7j1rNww=="}, checksum)
+		require.Equal(t, []byte("hello world"), server.objects["artifacts/app.ipa"].body)
+	}
+	t.Log("error - unsupported algorithm")
+	{
+		_, err := awsProvider.PutObjectWithChecksum("artifacts/app.aab", []byte("hello world"), "CRC64")
+		require.EqualError(t, err, "Unsupported checksum algorithm: CRC64")
+		require.NotContains(t, server.objects, "artifacts/app.aab")
+	}
+}
+
+func Test_AWS_GetObjectStream(t *testing.T) {
+	server, awsProvider := newS3TestServer()
+	defer server.Close()
+	checksum, err := awsProvider.PutObjectWithChecksum("artifacts/app.apk", []byte("hello world"), providers.ChecksumAlgorithmCRC32C)
+	require.NoError(t, err)
+
+	t.Log("ok - checksum from the response headers")
+	{
+		body, err := awsProvider.GetObjectStream("artifacts/app.apk", providers.Checksum{Algorithm: providers.ChecksumAlgorithmCRC32C})
+		require.NoError(t, err)
+		content, err := ioutil.ReadAll(body)
+		require.NoError(t, err)
+		require.NoError(t, body.Close())
+		require.Equal(t, []byte("hello world"), content)
+	}
+	t.Log("ok - expected checksum")
+	{
+		body, err := awsProvider.GetObjectStream("artifacts/app.apk", checksum)
+		require.NoError(t, err)
+		content, err := ioutil.ReadAll(body)
+		require.NoError(t, err)
+		require.NoError(t, body.Close())
+		require.Equal(t, []byte("hello world"), content)
+	}
+	t.Log("ok - MD5 from the ETag")
+	{
+		body, err := awsProvider.GetObjectStream("artifacts/app.apk", providers.Checksum{Algorithm: providers.ChecksumAlgorithmMD5})
+		require.NoError(t, err)
+		content, err := ioutil.ReadAll(body)
+		require.NoError(t, err)
+		require.NoError(t, body.Close())
+		require.Equal(t, []byte("hello world"), content)
+	}
+	t.Log("error - content doesn't match the expected checksum")
+	{
+		expected := providers.Checksum{Algorithm: providers.ChecksumAlgorithmCRC32C, Value: "AAAAAA=="}
+		body, err := awsProvider.GetObjectStream("artifacts/app.apk", expected)
+		require.NoError(t, err)
+		_, err = ioutil.ReadAll(body)
+		require.NoError(t, body.Close())
+
+		mismatchErr, ok := err.(*providers.ChecksumMismatchError)
+		require.True(t, ok, "%T", err)
+		require.Equal(t, &providers.ChecksumMismatchError{Algorithm: providers.ChecksumAlgorithmCRC32C, Expected: "AAAAAA==", Actual: checksum.Value}, mismatchErr)
+	}
+	t.Log("error - stored content is corrupted")
+	{
+		server.objects["artifacts/app.apk"].body = []byte("hello w0rld")
+
+		body, err := awsProvider.GetObjectStream("artifacts/app.apk", providers.Checksum{Algorithm: providers.ChecksumAlgorithmCRC32C})
+		require.NoError(t, err)
+		content, err := ioutil.ReadAll(body)
+		require.NoError(t, body.Close())
+		require.Equal(t, []byte("hello w0rld"), content)
+
+		mismatchErr, ok := err.(*providers.ChecksumMismatchError)
+		require.True(t, ok, "%T", err)
+		require.Equal(t, checksum.Value, mismatchErr.Expected)
+	}
+	t.Log("error - no checksum of the algorithm")
+	{
+		_, err := awsProvider.GetObjectStream("artifacts/app.apk", providers.Checksum{Algorithm: providers.ChecksumAlgorithmSHA256})
+		require.Equal(t, providers.ErrChecksumNotAvailable, errors.Cause(err))
+	}
+	t.Log("error - composite checksum of a multipart upload")
+	{
+		server.objects["artifacts/app.apk"].checksums["X-Amz-Checksum-crc32c"] = "Nks/tw==-3"
+
+		_, err := awsProvider.GetObjectStream("artifacts/app.apk", providers.Checksum{Algorithm: providers.ChecksumAlgorithmCRC32C})
+		require.Equal(t, providers.ErrChecksumNotAvailable, errors.Cause(err))
+	}
+	t.Log("error - object doesn't exist")
+	{
+		_, err := awsProvider.GetObjectStream("artifacts/missing.apk", providers.Checksum{Algorithm: providers.ChecksumAlgorithmCRC32C})
+		require.Error(t, err)
+	}
+}
+
+func Test_AWS_GeneratePresignedPUTURLWithChecksum(t *testing.T) {
+	server, awsProvider := newS3TestServer()
+	defer server.Close()
+	content := []byte("hello world")
+
+	t.Log("ok - SHA256 checksum is signed in the query")
+	{
+		checksum, err := providers.ComputeChecksum(providers.ChecksumAlgorithmSHA256, content)
+		require.NoError(t, err)
+		presignedURL, err := awsProvider.GeneratePresignedPUTURLWithChecksum("artifacts/app.apk", time.Minute, int64(len(content)), checksum)
+		require.NoError(t, err)
+
+		parsedURL, err := url.Parse(presignedURL)
+		require.NoError(t, err)
+		require.Equal(t, checksum.Value, parsedURL.Query().Get("X-Amz-Checksum-Sha256"))
+		require.Equal(t, "SHA256", parsedURL.Query().Get("X-Amz-Sdk-Checksum-Algorithm"))
+
+		resp := putPresigned(t, presignedURL, []byte("hello w0rld"), nil)
+		require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		require.NotContains(t, server.objects, "artifacts/app.apk")
+
+		resp = putPresigned(t, presignedURL, content, nil)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, content, server.objects["artifacts/app.apk"].body)
+	}
+	t.Log("ok - MD5 is a signed header which has to be sent by the uploader")
+	{
+		checksum, err := providers.ComputeChecksum(providers.ChecksumAlgorithmMD5, content)
+		require.NoError(t, err)
+		presignedURL, err := awsProvider.GeneratePresignedPUTURLWithChecksum("artifacts/app.ipa", time.Minute, int64(len(content)), checksum)
+		require.NoError(t, err)
+
+		parsedURL, err := url.Parse(presignedURL)
+		require.NoError(t, err)
+		require.Empty(t, parsedURL.Query().Get("Content-Md5"))
+		require.Contains(t, parsedURL.Query().Get("X-Amz-SignedHeaders"), "content-md5")
+
+		resp := putPresigned(t, presignedURL, []byte("hello w0rld"), http.Header{"Content-Md5": {checksum.Value}})
+		require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+		resp = putPresigned(t, presignedURL, content, http.Header{"Content-Md5": {checksum.Value}})
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+	t.Log("error - unsupported algorithm")
+	{
+		_, err := awsProvider.GeneratePresignedPUTURLWithChecksum("artifacts/app.aab", time.Minute, int64(len(content)), providers.Checksum{Algorithm: "CRC64", Value: "AAAA"})
+		require.EqualError(t, err, "Unsupported checksum algorithm: CRC64")
+	}
+}
+
+func putPresigned(t *testing.T, presignedURL string, body []byte, header http.Header) *http.Response {
+	req, err := http.NewRequest(http.MethodPut, presignedURL, bytes.NewReader(body))
+	require.NoError(t, err)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	return resp
+}
@@ -0,0 +1,158 @@
+package providers
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/cloudfront/sign"
+	"github.com/pkg/errors"
+)
+
+// PresignedGETURLGenerator is implemented by both the S3 and the CloudFront
+// provider, so callers can switch between them.
+type PresignedGETURLGenerator interface {
+	GeneratePresignedGETURL(key string, expiresIn time.Duration) (string, error)
+}
+
+// CloudFrontInterface ...
+type CloudFrontInterface interface {
+	PresignedGETURLGenerator
+	GetConfig() CloudFrontConfig
+	GenerateSignedURL(key string, policy CloudFrontPolicy) (string, error)
+	GenerateSignedCookies(keyPattern string, policy CloudFrontPolicy) ([]*http.Cookie, error)
+}
+
+// CloudFrontConfig ...
+type CloudFrontConfig struct {
+	// BaseURL of the distribution, e.g. https://d111111abcdef8.cloudfront.net
+	BaseURL   string
+	KeyPairID string
+	// PrivateKey is the PEM encoded (PKCS #1 or PKCS #8) RSA private key of the key pair
+	PrivateKey string
+	// CookieDomain is optional, it's set as the domain of the signed cookies
+	CookieDomain string
+}
+
+// CloudFrontPolicy holds the conditions of a custom policy. Only ExpiresAt is
+// required, the zero value of the other fields means no restriction.
+type CloudFrontPolicy struct {
+	ExpiresAt time.Time
+	NotBefore time.Time
+	// IPAddress is an IPv4 or IPv6 address or CIDR range, e.g. 192.0.2.0/24
+	IPAddress string
+}
+
+// CloudFront ...
+type CloudFront struct {
+	config     CloudFrontConfig
+	privateKey *rsa.PrivateKey
+}
+
+// NewCloudFront ...
+func NewCloudFront(config CloudFrontConfig) (*CloudFront, error) {
+	if config.BaseURL == "" {
+		return nil, errors.New("No CloudFront base URL specified")
+	}
+	if config.KeyPairID == "" {
+		return nil, errors.New("No CloudFront key pair ID specified")
+	}
+	privateKey, err := parseRSAPrivateKey(config.PrivateKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to parse private key")
+	}
+	return &CloudFront{
+		config:     config,
+		privateKey: privateKey,
+	}, nil
+}
+
+// GetConfig ...
+func (c *CloudFront) GetConfig() CloudFrontConfig {
+	return c.config
+}
+
+// GeneratePresignedGETURL generates a URL signed with a canned policy
+func (c *CloudFront) GeneratePresignedGETURL(key string, expiresIn time.Duration) (string, error) {
+	return c.GenerateSignedURL(key, CloudFrontPolicy{ExpiresAt: time.Now().Add(expiresIn)})
+}
+
+// GenerateSignedURL generates a URL signed with a canned policy if there is no
+// condition besides the expiration, otherwise with a custom policy
+func (c *CloudFront) GenerateSignedURL(key string, policy CloudFrontPolicy) (string, error) {
+	signer := sign.NewURLSigner(c.config.KeyPairID, c.privateKey)
+	resource := c.resourceURL(key)
+	if policy.NotBefore.IsZero() && policy.IPAddress == "" {
+		signedURL, err := signer.Sign(resource, policy.ExpiresAt)
+		if err != nil {
+			return "", errors.WithStack(err)
+		}
+		return signedURL, nil
+	}
+
+	signedURL, err := signer.SignWithPolicy(resource, policy.signPolicy(resource))
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	return signedURL, nil
+}
+
+// GenerateSignedCookies generates the cookies granting access to every object matching
+// the key pattern, e.g. "builds/build-slug/*". Custom policy is used, as the canned
+// one doesn't support wildcards.
+func (c *CloudFront) GenerateSignedCookies(keyPattern string, policy CloudFrontPolicy) ([]*http.Cookie, error) {
+	signer := sign.NewCookieSigner(c.config.KeyPairID, c.privateKey, func(o *sign.CookieOptions) {
+		o.Path = "/"
+		o.Domain = c.config.CookieDomain
+		o.Secure = strings.HasPrefix(c.config.BaseURL, "https://")
+	})
+	resource := strings.Replace(c.resourceURL(keyPattern), "%2A", "*", -1)
+	cookies, err := signer.SignWithPolicy(policy.signPolicy(resource))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return cookies, nil
+}
+
+func (c *CloudFront) resourceURL(key string) string {
+	path := (&url.URL{Path: "/" + strings.TrimPrefix(key, "/")}).EscapedPath()
+	return strings.TrimSuffix(c.config.BaseURL, "/") + path
+}
+
+func (p CloudFrontPolicy) signPolicy(resource string) *sign.Policy {
+	condition := sign.Condition{
+		DateLessThan: sign.NewAWSEpochTime(p.ExpiresAt),
+	}
+	if !p.NotBefore.IsZero() {
+		condition.DateGreaterThan = sign.NewAWSEpochTime(p.NotBefore)
+	}
+	if p.IPAddress != "" {
+		condition.IPAddress = &sign.IPAddress{SourceIP: p.IPAddress}
+	}
+	return &sign.Policy{
+		Statements: []sign.Statement{{Resource: resource, Condition: condition}},
+	}
+}
+
+func parseRSAPrivateKey(privateKey string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(privateKey))
+	if block == nil {
+		return nil, errors.New("Private key is not PEM encoded")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("Private key is not an RSA key")
+	}
+	return rsaKey, nil
+}
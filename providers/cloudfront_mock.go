@@ -0,0 +1,43 @@
+package providers
+
+import (
+	"net/http"
+	"time"
+)
+
+// CloudFrontMock ...
+type CloudFrontMock struct {
+	Config                    CloudFrontConfig
+	GeneratePresignedGETURLFn func(string, time.Duration) (string, error)
+	GenerateSignedURLFn       func(string, CloudFrontPolicy) (string, error)
+	GenerateSignedCookiesFn   func(string, CloudFrontPolicy) ([]*http.Cookie, error)
+}
+
+// GetConfig ...
+func (m *CloudFrontMock) GetConfig() CloudFrontConfig {
+	return m.Config
+}
+
+// GeneratePresignedGETURL ...
+func (m *CloudFrontMock) GeneratePresignedGETURL(key string, expiresIn time.Duration) (string, error) {
+	if m.GeneratePresignedGETURLFn == nil {
+		panic("You have to override GeneratePresignedGETURL function in tests")
+	}
+	return m.GeneratePresignedGETURLFn(key, expiresIn)
+}
+
+// GenerateSignedURL ...
+func (m *CloudFrontMock) GenerateSignedURL(key string, policy CloudFrontPolicy) (string, error) {
+	if m.GenerateSignedURLFn == nil {
+		panic("You have to override GenerateSignedURL function in tests")
+	}
+	return m.GenerateSignedURLFn(key, policy)
+}
+
+// GenerateSignedCookies ...
+func (m *CloudFrontMock) GenerateSignedCookies(keyPattern string, policy CloudFrontPolicy) ([]*http.Cookie, error) {
+	if m.GenerateSignedCookiesFn == nil {
+		panic("You have to override GenerateSignedCookies function in tests")
+	}
+	return m.GenerateSignedCookiesFn(keyPattern, policy)
+}
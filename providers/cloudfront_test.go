@@ -0,0 +1,95 @@
+package providers_test
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/bitrise-io/api-utils/providers"
+)
+
+func decodeCloudFrontBase64(t *testing.T, s string) []byte {
+	decoded, err := base64.StdEncoding.DecodeString(strings.NewReplacer("-", "+", "_", "=", "~", "/").Replace(s))
+	require.NoError(t, err)
+	return decoded
+}
+
+func Test_CloudFront_GenerateSignedURL(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	privateKeyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)})
+
+	cloudFront, err := providers.NewCloudFront(providers.CloudFrontConfig{
+		BaseURL:    "https://d111111abcdef8.cloudfront.net/",
+		KeyPairID:  "APKAEXAMPLE",
+		PrivateKey: string(privateKeyPEM),
+	})
+	require.NoError(t, err)
+
+	t.Log("ok - canned policy")
+	{
+		expiresAt := time.Unix(1700000000, 0)
+		signedURL, err := cloudFront.GenerateSignedURL("builds/build slug/app.apk", providers.CloudFrontPolicy{ExpiresAt: expiresAt})
+		require.NoError(t, err)
+
+		u, err := url.Parse(signedURL)
+		require.NoError(t, err)
+		require.Equal(t, "https://d111111abcdef8.cloudfront.net/builds/build%20slug/app.apk", strings.Split(signedURL, "?")[0])
+		require.Equal(t, "1700000000", u.Query().Get("Expires"))
+		require.Equal(t, "APKAEXAMPLE", u.Query().Get("Key-Pair-Id"))
+		require.NotEmpty(t, u.Query().Get("Signature"))
+		require.Empty(t, u.Query().Get("Policy"))
+	}
+	t.Log("ok - custom policy with date range and IP condition")
+	{
+		signedURL, err := cloudFront.GenerateSignedURL("builds/app.apk", providers.CloudFrontPolicy{
+			ExpiresAt: time.Unix(1700000000, 0),
+			NotBefore: time.Unix(1600000000, 0),
+			IPAddress: "192.0.2.0/24",
+		})
+		require.NoError(t, err)
+
+		u, err := url.Parse(signedURL)
+		require.NoError(t, err)
+		require.Empty(t, u.Query().Get("Expires"))
+
+		policy := decodeCloudFrontBase64(t, u.Query().Get("Policy"))
+		require.Equal(t, `{"Statement":[{"Resource":"https://d111111abcdef8.cloudfront.net/builds/app.apk","Condition":{"IpAddress":{"AWS:SourceIp":"192.0.2.0/24"},"DateGreaterThan":{"AWS:EpochTime":1600000000},"DateLessThan":{"AWS:EpochTime":1700000000}}}]}`, string(policy))
+
+		hash := sha1.Sum(policy)
+		signature := decodeCloudFrontBase64(t, u.Query().Get("Signature"))
+		require.NoError(t, rsa.VerifyPKCS1v15(&privateKey.PublicKey, crypto.SHA1, hash[:], signature))
+	}
+	t.Log("ok - signed cookies")
+	{
+		cookies, err := cloudFront.GenerateSignedCookies("builds/*", providers.CloudFrontPolicy{ExpiresAt: time.Unix(1700000000, 0)})
+		require.NoError(t, err)
+
+		names := []string{}
+		for _, cookie := range cookies {
+			names = append(names, cookie.Name)
+			require.True(t, cookie.Secure)
+		}
+		require.Equal(t, []string{"CloudFront-Policy", "CloudFront-Signature", "CloudFront-Key-Pair-Id"}, names)
+		require.Contains(t, string(decodeCloudFrontBase64(t, cookies[0].Value)), `"Resource":"https://d111111abcdef8.cloudfront.net/builds/*"`)
+	}
+	t.Log("error - invalid private key")
+	{
+		_, err := providers.NewCloudFront(providers.CloudFrontConfig{
+			BaseURL:    "https://d111111abcdef8.cloudfront.net",
+			KeyPairID:  "APKAEXAMPLE",
+			PrivateKey: "invalid",
+		})
+		require.EqualError(t, err, "Failed to parse private key: Private key is not PEM encoded")
+	}
+}
@@ -0,0 +1,74 @@
+package providers
+
+import (
+	"sort"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+)
+
+// LifecycleRule expires the objects matching the prefix and all of the tags
+// after the given number of days. A rule without prefix and tags is rejected,
+// unless AllObjects is set, as it would expire every object of the bucket.
+type LifecycleRule struct {
+	ID             string
+	Prefix         string
+	Tags           map[string]string
+	AllObjects     bool
+	ExpirationDays int64
+}
+
+func (r LifecycleRule) s3LifecycleRule() (*s3.LifecycleRule, error) {
+	if r.ID == "" {
+		return nil, errors.New("No lifecycle rule ID specified")
+	}
+	if r.ExpirationDays < 1 {
+		return nil, errors.Errorf("Invalid expiration days for lifecycle rule %s: %d", r.ID, r.ExpirationDays)
+	}
+
+	hasFilter := r.Prefix != "" || len(r.Tags) > 0
+	if !hasFilter && !r.AllObjects {
+		return nil, errors.Errorf("No prefix or tags specified for lifecycle rule %s", r.ID)
+	}
+	if hasFilter && r.AllObjects {
+		return nil, errors.Errorf("Lifecycle rule %s has a prefix or tags, but it's for all objects", r.ID)
+	}
+
+	filter := &s3.LifecycleRuleFilter{}
+	tags := s3Tags(r.Tags)
+	switch {
+	case len(tags) == 0:
+		filter.Prefix = aws.String(r.Prefix)
+	case len(tags) == 1 && r.Prefix == "":
+		filter.Tag = tags[0]
+	default:
+		filter.And = &s3.LifecycleRuleAndOperator{Tags: tags}
+		if r.Prefix != "" {
+			filter.And.Prefix = aws.String(r.Prefix)
+		}
+	}
+
+	return &s3.LifecycleRule{
+		ID:         aws.String(r.ID),
+		Status:     aws.String(s3.ExpirationStatusEnabled),
+		Filter:     filter,
+		Expiration: &s3.LifecycleExpiration{Days: aws.Int64(r.ExpirationDays)},
+	}, nil
+}
+
+// s3Tags converts the tags map to an S3 tag set, sorted by key to keep
+// the requests deterministic
+func s3Tags(tags map[string]string) []*s3.Tag {
+	keys := []string{}
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	tagSet := []*s3.Tag{}
+	for _, key := range keys {
+		tagSet = append(tagSet, &s3.Tag{Key: aws.String(key), Value: aws.String(tags[key])})
+	}
+	return tagSet
+}
@@ -0,0 +1,187 @@
+package providers
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bitrise-io/api-utils/logging"
+	"github.com/bitrise-io/api-utils/redis"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultPresignedURLCacheKeyPrefix = "presigned-url"
+	defaultMinRemainingValidityRatio  = 0.5
+	memoryCacheSweepInterval          = 100
+)
+
+// PresignedURLCacheStore ...
+type PresignedURLCacheStore interface {
+	// Get returns an empty string if there is no cached value for the key
+	Get(key string) (string, error)
+	Set(key, value string, ttl time.Duration) error
+}
+
+// PresignedURLCacheConfig ...
+type PresignedURLCacheConfig struct {
+	// MinRemainingValidityRatio is the part of the requested expiration a cached URL
+	// has to be valid for to be returned, defaults to 0.5
+	MinRemainingValidityRatio float64
+	// KeyPrefix of the cache entries, defaults to "presigned-url"
+	KeyPrefix string
+}
+
+// PresignedURLCache is an AWSInterface decorator which caches the presigned GET URLs,
+// all the other calls are passed to the wrapped provider.
+type PresignedURLCache struct {
+	AWSInterface
+	store  PresignedURLCacheStore
+	config PresignedURLCacheConfig
+}
+
+// NewPresignedURLCache ...
+func NewPresignedURLCache(provider AWSInterface, store PresignedURLCacheStore, config PresignedURLCacheConfig) *PresignedURLCache {
+	if config.MinRemainingValidityRatio <= 0 || config.MinRemainingValidityRatio >= 1 {
+		config.MinRemainingValidityRatio = defaultMinRemainingValidityRatio
+	}
+	if config.KeyPrefix == "" {
+		config.KeyPrefix = defaultPresignedURLCacheKeyPrefix
+	}
+	return &PresignedURLCache{
+		AWSInterface: provider,
+		store:        store,
+		config:       config,
+	}
+}
+
+// GeneratePresignedGETURL returns the cached URL of the key if it's still valid for
+// the minimum remaining validity of expiresIn. The URL is shared between the calls with
+// different expirations, so it can be valid for longer than expiresIn. Cache errors are
+// logged and the URL is generated by the wrapped provider.
+func (c *PresignedURLCache) GeneratePresignedGETURL(key string, expiresIn time.Duration) (string, error) {
+	logger := logging.WithContext(nil)
+	cacheKey := c.cacheKey(key)
+	entry, err := c.store.Get(cacheKey)
+	if err != nil {
+		logger.Warn("Failed to get presigned URL from cache", zap.String("key", cacheKey), zap.Error(err))
+	}
+	minValidity := time.Duration(float64(expiresIn) * c.config.MinRemainingValidityRatio)
+	if cachedURL, expiresAt, ok := parseCacheEntry(entry); ok && time.Until(expiresAt) >= minValidity {
+		return cachedURL, nil
+	}
+
+	generatedAt := time.Now()
+	presignedURL, err := c.AWSInterface.GeneratePresignedGETURL(key, expiresIn)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	// not cached if it could be returned for less than a second
+	if expiresIn-minValidity >= time.Second {
+		entry := strconv.FormatInt(generatedAt.Add(expiresIn).Unix(), 10) + " " + presignedURL
+		if err := c.store.Set(cacheKey, entry, expiresIn); err != nil {
+			logger.Warn("Failed to store presigned URL in cache", zap.String("key", cacheKey), zap.Error(err))
+		}
+	}
+	return presignedURL, nil
+}
+
+func (c *PresignedURLCache) cacheKey(key string) string {
+	return fmt.Sprintf("%s:%s:%s", c.config.KeyPrefix, c.GetConfig().Bucket, key)
+}
+
+// parseCacheEntry splits the entry into the URL and its expiry, stored in unix seconds
+func parseCacheEntry(entry string) (string, time.Time, bool) {
+	parts := strings.SplitN(entry, " ", 2)
+	if len(parts) != 2 {
+		return "", time.Time{}, false
+	}
+	expiresAt, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return "", time.Time{}, false
+	}
+	return parts[1], time.Unix(expiresAt, 0), true
+}
+
+type memoryCacheEntry struct {
+	value     string
+	expiresAt time.Time
+}
+
+// MemoryPresignedURLCacheStore is an in-process PresignedURLCacheStore
+type MemoryPresignedURLCacheStore struct {
+	mu      sync.Mutex
+	entries map[string]memoryCacheEntry
+	sets    int
+}
+
+// NewMemoryPresignedURLCacheStore ...
+func NewMemoryPresignedURLCacheStore() *MemoryPresignedURLCacheStore {
+	return &MemoryPresignedURLCacheStore{entries: map[string]memoryCacheEntry{}}
+}
+
+// Get ...
+func (s *MemoryPresignedURLCacheStore) Get(key string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.entries[key]
+	if !ok {
+		return "", nil
+	}
+	if time.Now().After(entry.expiresAt) {
+		delete(s.entries, key)
+		return "", nil
+	}
+	return entry.value, nil
+}
+
+// Set ...
+func (s *MemoryPresignedURLCacheStore) Set(key, value string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	s.entries[key] = memoryCacheEntry{value: value, expiresAt: now.Add(ttl)}
+	s.sets++
+	if s.sets%memoryCacheSweepInterval == 0 {
+		for k, entry := range s.entries {
+			if now.After(entry.expiresAt) {
+				delete(s.entries, k)
+			}
+		}
+	}
+	return nil
+}
+
+// RedisPresignedURLCacheStore is a PresignedURLCacheStore backed by redis,
+// so the cached URLs are shared between the instances of the service
+type RedisPresignedURLCacheStore struct {
+	client redis.Interface
+}
+
+// NewRedisPresignedURLCacheStore ...
+func NewRedisPresignedURLCacheStore(client redis.Interface) *RedisPresignedURLCacheStore {
+	return &RedisPresignedURLCacheStore{client: client}
+}
+
+// Get ...
+func (s *RedisPresignedURLCacheStore) Get(key string) (string, error) {
+	value, err := s.client.GetString(key)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	return value, nil
+}
+
+// Set ...
+func (s *RedisPresignedURLCacheStore) Set(key, value string, ttl time.Duration) error {
+	if err := s.client.Set(key, value, int(ttl/time.Second)); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
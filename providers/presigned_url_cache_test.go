@@ -0,0 +1,120 @@
+package providers_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/bitrise-io/api-utils/providers"
+	"github.com/bitrise-io/api-utils/redis"
+)
+
+func Test_PresignedURLCache_GeneratePresignedGETURL(t *testing.T) {
+	newProvider := func(calls *int) *providers.AWSMock {
+		return &providers.AWSMock{
+			Config: providers.AWSConfig{Bucket: "test-bucket"},
+			GeneratePresignedGETURLFn: func(key string, expiresIn time.Duration) (string, error) {
+				*calls++
+				return fmt.Sprintf("https://test-bucket.s3.amazonaws.com/%s?X-Amz-Expires=%d&call=%d", key, int(expiresIn.Seconds()), *calls), nil
+			},
+		}
+	}
+
+	t.Log("ok - memory store, cached by key while it's valid long enough")
+	{
+		calls := 0
+		cache := providers.NewPresignedURLCache(newProvider(&calls), providers.NewMemoryPresignedURLCacheStore(), providers.PresignedURLCacheConfig{})
+
+		url1, err := cache.GeneratePresignedGETURL("artifacts/app.apk", time.Hour)
+		require.NoError(t, err)
+		url2, err := cache.GeneratePresignedGETURL("artifacts/app.apk", time.Hour)
+		require.NoError(t, err)
+		require.Equal(t, url1, url2)
+		require.Equal(t, 1, calls)
+
+		url3, err := cache.GeneratePresignedGETURL("artifacts/app.apk", 30*time.Minute)
+		require.NoError(t, err)
+		require.Equal(t, url1, url3)
+		require.Equal(t, 1, calls)
+
+		url4, err := cache.GeneratePresignedGETURL("artifacts/app.apk", 4*time.Hour)
+		require.NoError(t, err)
+		require.Equal(t, "https://test-bucket.s3.amazonaws.com/artifacts/app.apk?X-Amz-Expires=14400&call=2", url4)
+		url5, err := cache.GeneratePresignedGETURL("artifacts/app.apk", time.Hour)
+		require.NoError(t, err)
+		require.Equal(t, url4, url5)
+
+		_, err = cache.GeneratePresignedGETURL("artifacts/app.ipa", time.Hour)
+		require.NoError(t, err)
+		require.Equal(t, 3, calls)
+	}
+	t.Log("ok - not cached when the expiration is too short")
+	{
+		calls := 0
+		cache := providers.NewPresignedURLCache(newProvider(&calls), providers.NewMemoryPresignedURLCacheStore(), providers.PresignedURLCacheConfig{})
+
+		for i := 0; i < 2; i++ {
+			_, err := cache.GeneratePresignedGETURL("artifacts/app.apk", time.Second)
+			require.NoError(t, err)
+		}
+		require.Equal(t, 2, calls)
+	}
+	t.Log("ok - redis store")
+	{
+		calls := 0
+		stored := map[string]interface{}{}
+		redisClient := &redis.ClientMock{
+			GetStringFn: func(key string) (string, error) {
+				value, _ := stored[key].(string)
+				return value, nil
+			},
+			SetFn: func(key string, value interface{}, ttl int) error {
+				require.Equal(t, "presigned-url:test-bucket:artifacts/app.apk", key)
+				require.Equal(t, 3600, ttl)
+				stored[key] = value
+				return nil
+			},
+		}
+		cache := providers.NewPresignedURLCache(newProvider(&calls), providers.NewRedisPresignedURLCacheStore(redisClient), providers.PresignedURLCacheConfig{})
+
+		url1, err := cache.GeneratePresignedGETURL("artifacts/app.apk", time.Hour)
+		require.NoError(t, err)
+		url2, err := cache.GeneratePresignedGETURL("artifacts/app.apk", time.Hour)
+		require.NoError(t, err)
+		require.Equal(t, url1, url2)
+		require.Equal(t, 1, calls)
+	}
+	t.Log("ok - expired or invalid entries aren't returned")
+	{
+		calls := 0
+		store := providers.NewMemoryPresignedURLCacheStore()
+		cache := providers.NewPresignedURLCache(newProvider(&calls), store, providers.PresignedURLCacheConfig{})
+
+		expiresAt := time.Now().Add(10 * time.Minute).Unix()
+		require.NoError(t, store.Set("presigned-url:test-bucket:artifacts/app.apk", fmt.Sprintf("%d https://expiring", expiresAt), time.Hour))
+		require.NoError(t, store.Set("presigned-url:test-bucket:artifacts/app.ipa", "https://without-expiry", time.Hour))
+
+		presignedURL, err := cache.GeneratePresignedGETURL("artifacts/app.apk", time.Hour)
+		require.NoError(t, err)
+		require.Equal(t, "https://test-bucket.s3.amazonaws.com/artifacts/app.apk?X-Amz-Expires=3600&call=1", presignedURL)
+		presignedURL, err = cache.GeneratePresignedGETURL("artifacts/app.ipa", time.Hour)
+		require.NoError(t, err)
+		require.Equal(t, "https://test-bucket.s3.amazonaws.com/artifacts/app.ipa?X-Amz-Expires=3600&call=2", presignedURL)
+	}
+	t.Log("ok - cache errors fall back to the provider")
+	{
+		calls := 0
+		redisClient := &redis.ClientMock{
+			GetStringFn: func(key string) (string, error) { return "", errors.New("connection refused") },
+			SetFn:       func(key string, value interface{}, ttl int) error { return errors.New("connection refused") },
+		}
+		cache := providers.NewPresignedURLCache(newProvider(&calls), providers.NewRedisPresignedURLCacheStore(redisClient), providers.PresignedURLCacheConfig{})
+
+		presignedURL, err := cache.GeneratePresignedGETURL("artifacts/app.apk", time.Hour)
+		require.NoError(t, err)
+		require.Equal(t, "https://test-bucket.s3.amazonaws.com/artifacts/app.apk?X-Amz-Expires=3600&call=1", presignedURL)
+	}
+}
@@ -0,0 +1,81 @@
+package providers
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/rds/rdsutils"
+	"github.com/pkg/errors"
+)
+
+const (
+	// the tokens are valid for 15 minutes
+	rdsAuthTokenLifetime       = 15 * time.Minute
+	defaultRDSAuthTokenRefresh = 5 * time.Minute
+)
+
+// RDSAuthTokenProvider generates IAM authentication tokens of RDS, it can be used as the
+// database.PasswordProvider of the connection. The credentials of the AWSConfig are used
+// if they are set, the default credential chain (e.g. the instance's role) otherwise.
+// The tokens are only accepted over TLS, so the connection can't use sslmode=disable.
+type RDSAuthTokenProvider struct {
+	// Endpoint of the database, host:port
+	Endpoint string
+	User     string
+	// RefreshBefore is how long before the expiry a new token is generated, defaults to 5 minutes
+	RefreshBefore time.Duration
+
+	config      AWSConfig
+	credentials *credentials.Credentials
+
+	mu        sync.Mutex
+	token     string
+	expiresAt time.Time
+}
+
+// NewRDSAuthTokenProvider ...
+func NewRDSAuthTokenProvider(config AWSConfig, endpoint, user string) (*RDSAuthTokenProvider, error) {
+	var creds *credentials.Credentials
+	if config.AccessKeyID != "" {
+		creds = credentials.NewStaticCredentials(config.AccessKeyID, config.SecretAccessKey, "")
+	} else {
+		sess, err := session.NewSession(&aws.Config{Region: aws.String(config.Region)})
+		if err != nil {
+			return nil, errors.Wrap(err, "Session creation failed")
+		}
+		creds = sess.Config.Credentials
+	}
+	return &RDSAuthTokenProvider{
+		Endpoint:      endpoint,
+		User:          user,
+		RefreshBefore: defaultRDSAuthTokenRefresh,
+		config:        config,
+		credentials:   creds,
+	}, nil
+}
+
+// Password returns the current token, and generates a new one if it expires within RefreshBefore
+func (p *RDSAuthTokenProvider) Password(ctx context.Context) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.token != "" && time.Until(p.expiresAt) > p.RefreshBefore {
+		return p.token, nil
+	}
+
+	generatedAt := time.Now()
+	token, err := rdsutils.BuildAuthToken(p.Endpoint, p.config.Region, p.User, p.credentials)
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to generate RDS auth token")
+	}
+	p.token, p.expiresAt = token, generatedAt.Add(rdsAuthTokenLifetime)
+	return token, nil
+}
+
+// RequiresTLS ...
+func (p *RDSAuthTokenProvider) RequiresTLS() bool {
+	return true
+}
@@ -0,0 +1,53 @@
+package providers_test
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/bitrise-io/api-utils/database"
+	"github.com/bitrise-io/api-utils/providers"
+)
+
+func Test_RDSAuthTokenProvider(t *testing.T) {
+	provider, err := providers.NewRDSAuthTokenProvider(providers.AWSConfig{
+		Region:          "us-east-1",
+		AccessKeyID:     "AKIDEXAMPLE",
+		SecretAccessKey: "secret",
+	}, "db.example.com:5432", "api")
+	require.NoError(t, err)
+
+	t.Log("ok - token signed for the user")
+	{
+		token, err := provider.Password(context.Background())
+		require.NoError(t, err)
+		require.True(t, strings.HasPrefix(token, "db.example.com:5432?"))
+
+		query, err := url.ParseQuery(strings.SplitN(token, "?", 2)[1])
+		require.NoError(t, err)
+		require.Equal(t, "connect", query.Get("Action"))
+		require.Equal(t, "api", query.Get("DBUser"))
+		require.Equal(t, "900", query.Get("X-Amz-Expires"))
+		require.True(t, strings.HasPrefix(query.Get("X-Amz-Credential"), "AKIDEXAMPLE/"))
+		require.NotEmpty(t, query.Get("X-Amz-Signature"))
+	}
+	t.Log("ok - token is reused until the refresh")
+	{
+		first, err := provider.Password(context.Background())
+		require.NoError(t, err)
+		second, err := provider.Password(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, first, second)
+	}
+	t.Log("error - connection without TLS")
+	{
+		_, err := database.NewConnection(database.PostgresDatabase{
+			Host: "db.example.com", Port: 5432, User: "api", DBName: "app", SSLMode: "disable",
+			PasswordProvider: provider,
+		}, true)
+		require.EqualError(t, err, "Database password provider requires TLS, sslmode=disable isn't supported")
+	}
+}
@@ -0,0 +1,248 @@
+package providers_test
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/bitrise-io/api-utils/providers"
+)
+
+const testBucket = "test-bucket"
+
+type s3TestObject struct {
+	body        []byte
+	contentType string
+	metadata    map[string]string
+	tags        []s3TestTag
+	checksums   map[string]string
+}
+
+type s3TestTag struct {
+	Key   string `xml:"Key"`
+	Value string `xml:"Value"`
+}
+
+type s3TestTagging struct {
+	XMLName xml.Name    `xml:"Tagging"`
+	TagSet  []s3TestTag `xml:"TagSet>Tag"`
+}
+
+// s3TestServer is a minimal, in-memory S3 compatible server. It supports path style
+// object, tagging, copy and lifecycle requests and doesn't verify the signatures.
+type s3TestServer struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	objects   map[string]*s3TestObject
+	lifecycle []byte
+}
+
+func newS3TestServer() (*s3TestServer, *providers.AWS) {
+	s := &s3TestServer{objects: map[string]*s3TestObject{}}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+
+	return s, &providers.AWS{Config: providers.AWSConfig{
+		Region:          "us-east-1",
+		AccessKeyID:     "test-access-key-id",
+		SecretAccessKey: "test-secret-access-key",
+		Bucket:          testBucket,
+		Endpoint:        s.URL,
+	}}
+}
+
+func (s *s3TestServer) handle(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	path := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if path[0] != testBucket {
+		s.respondWithError(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	query := r.URL.Query()
+	if len(path) == 1 || path[1] == "" {
+		if _, ok := query["lifecycle"]; ok {
+			s.handleLifecycle(w, r)
+			return
+		}
+		s.respondWithError(w, http.StatusNotImplemented, "NotImplemented")
+		return
+	}
+
+	key := path[1]
+	if _, ok := query["tagging"]; ok {
+		s.handleTagging(w, r, key)
+		return
+	}
+	switch r.Method {
+	case http.MethodPut:
+		if r.Header.Get("X-Amz-Copy-Source") != "" {
+			s.copyObject(w, r, key)
+			return
+		}
+		s.putObject(w, r, key)
+	case http.MethodGet, http.MethodHead:
+		s.getObject(w, r, key)
+	case http.MethodDelete:
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		s.respondWithError(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+func (s *s3TestServer) putObject(w http.ResponseWriter, r *http.Request, key string) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		s.respondWithError(w, http.StatusBadRequest, "IncompleteBody")
+		return
+	}
+	object := &s3TestObject{
+		body:        body,
+		contentType: r.Header.Get("Content-Type"),
+		metadata:    metadataFromHeaders(r.Header),
+		checksums:   map[string]string{},
+	}
+	for _, algorithm := range []providers.ChecksumAlgorithm{providers.ChecksumAlgorithmCRC32C, providers.ChecksumAlgorithmSHA256} {
+		header := "X-Amz-Checksum-" + strings.ToLower(string(algorithm))
+		expected := r.Header.Get(header)
+		if expected == "" {
+			// the presigned URLs have the unsigned x-amz headers in the query
+			expected = r.URL.Query().Get(http.CanonicalHeaderKey(header))
+		}
+		if expected == "" {
+			continue
+		}
+		checksum, err := providers.ComputeChecksum(algorithm, body)
+		if err != nil || checksum.Value != expected {
+			s.respondWithError(w, http.StatusBadRequest, "BadDigest")
+			return
+		}
+		object.checksums[header] = expected
+	}
+	if expected := r.Header.Get("Content-MD5"); expected != "" {
+		sum := md5.Sum(body)
+		if base64.StdEncoding.EncodeToString(sum[:]) != expected {
+			s.respondWithError(w, http.StatusBadRequest, "BadDigest")
+			return
+		}
+	}
+	if tagging := r.Header.Get("X-Amz-Tagging"); tagging != "" {
+		values, _ := url.ParseQuery(tagging)
+		for k := range values {
+			object.tags = append(object.tags, s3TestTag{Key: k, Value: values.Get(k)})
+		}
+	}
+	s.objects[key] = object
+	w.Header().Set("ETag", object.etag())
+}
+
+func (s *s3TestServer) copyObject(w http.ResponseWriter, r *http.Request, key string) {
+	source, err := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+	if err != nil {
+		s.respondWithError(w, http.StatusBadRequest, "InvalidArgument")
+		return
+	}
+	sourceObject, ok := s.objects[strings.TrimPrefix(strings.TrimPrefix(source, "/"), testBucket+"/")]
+	if !ok {
+		s.respondWithError(w, http.StatusNotFound, "NoSuchKey")
+		return
+	}
+	object := *sourceObject
+	if r.Header.Get("X-Amz-Metadata-Directive") == "REPLACE" {
+		object.contentType = r.Header.Get("Content-Type")
+		object.metadata = metadataFromHeaders(r.Header)
+	}
+	s.objects[key] = &object
+	fmt.Fprintf(w, `<CopyObjectResult><ETag>%s</ETag></CopyObjectResult>`, object.etag())
+}
+
+func (s *s3TestServer) getObject(w http.ResponseWriter, r *http.Request, key string) {
+	object, ok := s.objects[key]
+	if !ok {
+		s.respondWithError(w, http.StatusNotFound, "NoSuchKey")
+		return
+	}
+	w.Header().Set("ETag", object.etag())
+	w.Header().Set("Content-Type", object.contentType)
+	for k, v := range object.metadata {
+		w.Header().Set("X-Amz-Meta-"+k, v)
+	}
+	if r.Header.Get("X-Amz-Checksum-Mode") == "ENABLED" {
+		for k, v := range object.checksums {
+			w.Header().Set(k, v)
+		}
+	}
+	if r.Method == http.MethodGet {
+		w.Write(object.body)
+	}
+}
+
+func (s *s3TestServer) handleTagging(w http.ResponseWriter, r *http.Request, key string) {
+	object, ok := s.objects[key]
+	if !ok {
+		s.respondWithError(w, http.StatusNotFound, "NoSuchKey")
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		body, _ := xml.Marshal(s3TestTagging{TagSet: object.tags})
+		w.Write(body)
+	case http.MethodPut:
+		tagging := s3TestTagging{}
+		if err := xml.NewDecoder(r.Body).Decode(&tagging); err != nil {
+			s.respondWithError(w, http.StatusBadRequest, "MalformedXML")
+			return
+		}
+		object.tags = tagging.TagSet
+	case http.MethodDelete:
+		object.tags = nil
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (s *s3TestServer) handleLifecycle(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		if s.lifecycle == nil {
+			s.respondWithError(w, http.StatusNotFound, "NoSuchLifecycleConfiguration")
+			return
+		}
+		w.Write(s.lifecycle)
+	case http.MethodPut:
+		if r.Header.Get("Content-MD5") == "" {
+			s.respondWithError(w, http.StatusBadRequest, "InvalidRequest")
+			return
+		}
+		s.lifecycle, _ = ioutil.ReadAll(r.Body)
+	}
+}
+
+func (s *s3TestServer) respondWithError(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `<Error><Code>%s</Code><Message>%s</Message></Error>`, code, code)
+}
+
+func (o *s3TestObject) etag() string {
+	sum := md5.Sum(o.body)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func metadataFromHeaders(h http.Header) map[string]string {
+	metadata := map[string]string{}
+	for k := range h {
+		if strings.HasPrefix(k, "X-Amz-Meta-") {
+			metadata[strings.TrimPrefix(k, "X-Amz-Meta-")] = h.Get(k)
+		}
+	}
+	return metadata
+}
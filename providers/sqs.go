@@ -0,0 +1,183 @@
+package providers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/pkg/errors"
+)
+
+const sqsMaxBatchSize = 10
+
+// SQSInterface ...
+type SQSInterface interface {
+	GetConfig() AWSConfig
+	SendMessages(ctx context.Context, messages []SQSMessage) error
+}
+
+// SQSMessage ...
+type SQSMessage struct {
+	Body       string
+	Attributes map[string]string
+	// GroupID and DeduplicationID are used with FIFO queues only. DeduplicationID can
+	// be omitted if content based deduplication is enabled on the queue.
+	GroupID         string
+	DeduplicationID string
+	DelaySeconds    int64
+}
+
+// SQSReceivedMessage ...
+type SQSReceivedMessage struct {
+	ID            string
+	Body          string
+	Attributes    map[string]string
+	GroupID       string
+	ReceiveCount  int
+	receiptHandle string
+}
+
+// SQSBatchSendError is returned when some of the messages couldn't be sent,
+// Failed holds the reason by the index of the message. The messages which
+// aren't in Failed were sent, they shouldn't be sent again.
+type SQSBatchSendError struct {
+	Failed map[int]string
+}
+
+func (e *SQSBatchSendError) Error() string {
+	indexes := []int{}
+	for index := range e.Failed {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+
+	failures := []string{}
+	for _, index := range indexes {
+		failures = append(failures, fmt.Sprintf("#%d: %s", index, e.Failed[index]))
+	}
+	return fmt.Sprintf("Failed to send %d message(s): %s", len(e.Failed), strings.Join(failures, ", "))
+}
+
+// SQS ...
+type SQS struct {
+	Config   AWSConfig
+	QueueURL string
+}
+
+// GetConfig ...
+func (p *SQS) GetConfig() AWSConfig {
+	return p.Config
+}
+
+func (p *SQS) createSQSClient() (*sqs.SQS, error) {
+	sess, err := p.Config.newSession()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return sqs.New(sess), nil
+}
+
+// SendMessages sends the messages in batches of 10. If some of the messages
+// couldn't be sent a *SQSBatchSendError is returned, even if a later batch failed
+// as a whole. The messages of a FIFO group aren't sent in the later batches after
+// one of them failed, to keep their order.
+func (p *SQS) SendMessages(ctx context.Context, messages []SQSMessage) error {
+	svc, err := p.createSQSClient()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	batchErr := &SQSBatchSendError{Failed: map[int]string{}}
+	failedGroups := map[string]bool{}
+	next := 0
+	for next < len(messages) {
+		entries := []*sqs.SendMessageBatchRequestEntry{}
+		for ; next < len(messages) && len(entries) < sqsMaxBatchSize; next++ {
+			message := messages[next]
+			if message.GroupID != "" && failedGroups[message.GroupID] {
+				batchErr.Failed[next] = fmt.Sprintf("Skipped: a previous message of group %s failed", message.GroupID)
+				continue
+			}
+			entries = append(entries, message.batchRequestEntry(next))
+		}
+		if len(entries) == 0 {
+			continue
+		}
+
+		out, err := svc.SendMessageBatchWithContext(ctx, &sqs.SendMessageBatchInput{
+			QueueUrl: aws.String(p.QueueURL),
+			Entries:  entries,
+		})
+		if err != nil {
+			// the messages of this and the remaining batches weren't sent
+			for _, entry := range entries {
+				index, _ := strconv.Atoi(aws.StringValue(entry.Id))
+				batchErr.Failed[index] = err.Error()
+			}
+			for ; next < len(messages); next++ {
+				batchErr.Failed[next] = "Not sent: a previous batch failed"
+			}
+			return batchErr
+		}
+		for _, failed := range out.Failed {
+			index, err := strconv.Atoi(aws.StringValue(failed.Id))
+			if err != nil || index < 0 || index >= len(messages) {
+				return errors.Errorf("Invalid batch entry ID: %s", aws.StringValue(failed.Id))
+			}
+			batchErr.Failed[index] = fmt.Sprintf("%s: %s", aws.StringValue(failed.Code), aws.StringValue(failed.Message))
+			if groupID := messages[index].GroupID; groupID != "" {
+				failedGroups[groupID] = true
+			}
+		}
+	}
+
+	if len(batchErr.Failed) > 0 {
+		return batchErr
+	}
+	return nil
+}
+
+func (m SQSMessage) batchRequestEntry(index int) *sqs.SendMessageBatchRequestEntry {
+	entry := &sqs.SendMessageBatchRequestEntry{
+		Id:          aws.String(strconv.Itoa(index)),
+		MessageBody: aws.String(m.Body),
+	}
+	if m.DelaySeconds > 0 {
+		entry.DelaySeconds = aws.Int64(m.DelaySeconds)
+	}
+	if m.GroupID != "" {
+		entry.MessageGroupId = aws.String(m.GroupID)
+	}
+	if m.DeduplicationID != "" {
+		entry.MessageDeduplicationId = aws.String(m.DeduplicationID)
+	}
+	if len(m.Attributes) > 0 {
+		entry.MessageAttributes = map[string]*sqs.MessageAttributeValue{}
+		for name, value := range m.Attributes {
+			entry.MessageAttributes[name] = &sqs.MessageAttributeValue{
+				DataType:    aws.String("String"),
+				StringValue: aws.String(value),
+			}
+		}
+	}
+	return entry
+}
+
+func newSQSReceivedMessage(message *sqs.Message) SQSReceivedMessage {
+	receivedMessage := SQSReceivedMessage{
+		ID:            aws.StringValue(message.MessageId),
+		Body:          aws.StringValue(message.Body),
+		Attributes:    map[string]string{},
+		GroupID:       aws.StringValue(message.Attributes[sqs.MessageSystemAttributeNameMessageGroupId]),
+		receiptHandle: aws.StringValue(message.ReceiptHandle),
+	}
+	receivedMessage.ReceiveCount, _ = strconv.Atoi(aws.StringValue(message.Attributes[sqs.MessageSystemAttributeNameApproximateReceiveCount]))
+	for name, value := range message.MessageAttributes {
+		receivedMessage.Attributes[name] = aws.StringValue(value.StringValue)
+	}
+	return receivedMessage
+}
@@ -0,0 +1,317 @@
+package providers
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/bitrise-io/api-utils/logging"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultSQSWaitTime          = 20 * time.Second
+	sqsMaxWaitTime              = 20 * time.Second
+	defaultSQSVisibilityTimeout = 30 * time.Second
+	sqsDeleteFlushInterval      = time.Second
+	sqsReceiveErrorBackoff      = time.Second
+	sqsDeleteTimeout            = 10 * time.Second
+)
+
+// SQSHandler processes a received message. The message is deleted from
+// the queue if it returns nil, otherwise it becomes visible again once
+// its visibility timeout expires.
+type SQSHandler func(ctx context.Context, message SQSReceivedMessage) error
+
+// SQSConsumerConfig ...
+type SQSConsumerConfig struct {
+	// Concurrency is the number of messages handled in parallel, defaults to 1
+	Concurrency int
+	// WaitTime of the long polling, defaults to 20 seconds which is the maximum of SQS
+	WaitTime time.Duration
+	// VisibilityTimeout of the received messages, defaults to 30 seconds. It's
+	// extended periodically while the handler is running. SQS accepts whole seconds
+	// only, so it's rounded up.
+	VisibilityTimeout time.Duration
+}
+
+// SQSConsumer long polls the queue and passes the received messages to the handler.
+// The messages of a FIFO group received in the same batch are handled one after the
+// other, and the ones after a failed message are left in the queue to keep their order.
+type SQSConsumer struct {
+	provider *SQS
+	handler  SQSHandler
+	config   SQSConsumerConfig
+
+	stopOnce sync.Once
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// NewSQSConsumer ...
+func NewSQSConsumer(provider *SQS, handler SQSHandler, config SQSConsumerConfig) *SQSConsumer {
+	if config.Concurrency < 1 {
+		config.Concurrency = 1
+	}
+	if config.WaitTime == 0 {
+		config.WaitTime = defaultSQSWaitTime
+	}
+	if config.WaitTime > sqsMaxWaitTime {
+		config.WaitTime = sqsMaxWaitTime
+	}
+	if config.VisibilityTimeout <= 0 {
+		config.VisibilityTimeout = defaultSQSVisibilityTimeout
+	}
+	if remainder := config.VisibilityTimeout % time.Second; remainder != 0 {
+		config.VisibilityTimeout += time.Second - remainder
+	}
+	return &SQSConsumer{
+		provider: provider,
+		handler:  handler,
+		config:   config,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// Run receives and handles messages until Shutdown is called or the context is
+// cancelled. The context is passed to the handlers as well. It returns nil after
+// Shutdown and the context's error after cancellation.
+func (c *SQSConsumer) Run(ctx context.Context) error {
+	defer close(c.done)
+
+	svc, err := c.provider.createSQSClient()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	receiveCtx, cancelReceive := context.WithCancel(ctx)
+	defer cancelReceive()
+	go func() {
+		select {
+		case <-c.stop:
+			cancelReceive()
+		case <-receiveCtx.Done():
+		}
+	}()
+
+	deletes := make(chan string)
+	deleterDone := make(chan struct{})
+	go func() {
+		defer close(deleterDone)
+		c.deleteMessages(svc, deletes)
+	}()
+
+	handlers := sync.WaitGroup{}
+	slots := make(chan struct{}, c.config.Concurrency)
+	for receiveCtx.Err() == nil {
+		// wait for at least one free slot, then take every other free one up to the batch size
+		select {
+		case slots <- struct{}{}:
+		case <-receiveCtx.Done():
+			continue
+		}
+		acquired := 1
+	acquire:
+		for acquired < sqsMaxBatchSize {
+			select {
+			case slots <- struct{}{}:
+				acquired++
+			default:
+				break acquire
+			}
+		}
+
+		messages, err := c.receiveMessages(receiveCtx, svc, acquired)
+		for i := len(messages); i < acquired; i++ {
+			<-slots
+		}
+		if err != nil {
+			if receiveCtx.Err() == nil {
+				logging.WithContext(ctx).Error("Failed to receive SQS messages", zap.Error(err))
+				c.sleep(receiveCtx, sqsReceiveErrorBackoff)
+			}
+			continue
+		}
+
+		for _, group := range groupMessages(messages) {
+			handlers.Add(1)
+			go func(group []*sqs.Message) {
+				defer handlers.Done()
+				for i, message := range group {
+					if !c.handleMessage(ctx, svc, message) {
+						for range group[i:] {
+							<-slots
+						}
+						return
+					}
+					deletes <- aws.StringValue(message.ReceiptHandle)
+					<-slots
+				}
+			}(group)
+		}
+	}
+
+	handlers.Wait()
+	close(deletes)
+	<-deleterDone
+	return ctx.Err()
+}
+
+// Shutdown stops receiving new messages and waits for the running handlers to
+// finish and the handled messages to be deleted, or for the context to be done.
+func (c *SQSConsumer) Shutdown(ctx context.Context) error {
+	c.stopOnce.Do(func() { close(c.stop) })
+	select {
+	case <-c.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// groupMessages splits the messages by their FIFO group, keeping their order. The
+// messages without a group, received from a standard queue, are in a group of their own.
+func groupMessages(messages []*sqs.Message) [][]*sqs.Message {
+	groups := [][]*sqs.Message{}
+	groupIndex := map[string]int{}
+	for _, message := range messages {
+		groupID := aws.StringValue(message.Attributes[sqs.MessageSystemAttributeNameMessageGroupId])
+		if i, ok := groupIndex[groupID]; ok && groupID != "" {
+			groups[i] = append(groups[i], message)
+			continue
+		}
+		groupIndex[groupID] = len(groups)
+		groups = append(groups, []*sqs.Message{message})
+	}
+	return groups
+}
+
+func (c *SQSConsumer) receiveMessages(ctx context.Context, svc *sqs.SQS, maxMessages int) ([]*sqs.Message, error) {
+	out, err := svc.ReceiveMessageWithContext(ctx, &sqs.ReceiveMessageInput{
+		QueueUrl:              aws.String(c.provider.QueueURL),
+		MaxNumberOfMessages:   aws.Int64(int64(maxMessages)),
+		WaitTimeSeconds:       aws.Int64(int64(c.config.WaitTime / time.Second)),
+		VisibilityTimeout:     aws.Int64(int64(c.config.VisibilityTimeout / time.Second)),
+		AttributeNames:        aws.StringSlice([]string{sqs.QueueAttributeNameAll}),
+		MessageAttributeNames: aws.StringSlice([]string{"All"}),
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return out.Messages, nil
+}
+
+// handleMessage runs the handler while extending the visibility timeout of the
+// message, and reports whether the message can be deleted
+func (c *SQSConsumer) handleMessage(ctx context.Context, svc *sqs.SQS, message *sqs.Message) bool {
+	logger := logging.WithContext(ctx).With(zap.String("sqs_message_id", aws.StringValue(message.MessageId)))
+
+	handlerDone := make(chan struct{})
+	extenderDone := make(chan struct{})
+	go func() {
+		defer close(extenderDone)
+		ticker := time.NewTicker(c.config.VisibilityTimeout / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				_, err := svc.ChangeMessageVisibilityWithContext(ctx, &sqs.ChangeMessageVisibilityInput{
+					QueueUrl:          aws.String(c.provider.QueueURL),
+					ReceiptHandle:     message.ReceiptHandle,
+					VisibilityTimeout: aws.Int64(int64(c.config.VisibilityTimeout / time.Second)),
+				})
+				if err != nil {
+					logger.Warn("Failed to extend SQS message visibility timeout", zap.Error(err))
+				}
+			case <-handlerDone:
+				return
+			}
+		}
+	}()
+
+	err := c.callHandler(ctx, newSQSReceivedMessage(message))
+	close(handlerDone)
+	<-extenderDone
+	if err != nil {
+		logger.Error("Failed to handle SQS message", zap.Error(err))
+		return false
+	}
+	return true
+}
+
+func (c *SQSConsumer) callHandler(ctx context.Context, message SQSReceivedMessage) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.Errorf("Handler panicked: %v", r)
+		}
+	}()
+	return c.handler(ctx, message)
+}
+
+// deleteMessages deletes the handled messages in batches, a batch is sent when it's
+// full or after the flush interval. The remaining ones are deleted once the channel is closed.
+// The deletes don't use the context of Run, so the handled messages are deleted after it's cancelled.
+func (c *SQSConsumer) deleteMessages(svc *sqs.SQS, receiptHandles <-chan string) {
+	batch := []string{}
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		entries := []*sqs.DeleteMessageBatchRequestEntry{}
+		for i, receiptHandle := range batch {
+			entries = append(entries, &sqs.DeleteMessageBatchRequestEntry{
+				Id:            aws.String(strconv.Itoa(i)),
+				ReceiptHandle: aws.String(receiptHandle),
+			})
+		}
+		batch = []string{}
+
+		ctx, cancel := context.WithTimeout(context.Background(), sqsDeleteTimeout)
+		defer cancel()
+		out, err := svc.DeleteMessageBatchWithContext(ctx, &sqs.DeleteMessageBatchInput{
+			QueueUrl: aws.String(c.provider.QueueURL),
+			Entries:  entries,
+		})
+		if err != nil {
+			logging.WithContext(ctx).Error("Failed to delete SQS messages", zap.Error(err))
+			return
+		}
+		for _, failed := range out.Failed {
+			logging.WithContext(ctx).Error("Failed to delete SQS message",
+				zap.String("code", aws.StringValue(failed.Code)),
+				zap.String("message", aws.StringValue(failed.Message)))
+		}
+	}
+
+	ticker := time.NewTicker(sqsDeleteFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case receiptHandle, ok := <-receiptHandles:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, receiptHandle)
+			if len(batch) == sqsMaxBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+func (c *SQSConsumer) sleep(ctx context.Context, d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
@@ -0,0 +1,22 @@
+package providers
+
+import "context"
+
+// SQSMock ...
+type SQSMock struct {
+	Config         AWSConfig
+	SendMessagesFn func(context.Context, []SQSMessage) error
+}
+
+// GetConfig ...
+func (m *SQSMock) GetConfig() AWSConfig {
+	return m.Config
+}
+
+// SendMessages ...
+func (m *SQSMock) SendMessages(ctx context.Context, messages []SQSMessage) error {
+	if m.SendMessagesFn == nil {
+		panic("You have to override SendMessages function in tests")
+	}
+	return m.SendMessagesFn(ctx, messages)
+}
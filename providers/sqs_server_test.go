@@ -0,0 +1,300 @@
+package providers_test
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bitrise-io/api-utils/providers"
+)
+
+type sqsTestMessage struct {
+	id            string
+	body          string
+	attributes    map[string]string
+	groupID       string
+	receiptHandle string
+	receiveCount  int
+	visibleAt     time.Time
+}
+
+type sqsTestAttribute struct {
+	Name  string `xml:"Name"`
+	Value string `xml:"Value"`
+}
+
+type sqsTestMessageAttribute struct {
+	Name        string `xml:"Name"`
+	StringValue string `xml:"Value>StringValue"`
+	DataType    string `xml:"Value>DataType"`
+}
+
+type sqsTestReceivedMessage struct {
+	MessageID         string                    `xml:"MessageId"`
+	ReceiptHandle     string                    `xml:"ReceiptHandle"`
+	MD5OfBody         string                    `xml:"MD5OfBody"`
+	Body              string                    `xml:"Body"`
+	Attributes        []sqsTestAttribute        `xml:"Attribute"`
+	MessageAttributes []sqsTestMessageAttribute `xml:"MessageAttribute"`
+}
+
+type sqsTestBatchResultEntry struct {
+	ID        string `xml:"Id"`
+	MessageID string `xml:"MessageId,omitempty"`
+	MD5OfBody string `xml:"MD5OfMessageBody,omitempty"`
+}
+
+type sqsTestBatchErrorEntry struct {
+	ID          string `xml:"Id"`
+	Code        string `xml:"Code"`
+	Message     string `xml:"Message"`
+	SenderFault bool   `xml:"SenderFault"`
+}
+
+// sqsTestServer is a minimal, in-memory stand-in of a single SQS queue,
+// speaking the query protocol used by the SDK
+type sqsTestServer struct {
+	*httptest.Server
+
+	mu              sync.Mutex
+	nextID          int
+	messages        []*sqsTestMessage
+	deduplicationID map[string]bool
+	deleted         []string
+	visibilityCalls int
+	lastVisibility  string
+	lastWaitTime    string
+	batchRequests   int
+	// failedBatches are the SendMessageBatch requests, by their 1 based number, which
+	// are rejected as a whole
+	failedBatches map[int]bool
+}
+
+func newSQSTestServer() (*sqsTestServer, *providers.SQS) {
+	s := &sqsTestServer{deduplicationID: map[string]bool{}}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+
+	return s, &providers.SQS{
+		Config: providers.AWSConfig{
+			Region:          "us-east-1",
+			AccessKeyID:     "test-access-key-id",
+			SecretAccessKey: "test-secret-access-key",
+			Endpoint:        s.URL,
+		},
+		QueueURL: s.URL + "/123456789012/test-queue",
+	}
+}
+
+func (s *sqsTestServer) handle(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	action := r.PostForm.Get("Action")
+	switch action {
+	case "SendMessageBatch":
+		if s.rejectBatch() {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, "<ErrorResponse><Error><Type>Sender</Type><Code>AccessDenied</Code><Message>Access to the resource is denied</Message></Error><RequestId>test</RequestId></ErrorResponse>")
+			return
+		}
+		s.respond(w, action, s.sendMessageBatch(r))
+	case "ReceiveMessage":
+		s.respond(w, action, s.receiveMessage(r))
+	case "ChangeMessageVisibility":
+		s.respond(w, action, s.changeMessageVisibility(r))
+	case "DeleteMessageBatch":
+		s.respond(w, action, s.deleteMessageBatch(r))
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+func (s *sqsTestServer) respond(w http.ResponseWriter, action string, result interface{}) {
+	body, err := xml.Marshal(result)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintf(w, "<%sResponse>%s<ResponseMetadata><RequestId>test</RequestId></ResponseMetadata></%sResponse>", action, body, action)
+}
+
+func (s *sqsTestServer) rejectBatch() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.batchRequests++
+	return s.failedBatches[s.batchRequests]
+}
+
+func (s *sqsTestServer) sendMessageBatch(r *http.Request) interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result := struct {
+		XMLName    xml.Name
+		Successful []sqsTestBatchResultEntry `xml:"SendMessageBatchResultEntry"`
+		Failed     []sqsTestBatchErrorEntry  `xml:"BatchResultErrorEntry"`
+	}{XMLName: xml.Name{Local: "SendMessageBatchResult"}}
+	for i := 1; r.PostForm.Get(fmt.Sprintf("SendMessageBatchRequestEntry.%d.Id", i)) != ""; i++ {
+		prefix := fmt.Sprintf("SendMessageBatchRequestEntry.%d.", i)
+		id := r.PostForm.Get(prefix + "Id")
+		body := r.PostForm.Get(prefix + "MessageBody")
+		if body == "" {
+			result.Failed = append(result.Failed, sqsTestBatchErrorEntry{ID: id, Code: "EmptyValue", Message: "No message body", SenderFault: true})
+			continue
+		}
+
+		sum := md5.Sum([]byte(body))
+		s.nextID++
+		message := &sqsTestMessage{
+			id:         strconv.Itoa(s.nextID),
+			body:       body,
+			groupID:    r.PostForm.Get(prefix + "MessageGroupId"),
+			attributes: map[string]string{},
+		}
+		result.Successful = append(result.Successful, sqsTestBatchResultEntry{ID: id, MessageID: message.id, MD5OfBody: hex.EncodeToString(sum[:])})
+
+		if deduplicationID := r.PostForm.Get(prefix + "MessageDeduplicationId"); deduplicationID != "" {
+			if s.deduplicationID[deduplicationID] {
+				continue
+			}
+			s.deduplicationID[deduplicationID] = true
+		}
+		for j := 1; r.PostForm.Get(fmt.Sprintf("%sMessageAttribute.%d.Name", prefix, j)) != ""; j++ {
+			attributePrefix := fmt.Sprintf("%sMessageAttribute.%d.", prefix, j)
+			message.attributes[r.PostForm.Get(attributePrefix+"Name")] = r.PostForm.Get(attributePrefix + "Value.StringValue")
+		}
+		s.messages = append(s.messages, message)
+	}
+	return result
+}
+
+func (s *sqsTestServer) receiveMessage(r *http.Request) interface{} {
+	maxMessages, _ := strconv.Atoi(r.PostForm.Get("MaxNumberOfMessages"))
+	waitTime, _ := strconv.Atoi(r.PostForm.Get("WaitTimeSeconds"))
+	s.mu.Lock()
+	s.lastWaitTime = r.PostForm.Get("WaitTimeSeconds")
+	s.mu.Unlock()
+	visibilityTimeout, _ := strconv.Atoi(r.PostForm.Get("VisibilityTimeout"))
+
+	result := struct {
+		XMLName  xml.Name
+		Messages []sqsTestReceivedMessage `xml:"Message"`
+	}{XMLName: xml.Name{Local: "ReceiveMessageResult"}}
+	deadline := time.Now().Add(time.Duration(waitTime) * time.Second)
+	for {
+		s.mu.Lock()
+		now := time.Now()
+		for _, message := range s.messages {
+			if len(result.Messages) == maxMessages {
+				break
+			}
+			if message.visibleAt.After(now) {
+				continue
+			}
+			message.receiveCount++
+			message.receiptHandle = fmt.Sprintf("%s-%d", message.id, message.receiveCount)
+			message.visibleAt = now.Add(time.Duration(visibilityTimeout) * time.Second)
+
+			sum := md5.Sum([]byte(message.body))
+			receivedMessage := sqsTestReceivedMessage{
+				MessageID:     message.id,
+				ReceiptHandle: message.receiptHandle,
+				MD5OfBody:     hex.EncodeToString(sum[:]),
+				Body:          message.body,
+				Attributes:    []sqsTestAttribute{{Name: "ApproximateReceiveCount", Value: strconv.Itoa(message.receiveCount)}},
+			}
+			if message.groupID != "" {
+				receivedMessage.Attributes = append(receivedMessage.Attributes, sqsTestAttribute{Name: "MessageGroupId", Value: message.groupID})
+			}
+			for name, value := range message.attributes {
+				receivedMessage.MessageAttributes = append(receivedMessage.MessageAttributes, sqsTestMessageAttribute{Name: name, StringValue: value, DataType: "String"})
+			}
+			result.Messages = append(result.Messages, receivedMessage)
+		}
+		s.mu.Unlock()
+
+		if len(result.Messages) > 0 || time.Now().After(deadline) {
+			return result
+		}
+		select {
+		case <-r.Context().Done():
+			return result
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func (s *sqsTestServer) changeMessageVisibility(r *http.Request) interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	visibilityTimeout, _ := strconv.Atoi(r.PostForm.Get("VisibilityTimeout"))
+	s.lastVisibility = r.PostForm.Get("VisibilityTimeout")
+	for _, message := range s.messages {
+		if message.receiptHandle == r.PostForm.Get("ReceiptHandle") {
+			s.visibilityCalls++
+			message.visibleAt = time.Now().Add(time.Duration(visibilityTimeout) * time.Second)
+		}
+	}
+	return struct{ XMLName xml.Name }{XMLName: xml.Name{Local: "ChangeMessageVisibilityResult"}}
+}
+
+func (s *sqsTestServer) deleteMessageBatch(r *http.Request) interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result := struct {
+		XMLName    xml.Name
+		Successful []sqsTestBatchResultEntry `xml:"DeleteMessageBatchResultEntry"`
+	}{XMLName: xml.Name{Local: "DeleteMessageBatchResult"}}
+	for i := 1; r.PostForm.Get(fmt.Sprintf("DeleteMessageBatchRequestEntry.%d.Id", i)) != ""; i++ {
+		prefix := fmt.Sprintf("DeleteMessageBatchRequestEntry.%d.", i)
+		receiptHandle := r.PostForm.Get(prefix + "ReceiptHandle")
+		for j, message := range s.messages {
+			if message.receiptHandle == receiptHandle {
+				s.deleted = append(s.deleted, message.body)
+				s.messages = append(s.messages[:j], s.messages[j+1:]...)
+				break
+			}
+		}
+		result.Successful = append(result.Successful, sqsTestBatchResultEntry{ID: r.PostForm.Get(prefix + "Id")})
+	}
+	return result
+}
+
+func (s *sqsTestServer) deletedMessages() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.deleted...)
+}
+
+func (s *sqsTestServer) visibilityChanges() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.visibilityCalls
+}
+
+func (s *sqsTestServer) lastVisibilityTimeout() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastVisibility
+}
+
+func (s *sqsTestServer) lastWaitTimeSeconds() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastWaitTime
+}
+
+func (s *sqsTestServer) queuedMessages() []*sqsTestMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*sqsTestMessage{}, s.messages...)
+}
@@ -0,0 +1,257 @@
+package providers_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/bitrise-io/api-utils/providers"
+)
+
+func Test_SQS_SendMessages(t *testing.T) {
+	t.Log("ok - multiple batches with FIFO group and deduplication IDs")
+	{
+		server, sqsProvider := newSQSTestServer()
+		defer server.Close()
+
+		messages := []providers.SQSMessage{}
+		for i := 0; i < 12; i++ {
+			messages = append(messages, providers.SQSMessage{
+				Body:            fmt.Sprintf("message-%d", i),
+				Attributes:      map[string]string{"kind": "build"},
+				GroupID:         "app-slug-1",
+				DeduplicationID: fmt.Sprintf("dedup-%d", i%11),
+			})
+		}
+		require.NoError(t, sqsProvider.SendMessages(context.Background(), messages))
+
+		queued := server.queuedMessages()
+		require.Equal(t, 11, len(queued))
+		require.Equal(t, "message-0", queued[0].body)
+		require.Equal(t, "app-slug-1", queued[0].groupID)
+		require.Equal(t, map[string]string{"kind": "build"}, queued[0].attributes)
+	}
+	t.Log("error - failed entries")
+	{
+		server, sqsProvider := newSQSTestServer()
+		defer server.Close()
+
+		err := sqsProvider.SendMessages(context.Background(), []providers.SQSMessage{{Body: "message-0"}, {Body: ""}})
+		batchErr := &providers.SQSBatchSendError{}
+		require.True(t, errors.As(err, &batchErr))
+		require.Equal(t, map[int]string{1: "EmptyValue: No message body"}, batchErr.Failed)
+		require.Equal(t, 1, len(server.queuedMessages()))
+	}
+	t.Log("error - a later batch fails as a whole")
+	{
+		server, sqsProvider := newSQSTestServer()
+		defer server.Close()
+		server.failedBatches = map[int]bool{2: true}
+
+		messages := []providers.SQSMessage{}
+		for i := 0; i < 25; i++ {
+			messages = append(messages, providers.SQSMessage{Body: fmt.Sprintf("message-%d", i)})
+		}
+		err := sqsProvider.SendMessages(context.Background(), messages)
+		batchErr := &providers.SQSBatchSendError{}
+		require.True(t, errors.As(err, &batchErr))
+		require.Equal(t, 15, len(batchErr.Failed))
+		for i := 0; i < 10; i++ {
+			require.NotContains(t, batchErr.Failed, i)
+		}
+		require.Contains(t, batchErr.Failed[10], "AccessDenied")
+		require.Equal(t, "Not sent: a previous batch failed", batchErr.Failed[24])
+		require.Equal(t, 10, len(server.queuedMessages()))
+	}
+	t.Log("error - the rest of a FIFO group isn't sent after a failure")
+	{
+		server, sqsProvider := newSQSTestServer()
+		defer server.Close()
+
+		messages := []providers.SQSMessage{}
+		for i := 0; i < 14; i++ {
+			message := providers.SQSMessage{Body: fmt.Sprintf("message-%d", i), GroupID: "group-b"}
+			if i%2 == 0 {
+				message.GroupID = "group-a"
+			}
+			messages = append(messages, message)
+		}
+		messages[8].Body = ""
+		err := sqsProvider.SendMessages(context.Background(), messages)
+		batchErr := &providers.SQSBatchSendError{}
+		require.True(t, errors.As(err, &batchErr))
+		require.Equal(t, map[int]string{
+			8:  "EmptyValue: No message body",
+			10: "Skipped: a previous message of group group-a failed",
+			12: "Skipped: a previous message of group group-a failed",
+		}, batchErr.Failed)
+
+		bodies := []string{}
+		for _, message := range server.queuedMessages() {
+			bodies = append(bodies, message.body)
+		}
+		require.Equal(t, []string{
+			"message-0", "message-1", "message-2", "message-3", "message-4", "message-5", "message-6", "message-7",
+			"message-9", "message-11", "message-13",
+		}, bodies)
+	}
+}
+
+func Test_SQSConsumer(t *testing.T) {
+	t.Log("ok - successfully handled messages are deleted")
+	{
+		server, sqsProvider := newSQSTestServer()
+		defer server.Close()
+		require.NoError(t, sqsProvider.SendMessages(context.Background(), []providers.SQSMessage{
+			{Body: "message-0"}, {Body: "message-1"}, {Body: "message-2"}, {Body: "fail"}, {Body: "panic"},
+		}))
+
+		mu := sync.Mutex{}
+		handled := []string{}
+		consumer := providers.NewSQSConsumer(sqsProvider, func(ctx context.Context, message providers.SQSReceivedMessage) error {
+			mu.Lock()
+			handled = append(handled, message.Body)
+			mu.Unlock()
+			switch message.Body {
+			case "fail":
+				return errors.New("failed")
+			case "panic":
+				panic("handler panic")
+			}
+			return nil
+		}, providers.SQSConsumerConfig{Concurrency: 2, WaitTime: time.Second, VisibilityTimeout: 10 * time.Second})
+
+		runErr := make(chan error)
+		go func() { runErr <- consumer.Run(context.Background()) }()
+		require.Eventually(t, func() bool { return len(server.deletedMessages()) == 3 }, 5*time.Second, 10*time.Millisecond)
+		require.NoError(t, consumer.Shutdown(context.Background()))
+		require.NoError(t, <-runErr)
+
+		deleted := server.deletedMessages()
+		sort.Strings(deleted)
+		sort.Strings(handled)
+		require.Equal(t, []string{"message-0", "message-1", "message-2"}, deleted)
+		require.Equal(t, []string{"fail", "message-0", "message-1", "message-2", "panic"}, handled)
+		require.Equal(t, 2, len(server.queuedMessages()))
+	}
+	t.Log("ok - visibility is extended and the running handler finishes on shutdown")
+	{
+		server, sqsProvider := newSQSTestServer()
+		defer server.Close()
+		require.NoError(t, sqsProvider.SendMessages(context.Background(), []providers.SQSMessage{{Body: "message-0"}}))
+
+		started := make(chan struct{})
+		finish := make(chan struct{})
+		consumer := providers.NewSQSConsumer(sqsProvider, func(ctx context.Context, message providers.SQSReceivedMessage) error {
+			close(started)
+			<-finish
+			return nil
+		}, providers.SQSConsumerConfig{WaitTime: time.Second, VisibilityTimeout: 300 * time.Millisecond})
+
+		runErr := make(chan error)
+		go func() { runErr <- consumer.Run(context.Background()) }()
+		<-started
+		// the visibility timeout is rounded up to 1 second, and extended every half of it
+		require.Eventually(t, func() bool { return server.visibilityChanges() >= 1 }, 5*time.Second, 10*time.Millisecond)
+
+		shutdownErr := make(chan error)
+		go func() { shutdownErr <- consumer.Shutdown(context.Background()) }()
+		select {
+		case <-runErr:
+			t.Fatal("Run returned before the handler finished")
+		case <-time.After(50 * time.Millisecond):
+		}
+		close(finish)
+		require.NoError(t, <-shutdownErr)
+		require.NoError(t, <-runErr)
+
+		require.Equal(t, []string{"message-0"}, server.deletedMessages())
+		require.Equal(t, "1", server.lastVisibilityTimeout())
+	}
+	t.Log("ok - the rest of a FIFO group isn't handled after a failure")
+	{
+		server, sqsProvider := newSQSTestServer()
+		defer server.Close()
+		require.NoError(t, sqsProvider.SendMessages(context.Background(), []providers.SQSMessage{
+			{Body: "a-0", GroupID: "a"}, {Body: "b-0", GroupID: "b"}, {Body: "a-fail", GroupID: "a"},
+			{Body: "b-1", GroupID: "b"}, {Body: "a-2", GroupID: "a"},
+		}))
+
+		mu := sync.Mutex{}
+		handled := map[string][]string{}
+		consumer := providers.NewSQSConsumer(sqsProvider, func(ctx context.Context, message providers.SQSReceivedMessage) error {
+			mu.Lock()
+			handled[message.GroupID] = append(handled[message.GroupID], message.Body)
+			mu.Unlock()
+			if message.Body == "a-fail" {
+				return errors.New("failed")
+			}
+			return nil
+		}, providers.SQSConsumerConfig{Concurrency: 10, WaitTime: time.Second, VisibilityTimeout: 10 * time.Second})
+
+		runErr := make(chan error)
+		go func() { runErr <- consumer.Run(context.Background()) }()
+		require.Eventually(t, func() bool { return len(server.deletedMessages()) == 3 }, 5*time.Second, 10*time.Millisecond)
+		require.NoError(t, consumer.Shutdown(context.Background()))
+		require.NoError(t, <-runErr)
+
+		deleted := server.deletedMessages()
+		sort.Strings(deleted)
+		require.Equal(t, []string{"a-0", "b-0", "b-1"}, deleted)
+		require.Equal(t, map[string][]string{"a": {"a-0", "a-fail"}, "b": {"b-0", "b-1"}}, handled)
+		require.Equal(t, 2, len(server.queuedMessages()))
+	}
+	t.Log("ok - handled messages are deleted after the context is cancelled")
+	{
+		server, sqsProvider := newSQSTestServer()
+		defer server.Close()
+		require.NoError(t, sqsProvider.SendMessages(context.Background(), []providers.SQSMessage{{Body: "message-0"}}))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		consumer := providers.NewSQSConsumer(sqsProvider, func(ctx context.Context, message providers.SQSReceivedMessage) error {
+			cancel()
+			return nil
+		}, providers.SQSConsumerConfig{WaitTime: time.Second})
+
+		require.Equal(t, context.Canceled, consumer.Run(ctx))
+		require.Equal(t, []string{"message-0"}, server.deletedMessages())
+	}
+	t.Log("ok - wait time is limited to the maximum of SQS")
+	{
+		server, sqsProvider := newSQSTestServer()
+		defer server.Close()
+		require.NoError(t, sqsProvider.SendMessages(context.Background(), []providers.SQSMessage{{Body: "message-0"}}))
+
+		consumer := providers.NewSQSConsumer(sqsProvider, func(ctx context.Context, message providers.SQSReceivedMessage) error {
+			return nil
+		}, providers.SQSConsumerConfig{WaitTime: time.Minute})
+
+		runErr := make(chan error)
+		go func() { runErr <- consumer.Run(context.Background()) }()
+		require.Eventually(t, func() bool { return len(server.deletedMessages()) == 1 }, 5*time.Second, 10*time.Millisecond)
+		require.NoError(t, consumer.Shutdown(context.Background()))
+		require.NoError(t, <-runErr)
+		require.Equal(t, "20", server.lastWaitTimeSeconds())
+	}
+	t.Log("ok - cancelling the context stops the consumer")
+	{
+		server, sqsProvider := newSQSTestServer()
+		defer server.Close()
+
+		consumer := providers.NewSQSConsumer(sqsProvider, func(ctx context.Context, message providers.SQSReceivedMessage) error {
+			return nil
+		}, providers.SQSConsumerConfig{WaitTime: time.Second})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		runErr := make(chan error)
+		go func() { runErr <- consumer.Run(ctx) }()
+		cancel()
+		require.Equal(t, context.Canceled, <-runErr)
+	}
+}
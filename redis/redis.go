@@ -3,6 +3,7 @@ package redis
 import (
 	"fmt"
 	"net/url"
+	"sort"
 	"strings"
 	"time"
 
@@ -166,6 +167,33 @@ func (c *Client) GetInt64(key string) (int64, error) {
 
 }
 
+// XAdd appends an entry with the fields to the stream and returns its ID. With
+// maxLen set the stream is trimmed to about that many entries.
+func (c *Client) XAdd(stream string, maxLen int64, fields map[string]string) (string, error) {
+	conn := c.pool.Get()
+	defer c.closeConnection(conn)
+
+	args := redis.Args{stream}
+	if maxLen > 0 {
+		args = args.Add("MAXLEN", "~", maxLen)
+	}
+	args = args.Add("*")
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		args = args.Add(key, fields[key])
+	}
+
+	id, err := redis.String(conn.Do("XADD", args...))
+	if err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
 func (c *Client) closeConnection(conn redis.Conn) {
 	err := conn.Close()
 	if err != nil {
@@ -7,6 +7,7 @@ type ClientMock struct {
 	GetInt64Fn  func(string) (int64, error)
 	SetFn       func(string, interface{}, int) error
 	IncrFn      func(string) error
+	XAddFn      func(string, int64, map[string]string) (string, error)
 }
 
 // GetString ...
@@ -48,3 +49,11 @@ func (c *ClientMock) Incr(key string) error {
 	}
 	return c.IncrFn(key)
 }
+
+// XAdd ...
+func (c *ClientMock) XAdd(stream string, maxLen int64, fields map[string]string) (string, error) {
+	if c.XAddFn == nil {
+		panic("You have to override Client.XAdd function in tests")
+	}
+	return c.XAddFn(stream, maxLen, fields)
+}
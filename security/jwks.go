@@ -0,0 +1,209 @@
+package security
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"fmt"
+	"math"
+	"math/big"
+	"net/http"
+	"time"
+
+	"github.com/bitrise-io/api-utils/httpresponse"
+	"github.com/pkg/errors"
+)
+
+// JWK is a public key in the JSON Web Key format of RFC 7517
+type JWK struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid,omitempty"`
+	Use       string `json:"use,omitempty"`
+	Algorithm string `json:"alg,omitempty"`
+	// RSA
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// EC and OKP
+	Curve string `json:"crv,omitempty"`
+	X     string `json:"x,omitempty"`
+	Y     string `json:"y,omitempty"`
+}
+
+// JWKS is a JSON Web Key Set
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// NewJWK ...
+func NewJWK(key Key) (JWK, error) {
+	key, err := key.withDefaults()
+	if err != nil {
+		return JWK{}, err
+	}
+	jwk, err := newJWK(key)
+	if err != nil {
+		return JWK{}, err
+	}
+	// only the signing algorithm can be published, the verifiers restrict the key to it
+	jwk.Algorithm = key.Algorithms[0]
+	return jwk, nil
+}
+
+func newJWK(key Key) (JWK, error) {
+	switch publicKey := key.PublicKey.(type) {
+	case *rsa.PublicKey:
+		return JWK{
+			KeyType:   "RSA",
+			KeyID:     key.ID,
+			Use:       "sig",
+			Algorithm: "RS256",
+			N:         base64.RawURLEncoding.EncodeToString(publicKey.N.Bytes()),
+			E:         base64.RawURLEncoding.EncodeToString(big.NewInt(int64(publicKey.E)).Bytes()),
+		}, nil
+	case *ecdsa.PublicKey:
+		algorithms := keyAlgorithms(publicKey)
+		if len(algorithms) == 0 {
+			break
+		}
+		// the coordinates are padded to the size of the curve
+		size := (publicKey.Curve.Params().BitSize + 7) / 8
+		return JWK{
+			KeyType:   "EC",
+			KeyID:     key.ID,
+			Use:       "sig",
+			Algorithm: algorithms[0],
+			Curve:     publicKey.Curve.Params().Name,
+			X:         base64.RawURLEncoding.EncodeToString(padBytes(publicKey.X.Bytes(), size)),
+			Y:         base64.RawURLEncoding.EncodeToString(padBytes(publicKey.Y.Bytes(), size)),
+		}, nil
+	case ed25519.PublicKey:
+		return JWK{
+			KeyType:   "OKP",
+			KeyID:     key.ID,
+			Use:       "sig",
+			Algorithm: SigningMethodEdDSA.Alg(),
+			Curve:     "Ed25519",
+			X:         base64.RawURLEncoding.EncodeToString(publicKey),
+		}, nil
+	}
+	return JWK{}, errors.Errorf("Unsupported type %T of key %s", key.PublicKey, key.ID)
+}
+
+// PublicKey decodes the RSA, ECDSA or Ed25519 public key
+func (k JWK) PublicKey() (crypto.PublicKey, error) {
+	switch k.KeyType {
+	case "RSA":
+		n, err := decodeJWKInt(k.N)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid modulus of key %s", k.KeyID)
+		}
+		e, err := decodeJWKInt(k.E)
+		if err != nil || !e.IsInt64() || e.Int64() > math.MaxInt32 {
+			return nil, errors.Errorf("Invalid exponent of key %s", k.KeyID)
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Curve {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, errors.Errorf("Unsupported curve %s of key %s", k.Curve, k.KeyID)
+		}
+		x, err := decodeJWKInt(k.X)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid x coordinate of key %s", k.KeyID)
+		}
+		y, err := decodeJWKInt(k.Y)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid y coordinate of key %s", k.KeyID)
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.Errorf("Invalid point of key %s", k.KeyID)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		if k.Curve != "Ed25519" {
+			return nil, errors.Errorf("Unsupported curve %s of key %s", k.Curve, k.KeyID)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.Errorf("Invalid public key of key %s", k.KeyID)
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, errors.Errorf("Unsupported key type %s of key %s", k.KeyType, k.KeyID)
+}
+
+func padBytes(b []byte, size int) []byte {
+	if len(b) >= size {
+		return b
+	}
+	return append(make([]byte, size-len(b)), b...)
+}
+
+func decodeJWKInt(value string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, errors.New("empty value")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// keyAlgorithms returns the algorithms which can be verified with the key
+func keyAlgorithms(publicKey crypto.PublicKey) []string {
+	switch key := publicKey.(type) {
+	case *rsa.PublicKey:
+		return []string{"RS256", "RS384", "RS512"}
+	case *ecdsa.PublicKey:
+		switch key.Curve {
+		case elliptic.P256():
+			return []string{"ES256"}
+		case elliptic.P384():
+			return []string{"ES384"}
+		case elliptic.P521():
+			return []string{"ES512"}
+		}
+	case ed25519.PublicKey:
+		return []string{SigningMethodEdDSA.Alg()}
+	}
+	return nil
+}
+
+// JWKS returns the public keys of the set
+func (s *KeySet) JWKS() (JWKS, error) {
+	jwks := JWKS{Keys: []JWK{}}
+	for _, key := range s.Keys() {
+		jwk, err := NewJWK(key)
+		if err != nil {
+			return JWKS{}, err
+		}
+		jwks.Keys = append(jwks.Keys, jwk)
+	}
+	return jwks, nil
+}
+
+// JWKSHandler publishes the public keys of the set, e.g. at /.well-known/jwks.json.
+// The verifiers can cache the response for maxAge, so a new key should be added at
+// least maxAge before it's activated.
+func (s *KeySet) JWKSHandler(maxAge time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		jwks, err := s.JWKS()
+		if err != nil {
+			httpresponse.RespondWithInternalServerError(w, err)
+			return
+		}
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int64(maxAge/time.Second)))
+		httpresponse.RespondWithSuccessNoErr(w, jwks)
+	})
+}
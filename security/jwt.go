@@ -1,7 +1,6 @@
 package security
 
 import (
-	"crypto/rsa"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
@@ -13,17 +12,23 @@ type JWTInterface interface {
 	Sign(authToken string) (string, error)
 	Verify(jwtToken string) (bool, error)
 	GetToken(jwtToken string) (interface{}, error)
+	SignClaims(claims Claims) (string, error)
+	ParseClaims(jwtToken string, claims Claims) error
 }
 
 // JWTService ...
 type JWTService struct {
-	privateKey *rsa.PrivateKey
-	publicKey  *rsa.PublicKey
-	expiration time.Duration
+	keys   *KeySet
+	config JWTConfig
 }
 
 // NewJWTService ...
 func NewJWTService(publicKey, privateKey string, expiration time.Duration) (JWTService, error) {
+	return NewJWTServiceWithConfig(publicKey, privateKey, JWTConfig{Expiration: expiration})
+}
+
+// NewJWTServiceWithConfig ...
+func NewJWTServiceWithConfig(publicKey, privateKey string, config JWTConfig) (JWTService, error) {
 	signKey, err := jwt.ParseRSAPrivateKeyFromPEM([]byte(privateKey))
 	if err != nil {
 		return JWTService{}, errors.Wrap(err, "Failed to parse private key")
@@ -32,44 +37,86 @@ func NewJWTService(publicKey, privateKey string, expiration time.Duration) (JWTS
 	if err != nil {
 		return JWTService{}, errors.Wrap(err, "Failed to parse public key")
 	}
-	return JWTService{
-		privateKey: signKey,
-		publicKey:  verifyKey,
-		expiration: expiration,
-	}, nil
+	// the single key has no ID, the tokens are signed without a kid header
+	keys, err := NewKeySet(Key{PrivateKey: signKey, PublicKey: verifyKey})
+	if err != nil {
+		return JWTService{}, err
+	}
+	if err := keys.Activate(""); err != nil {
+		return JWTService{}, err
+	}
+	return NewJWTServiceWithKeySet(keys, config), nil
 }
 
-// Sign ...
-func (j *JWTService) Sign(authToken string) (string, error) {
-	jwtToken := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
-		"token": authToken,
-		"exp":   time.Now().Add(j.expiration).Unix(),
-	})
+// NewJWTServiceWithKeySet signs the tokens with the active key of the set, and
+// verifies them with the key of their kid header
+func NewJWTServiceWithKeySet(keys *KeySet, config JWTConfig) JWTService {
+	return JWTService{keys: keys, config: config}
+}
+
+// tokenClaims are the claims of the tokens signed by Sign
+type tokenClaims struct {
+	RegisteredClaims
+	Token interface{} `json:"token"`
+}
 
-	return jwtToken.SignedString(j.privateKey)
+// Sign signs the auth token, with the issuer and the audience of the config if they're set
+func (j *JWTService) Sign(authToken string) (string, error) {
+	claims := &tokenClaims{
+		RegisteredClaims: RegisteredClaims{Issuer: j.config.Issuer, ExpiresAt: time.Now().Add(j.config.Expiration).Unix()},
+		Token:            authToken,
+	}
+	if len(j.config.Audience) > 0 {
+		claims.Audience = append(Audience{}, j.config.Audience...)
+	}
+	return j.sign(claims)
 }
 
-// Verify ...
+// Verify checks the token like ParseClaims, including the issuer and the audience of the config
 func (j *JWTService) Verify(jwtToken string) (bool, error) {
-	token, err := jwt.Parse(jwtToken, func(token *jwt.Token) (interface{}, error) {
-		return j.publicKey, nil
-	})
-	if err != nil {
+	if err := j.ParseClaims(jwtToken, &tokenClaims{}); err != nil {
 		return false, err
 	}
-	return token.Valid, nil
+	return true, nil
 }
 
-// GetToken ...
+// GetToken returns the auth token of a token signed by Sign, it's verified like by Verify
 func (j *JWTService) GetToken(jwtToken string) (interface{}, error) {
-	token, err := jwt.Parse(jwtToken, func(token *jwt.Token) (interface{}, error) {
-		return j.publicKey, nil
-	})
+	claims := &tokenClaims{}
+	if err := j.ParseClaims(jwtToken, claims); err != nil {
+		return "", err
+	}
+	return claims.Token, nil
+}
+
+func (j *JWTService) sign(claims jwt.Claims) (string, error) {
+	key, err := j.keys.ActiveKey()
 	if err != nil {
 		return "", err
 	}
-	if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-		return claims["token"], nil
+	method := jwt.GetSigningMethod(key.Algorithms[0])
+	if method == nil {
+		return "", errors.Errorf("Unsupported signing method %s", key.Algorithms[0])
+	}
+	token := jwt.NewWithClaims(method, claims)
+	if key.ID != "" {
+		token.Header["kid"] = key.ID
+	}
+	return token.SignedString(key.PrivateKey)
+}
+
+// keyFunc returns the key of the kid header, or the key without an ID for the
+// tokens without one, e.g. the ones signed before rotation. The algorithm of the
+// token has to be one of the key's, otherwise e.g. a token signed with HMAC using
+// the public key as the secret could be accepted.
+func (j *JWTService) keyFunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	key, ok := j.keys.Key(kid)
+	if !ok {
+		return nil, &TokenError{Reason: ErrTokenSignatureInvalid, Err: errors.Errorf("Unknown key %s", kid)}
+	}
+	if !containsAlgorithm(key.Algorithms, token.Method.Alg()) {
+		return nil, &TokenError{Reason: ErrTokenSignatureInvalid, Err: errors.Errorf("Signing method %s is not allowed for key %s", token.Method.Alg(), kid)}
 	}
-	return "", errors.New("Token is not valid")
+	return key.PublicKey, nil
 }
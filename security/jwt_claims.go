@@ -0,0 +1,171 @@
+package security
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/pkg/errors"
+)
+
+// Claims of a token, a struct embedding RegisteredClaims and the custom claims, e.g.
+//
+//	type BuildClaims struct {
+//		security.RegisteredClaims
+//		Scopes  []string `json:"scopes"`
+//		AppSlug string   `json:"app_slug"`
+//	}
+type Claims interface {
+	jwt.Claims
+	Registered() *RegisteredClaims
+}
+
+// RegisteredClaims are the registered claims of RFC 7519, the times are in Unix seconds
+type RegisteredClaims struct {
+	Issuer    string   `json:"iss,omitempty"`
+	Subject   string   `json:"sub,omitempty"`
+	Audience  Audience `json:"aud,omitempty"`
+	ExpiresAt int64    `json:"exp,omitempty"`
+	NotBefore int64    `json:"nbf,omitempty"`
+	IssuedAt  int64    `json:"iat,omitempty"`
+	ID        string   `json:"jti,omitempty"`
+}
+
+// Registered ...
+func (c *RegisteredClaims) Registered() *RegisteredClaims {
+	return c
+}
+
+// Valid is called by jwt-go, the claims are validated by the JWTService
+// with the configured leeway instead
+func (c RegisteredClaims) Valid() error {
+	return nil
+}
+
+// Audience is a single string or an array of strings in the token
+type Audience []string
+
+// MarshalJSON ...
+func (a Audience) MarshalJSON() ([]byte, error) {
+	if len(a) == 1 {
+		return json.Marshal(a[0])
+	}
+	return json.Marshal([]string(a))
+}
+
+// UnmarshalJSON ...
+func (a *Audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = Audience{single}
+		return nil
+	}
+	var multiple []string
+	if err := json.Unmarshal(data, &multiple); err != nil {
+		return errors.New("Invalid audience claim")
+	}
+	*a = multiple
+	return nil
+}
+
+// Contains ...
+func (a Audience) Contains(audience string) bool {
+	for _, aud := range a {
+		if aud == audience {
+			return true
+		}
+	}
+	return false
+}
+
+// JWTConfig ...
+type JWTConfig struct {
+	// Expiration of the signed tokens, they don't expire if it's 0
+	Expiration time.Duration
+	// Issuer is set in the signed tokens, and it's required in the verified ones if it's set
+	Issuer string
+	// Audience is set in the signed tokens, and one of them is required in the verified
+	// ones if it's set
+	Audience []string
+	// Leeway is the allowed clock skew when checking the exp, nbf and iat claims
+	Leeway time.Duration
+}
+
+// SignClaims signs the claims, the unset iss, aud, iat, exp and jti claims are
+// filled from the config, the current time and a random ID
+func (j *JWTService) SignClaims(claims Claims) (string, error) {
+	registered := claims.Registered()
+	now := time.Now()
+	if registered.Issuer == "" {
+		registered.Issuer = j.config.Issuer
+	}
+	if len(registered.Audience) == 0 && len(j.config.Audience) > 0 {
+		registered.Audience = append(Audience{}, j.config.Audience...)
+	}
+	if registered.IssuedAt == 0 {
+		registered.IssuedAt = now.Unix()
+	}
+	if registered.ExpiresAt == 0 && j.config.Expiration > 0 {
+		registered.ExpiresAt = now.Add(j.config.Expiration).Unix()
+	}
+	if registered.ID == "" {
+		id, err := randomTokenID()
+		if err != nil {
+			return "", err
+		}
+		registered.ID = id
+	}
+
+	return j.sign(claims)
+}
+
+// ParseClaims verifies the token, its issuer, audience and times, and decodes its
+// claims into claims. A rejected token is reported with a *TokenError.
+func (j *JWTService) ParseClaims(jwtToken string, claims Claims) error {
+	parser := &jwt.Parser{SkipClaimsValidation: true}
+	_, err := parser.ParseWithClaims(jwtToken, claims, j.keyFunc)
+	if err != nil {
+		return tokenError(err)
+	}
+	return validateClaims(j.config, claims.Registered(), time.Now())
+}
+
+// validateClaims checks the times, the issuer and the audience of the config
+func validateClaims(config JWTConfig, claims *RegisteredClaims, now time.Time) error {
+	leeway := int64(config.Leeway / time.Second)
+	if claims.ExpiresAt != 0 && now.Unix() > claims.ExpiresAt+leeway {
+		return &TokenError{Reason: ErrTokenExpired}
+	}
+	if claims.NotBefore != 0 && now.Unix() < claims.NotBefore-leeway {
+		return &TokenError{Reason: ErrTokenNotValidYet}
+	}
+	if claims.IssuedAt != 0 && now.Unix() < claims.IssuedAt-leeway {
+		return &TokenError{Reason: ErrTokenIssuedInFuture}
+	}
+	if config.Issuer != "" && claims.Issuer != config.Issuer {
+		return &TokenError{Reason: ErrTokenInvalidIssuer}
+	}
+	if len(config.Audience) > 0 {
+		valid := false
+		for _, audience := range config.Audience {
+			if claims.Audience.Contains(audience) {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			return &TokenError{Reason: ErrTokenInvalidAudience}
+		}
+	}
+	return nil
+}
+
+func randomTokenID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.Wrap(err, "Failed to generate token ID")
+	}
+	return hex.EncodeToString(b), nil
+}
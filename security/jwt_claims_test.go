@@ -0,0 +1,148 @@
+package security_test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bitrise-io/api-utils/security"
+)
+
+type buildClaims struct {
+	security.RegisteredClaims
+	Scopes  []string `json:"scopes"`
+	AppSlug string   `json:"app_slug"`
+}
+
+func generateRSAKeyPEM(t *testing.T) (string, string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	publicKey, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.NoError(t, err)
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicKey})),
+		string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}))
+}
+
+func tokenPayload(t *testing.T, token string) map[string]interface{} {
+	payload, err := base64.RawURLEncoding.DecodeString(strings.Split(token, ".")[1])
+	require.NoError(t, err)
+	claims := map[string]interface{}{}
+	require.NoError(t, json.Unmarshal(payload, &claims))
+	return claims
+}
+
+func Test_JWTService_Claims(t *testing.T) {
+	publicKey, privateKey := generateRSAKeyPEM(t)
+	service, err := security.NewJWTServiceWithConfig(publicKey, privateKey, security.JWTConfig{
+		Expiration: time.Hour,
+		Issuer:     "https://api.bitrise.io",
+		Audience:   []string{"build-service"},
+		Leeway:     30 * time.Second,
+	})
+	require.NoError(t, err)
+
+	t.Log("ok - custom and registered claims")
+	{
+		token, err := service.SignClaims(&buildClaims{
+			RegisteredClaims: security.RegisteredClaims{Subject: "user-1"},
+			Scopes:           []string{"builds:read"},
+			AppSlug:          "app-1",
+		})
+		require.NoError(t, err)
+
+		payload := tokenPayload(t, token)
+		require.Equal(t, "https://api.bitrise.io", payload["iss"])
+		require.Equal(t, "build-service", payload["aud"])
+		require.Len(t, payload["jti"], 32)
+
+		claims := &buildClaims{}
+		require.NoError(t, service.ParseClaims(token, claims))
+		require.Equal(t, "user-1", claims.Subject)
+		require.Equal(t, security.Audience{"build-service"}, claims.Audience)
+		require.Equal(t, []string{"builds:read"}, claims.Scopes)
+		require.Equal(t, "app-1", claims.AppSlug)
+		require.InDelta(t, time.Now().Add(time.Hour).Unix(), claims.ExpiresAt, 5)
+		require.InDelta(t, time.Now().Unix(), claims.IssuedAt, 5)
+	}
+	t.Log("ok - one of multiple audiences")
+	{
+		token, err := service.SignClaims(&buildClaims{RegisteredClaims: security.RegisteredClaims{Audience: security.Audience{"other-service", "build-service"}}})
+		require.NoError(t, err)
+		require.Equal(t, []interface{}{"other-service", "build-service"}, tokenPayload(t, token)["aud"])
+		require.NoError(t, service.ParseClaims(token, &buildClaims{}))
+	}
+	t.Log("ok - Sign, Verify and GetToken with the issuer and the audience")
+	{
+		token, err := service.Sign("auth-token")
+		require.NoError(t, err)
+		payload := tokenPayload(t, token)
+		require.Equal(t, "https://api.bitrise.io", payload["iss"])
+		require.Equal(t, "build-service", payload["aud"])
+
+		valid, err := service.Verify(token)
+		require.NoError(t, err)
+		require.True(t, valid)
+		authToken, err := service.GetToken(token)
+		require.NoError(t, err)
+		require.Equal(t, "auth-token", authToken)
+	}
+	t.Log("not ok - Verify and GetToken check the issuer and the audience")
+	{
+		legacy, err := security.NewJWTService(publicKey, privateKey, time.Hour)
+		require.NoError(t, err)
+		token, err := legacy.Sign("auth-token")
+		require.NoError(t, err)
+
+		valid, err := service.Verify(token)
+		require.False(t, valid)
+		require.EqualError(t, err, "Token has invalid issuer")
+		_, err = service.GetToken(token)
+		require.EqualError(t, err, "Token has invalid issuer")
+	}
+	t.Log("ok - expired within the leeway")
+	{
+		token, err := service.SignClaims(&buildClaims{RegisteredClaims: security.RegisteredClaims{ExpiresAt: time.Now().Add(-10 * time.Second).Unix()}})
+		require.NoError(t, err)
+		require.NoError(t, service.ParseClaims(token, &buildClaims{}))
+	}
+
+	for message, claims := range map[string]security.RegisteredClaims{
+		"Token is expired":              {ExpiresAt: time.Now().Add(-time.Minute).Unix()},
+		"Token is not valid yet":        {NotBefore: time.Now().Add(time.Minute).Unix()},
+		"Token is issued in the future": {IssuedAt: time.Now().Add(time.Minute).Unix()},
+		"Token has invalid issuer":      {Issuer: "https://evil.example.com"},
+		"Token has invalid audience":    {Audience: security.Audience{"other-service"}},
+	} {
+		t.Log("not ok - " + message)
+		{
+			token, err := service.SignClaims(&buildClaims{RegisteredClaims: claims})
+			require.NoError(t, err)
+			require.EqualError(t, service.ParseClaims(token, &buildClaims{}), message)
+		}
+	}
+
+	t.Log("not ok - signed with an other key")
+	{
+		otherPublicKey, otherPrivateKey := generateRSAKeyPEM(t)
+		other, err := security.NewJWTServiceWithConfig(otherPublicKey, otherPrivateKey, security.JWTConfig{Issuer: "https://api.bitrise.io", Audience: []string{"build-service"}})
+		require.NoError(t, err)
+		token, err := other.SignClaims(&buildClaims{})
+		require.NoError(t, err)
+		require.EqualError(t, service.ParseClaims(token, &buildClaims{}), "Token has invalid signature: crypto/rsa: verification error")
+	}
+	t.Log("not ok - HMAC signed with the public key")
+	{
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, &buildClaims{}).SignedString([]byte(publicKey))
+		require.NoError(t, err)
+		require.EqualError(t, service.ParseClaims(token, &buildClaims{}), "Token has invalid signature: Signing method HS256 is not allowed for key ")
+	}
+}
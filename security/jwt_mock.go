@@ -2,9 +2,11 @@ package security
 
 // JWTMock ...
 type JWTMock struct {
-	SignFn     func(authToken string) (string, error)
-	VerifyFn   func(jwtToken string) (bool, error)
-	GetTokenFn func(jwtToken string) (interface{}, error)
+	SignFn        func(authToken string) (string, error)
+	VerifyFn      func(jwtToken string) (bool, error)
+	GetTokenFn    func(jwtToken string) (interface{}, error)
+	SignClaimsFn  func(claims Claims) (string, error)
+	ParseClaimsFn func(jwtToken string, claims Claims) error
 }
 
 // Sign ...
@@ -30,3 +32,19 @@ func (j *JWTMock) GetToken(jwtToken string) (interface{}, error) {
 	}
 	return j.GetTokenFn(jwtToken)
 }
+
+// SignClaims ...
+func (j *JWTMock) SignClaims(claims Claims) (string, error) {
+	if j.SignClaimsFn == nil {
+		panic("You have to override JWTService.SignClaims function in tests")
+	}
+	return j.SignClaimsFn(claims)
+}
+
+// ParseClaims ...
+func (j *JWTMock) ParseClaims(jwtToken string, claims Claims) error {
+	if j.ParseClaimsFn == nil {
+		panic("You have to override JWTService.ParseClaims function in tests")
+	}
+	return j.ParseClaimsFn(jwtToken, claims)
+}
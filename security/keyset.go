@@ -0,0 +1,256 @@
+package security
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	keyEnvPrefix    = "JWT_KEY_"
+	activeKeyEnvKey = "JWT_ACTIVE_KEY"
+	keyFileSuffix   = ".pem"
+)
+
+// Key of a KeySet, identified by the kid header of the tokens
+type Key struct {
+	ID string
+	// PrivateKey is nil for the keys which only verify
+	PrivateKey crypto.PrivateKey
+	PublicKey  crypto.PublicKey
+	// Algorithms accepted when verifying, the tokens are signed with the first one. It
+	// defaults to RS256 for RSA, ES256 or ES384 for ECDSA, and EdDSA for Ed25519 keys.
+	Algorithms []string
+}
+
+// ParseKeyPEM parses a private or a public key, the public key of a private one is derived from it
+func ParseKeyPEM(id string, data []byte) (Key, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return Key{}, errors.Errorf("Failed to decode PEM of key %s", id)
+	}
+	key := Key{ID: id}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		privateKey, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return Key{}, errors.Wrapf(err, "Failed to parse private key %s", id)
+		}
+		key.PrivateKey = privateKey
+	case "EC PRIVATE KEY":
+		privateKey, err := x509.ParseECPrivateKey(block.Bytes)
+		if err != nil {
+			return Key{}, errors.Wrapf(err, "Failed to parse private key %s", id)
+		}
+		key.PrivateKey = privateKey
+	case "PRIVATE KEY":
+		privateKey, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return Key{}, errors.Wrapf(err, "Failed to parse private key %s", id)
+		}
+		key.PrivateKey = privateKey
+	case "RSA PUBLIC KEY":
+		publicKey, err := x509.ParsePKCS1PublicKey(block.Bytes)
+		if err != nil {
+			return Key{}, errors.Wrapf(err, "Failed to parse public key %s", id)
+		}
+		key.PublicKey = publicKey
+	case "PUBLIC KEY":
+		publicKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return Key{}, errors.Wrapf(err, "Failed to parse public key %s", id)
+		}
+		key.PublicKey = publicKey
+	default:
+		return Key{}, errors.Errorf("Unsupported PEM block %s of key %s", block.Type, id)
+	}
+	return key.withDefaults()
+}
+
+// withDefaults derives the public key and the algorithm, and validates them
+func (k Key) withDefaults() (Key, error) {
+	if k.PublicKey == nil {
+		if signer, ok := k.PrivateKey.(crypto.Signer); ok {
+			k.PublicKey = signer.Public()
+		}
+	}
+	if k.PublicKey == nil {
+		return Key{}, errors.Errorf("No public key of key %s", k.ID)
+	}
+	supported := keyAlgorithms(k.PublicKey)
+	if len(supported) == 0 {
+		return Key{}, errors.Errorf("Unsupported type %T of key %s", k.PublicKey, k.ID)
+	}
+	if len(k.Algorithms) == 0 {
+		k.Algorithms = supported[:1]
+	}
+	for _, algorithm := range k.Algorithms {
+		if !containsAlgorithm(supported, algorithm) {
+			return Key{}, errors.Errorf("Algorithm %s is not supported by key %s", algorithm, k.ID)
+		}
+	}
+	return k, nil
+}
+
+func containsAlgorithm(algorithms []string, algorithm string) bool {
+	for _, a := range algorithms {
+		if a == algorithm {
+			return true
+		}
+	}
+	return false
+}
+
+// KeySet holds the signing keys. Tokens are signed with the active key, and verified
+// with the key of their kid header. A key can be rotated by adding the new one, which
+// is published in the JWKS, activating it once the verifiers fetched it, and retiring
+// the old one once the tokens signed with it expired.
+type KeySet struct {
+	mu     sync.RWMutex
+	keys   map[string]Key
+	active string
+}
+
+// NewKeySet ...
+func NewKeySet(keys ...Key) (*KeySet, error) {
+	s := &KeySet{keys: map[string]Key{}}
+	for _, key := range keys {
+		if err := s.Add(key); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// LoadKeySetFromDir reads every <kid>.pem file of the directory, they contain
+// a private or a public key
+func LoadKeySetFromDir(dir, activeKeyID string) (*KeySet, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+keyFileSuffix))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	s := &KeySet{keys: map[string]Key{}}
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to read key")
+		}
+		key, err := ParseKeyPEM(strings.TrimSuffix(filepath.Base(path), keyFileSuffix), data)
+		if err != nil {
+			return nil, err
+		}
+		if err := s.Add(key); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.Activate(activeKeyID); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// LoadKeySetFromEnv reads the keys from the JWT_KEY_<kid> environment variables, they
+// contain a private or a public key in PEM, and activates the one named by JWT_ACTIVE_KEY
+func LoadKeySetFromEnv() (*KeySet, error) {
+	s := &KeySet{keys: map[string]Key{}}
+	for _, env := range os.Environ() {
+		parts := strings.SplitN(env, "=", 2)
+		if !strings.HasPrefix(parts[0], keyEnvPrefix) || len(parts) != 2 {
+			continue
+		}
+		key, err := ParseKeyPEM(strings.TrimPrefix(parts[0], keyEnvPrefix), []byte(parts[1]))
+		if err != nil {
+			return nil, err
+		}
+		if err := s.Add(key); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.Activate(os.Getenv(activeKeyEnvKey)); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Add adds a key for verification, the active one can be changed to it if it has a private key
+func (s *KeySet) Add(key Key) error {
+	key, err := key.withDefaults()
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.keys[key.ID]; ok {
+		return errors.Errorf("Key %s already exists", key.ID)
+	}
+	s.keys[key.ID] = key
+	return nil
+}
+
+// Activate changes the signing key
+func (s *KeySet) Activate(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key, ok := s.keys[id]
+	if !ok {
+		return errors.Errorf("No key %s", id)
+	}
+	if key.PrivateKey == nil {
+		return errors.Errorf("Key %s has no private key", id)
+	}
+	s.active = id
+	return nil
+}
+
+// Retire removes a key, the tokens signed with it aren't accepted anymore
+func (s *KeySet) Retire(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.keys[id]; !ok {
+		return errors.Errorf("No key %s", id)
+	}
+	if id == s.active {
+		return errors.Errorf("Key %s is active", id)
+	}
+	delete(s.keys, id)
+	return nil
+}
+
+// ActiveKey returns the signing key
+func (s *KeySet) ActiveKey() (Key, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	key, ok := s.keys[s.active]
+	if !ok || key.PrivateKey == nil {
+		return Key{}, errors.New("No active key")
+	}
+	return key, nil
+}
+
+// Key returns the key of the kid
+func (s *KeySet) Key(id string) (Key, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	key, ok := s.keys[id]
+	return key, ok
+}
+
+// Keys returns the keys ordered by their IDs
+func (s *KeySet) Keys() []Key {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	keys := make([]Key, 0, len(s.keys))
+	for _, key := range s.keys {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].ID < keys[j].ID })
+	return keys
+}
@@ -0,0 +1,173 @@
+package security_test
+
+import (
+	"crypto/rsa"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bitrise-io/api-utils/security"
+)
+
+func tokenKeyID(t *testing.T, token string) interface{} {
+	parsed, _, err := new(jwt.Parser).ParseUnverified(token, jwt.MapClaims{})
+	require.NoError(t, err)
+	return parsed.Header["kid"]
+}
+
+func Test_ParseKeyPEM(t *testing.T) {
+	publicKeyPEM, privateKeyPEM := generateRSAKeyPEM(t)
+
+	t.Log("ok - private key")
+	{
+		key, err := security.ParseKeyPEM("key-1", []byte(privateKeyPEM))
+		require.NoError(t, err)
+		require.Equal(t, "key-1", key.ID)
+		require.NotNil(t, key.PrivateKey)
+		require.IsType(t, &rsa.PublicKey{}, key.PublicKey)
+	}
+	t.Log("ok - public key")
+	{
+		key, err := security.ParseKeyPEM("key-1", []byte(publicKeyPEM))
+		require.NoError(t, err)
+		require.Nil(t, key.PrivateKey)
+		require.IsType(t, &rsa.PublicKey{}, key.PublicKey)
+	}
+	t.Log("not ok - not PEM")
+	{
+		_, err := security.ParseKeyPEM("key-1", []byte("secret"))
+		require.EqualError(t, err, "Failed to decode PEM of key key-1")
+	}
+}
+
+func Test_KeySet_Rotation(t *testing.T) {
+	_, privateKey1 := generateRSAKeyPEM(t)
+	_, privateKey2 := generateRSAKeyPEM(t)
+	key1, err := security.ParseKeyPEM("key-1", []byte(privateKey1))
+	require.NoError(t, err)
+	key2, err := security.ParseKeyPEM("key-2", []byte(privateKey2))
+	require.NoError(t, err)
+
+	keys, err := security.NewKeySet(key1)
+	require.NoError(t, err)
+	require.NoError(t, keys.Activate("key-1"))
+	service := security.NewJWTServiceWithKeySet(keys, security.JWTConfig{Expiration: time.Hour})
+
+	oldToken, err := service.SignClaims(&buildClaims{})
+	require.NoError(t, err)
+	require.Equal(t, "key-1", tokenKeyID(t, oldToken))
+
+	t.Log("ok - tokens of the previous key are accepted after activating the new one")
+	{
+		require.NoError(t, keys.Add(key2))
+		require.NoError(t, keys.Activate("key-2"))
+		newToken, err := service.SignClaims(&buildClaims{})
+		require.NoError(t, err)
+		require.Equal(t, "key-2", tokenKeyID(t, newToken))
+
+		require.NoError(t, service.ParseClaims(oldToken, &buildClaims{}))
+		require.NoError(t, service.ParseClaims(newToken, &buildClaims{}))
+	}
+	t.Log("not ok - the active key can't be retired")
+	{
+		require.EqualError(t, keys.Retire("key-2"), "Key key-2 is active")
+	}
+	t.Log("not ok - tokens of a retired key")
+	{
+		require.NoError(t, keys.Retire("key-1"))
+		require.EqualError(t, service.ParseClaims(oldToken, &buildClaims{}), "Token has invalid signature: Unknown key key-1")
+	}
+	t.Log("not ok - duplicate key")
+	{
+		require.EqualError(t, keys.Add(key2), "Key key-2 already exists")
+	}
+	t.Log("not ok - public key can't be activated")
+	{
+		publicKeyPEM, _ := generateRSAKeyPEM(t)
+		publicKey, err := security.ParseKeyPEM("key-3", []byte(publicKeyPEM))
+		require.NoError(t, err)
+		require.NoError(t, keys.Add(publicKey))
+		require.EqualError(t, keys.Activate("key-3"), "Key key-3 has no private key")
+	}
+}
+
+func Test_LoadKeySet(t *testing.T) {
+	publicKey1, _ := generateRSAKeyPEM(t)
+	_, privateKey2 := generateRSAKeyPEM(t)
+
+	t.Log("ok - from directory")
+	{
+		dir, err := ioutil.TempDir("", "keys")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "key-1.pem"), []byte(publicKey1), 0600))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "key-2.pem"), []byte(privateKey2), 0600))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "README"), []byte("keys"), 0600))
+
+		keys, err := security.LoadKeySetFromDir(dir, "key-2")
+		require.NoError(t, err)
+		require.Len(t, keys.Keys(), 2)
+		active, err := keys.ActiveKey()
+		require.NoError(t, err)
+		require.Equal(t, "key-2", active.ID)
+	}
+	t.Log("ok - from environment")
+	{
+		require.NoError(t, os.Setenv("JWT_KEY_2020_01", publicKey1))
+		defer os.Unsetenv("JWT_KEY_2020_01")
+		require.NoError(t, os.Setenv("JWT_KEY_2020_02", privateKey2))
+		defer os.Unsetenv("JWT_KEY_2020_02")
+		require.NoError(t, os.Setenv("JWT_ACTIVE_KEY", "2020_02"))
+		defer os.Unsetenv("JWT_ACTIVE_KEY")
+
+		keys, err := security.LoadKeySetFromEnv()
+		require.NoError(t, err)
+		require.Len(t, keys.Keys(), 2)
+		active, err := keys.ActiveKey()
+		require.NoError(t, err)
+		require.Equal(t, "2020_02", active.ID)
+	}
+	t.Log("not ok - unknown active key")
+	{
+		dir, err := ioutil.TempDir("", "keys")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+
+		_, err = security.LoadKeySetFromDir(dir, "key-1")
+		require.EqualError(t, err, "No key key-1")
+	}
+}
+
+func Test_KeySet_JWKSHandler(t *testing.T) {
+	_, privateKey := generateRSAKeyPEM(t)
+	key, err := security.ParseKeyPEM("key-1", []byte(privateKey))
+	require.NoError(t, err)
+	keys, err := security.NewKeySet(key)
+	require.NoError(t, err)
+
+	t.Log("ok - public keys")
+	{
+		w := httptest.NewRecorder()
+		keys.JWKSHandler(5*time.Minute).ServeHTTP(w, httptest.NewRequest("GET", "/.well-known/jwks.json", nil))
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, "public, max-age=300", w.Header().Get("Cache-Control"))
+
+		jwks := security.JWKS{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &jwks))
+		require.Len(t, jwks.Keys, 1)
+		require.Equal(t, "RSA", jwks.Keys[0].KeyType)
+		require.Equal(t, "key-1", jwks.Keys[0].KeyID)
+		require.Equal(t, "RS256", jwks.Keys[0].Algorithm)
+		require.Equal(t, "AQAB", jwks.Keys[0].E)
+		require.NotEmpty(t, jwks.Keys[0].N)
+		require.NotContains(t, w.Body.String(), `"d"`)
+	}
+}
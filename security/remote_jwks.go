@@ -0,0 +1,279 @@
+package security
+
+import (
+	"context"
+	"crypto"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bitrise-io/api-utils/httpresponse"
+	"github.com/bitrise-io/api-utils/logging"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultJWKSCacheDuration      = time.Hour
+	defaultJWKSMaxCacheDuration   = 24 * time.Hour
+	defaultJWKSMinRefreshInterval = 30 * time.Second
+	defaultJWKSMaxStaleDuration   = time.Hour
+	defaultJWKSTimeout            = 10 * time.Second
+	maxJWKSSize                   = 1 << 20
+)
+
+// RemoteJWKSConfig ...
+type RemoteJWKSConfig struct {
+	// URL of the JWKS, e.g. https://id.example.com/.well-known/jwks.json
+	URL string
+	// Client defaults to an http.Client with a 10 seconds timeout
+	Client *http.Client
+	// Timeout of a fetch, defaults to the Client's Timeout, or 10 seconds if it has none
+	Timeout time.Duration
+	// CacheDuration of the keys if the response has no Cache-Control max-age, defaults
+	// to 1 hour. A max-age above MaxCacheDuration, 24 hours by default, is capped.
+	CacheDuration    time.Duration
+	MaxCacheDuration time.Duration
+	// MinRefreshInterval limits the fetches, e.g. of tokens with unknown kids,
+	// defaults to 30 seconds
+	MinRefreshInterval time.Duration
+	// MaxStaleDuration limits how long the keys are used after they expired while the
+	// JWKS can't be refreshed, defaults to 1 hour
+	MaxStaleDuration time.Duration
+	// Issuer, Audience and Leeway are checked like by the JWTService
+	Issuer   string
+	Audience []string
+	Leeway   time.Duration
+}
+
+type remoteKey struct {
+	publicKey  crypto.PublicKey
+	algorithms []string
+}
+
+// jwksFetch is a fetch in progress, the verifications needing it wait for done
+type jwksFetch struct {
+	done chan struct{}
+}
+
+// RemoteJWKSVerifier verifies tokens with the keys of a remote JWKS, e.g. of an identity
+// provider. The keys are cached, and fetched again when they expire or when a token has
+// an unknown kid, but at most once per MinRefreshInterval.
+type RemoteJWKSVerifier struct {
+	config RemoteJWKSConfig
+
+	mu        sync.Mutex
+	keys      map[string]remoteKey
+	fetchedAt time.Time
+	expiresAt time.Time
+	fetchErr  error
+	fetching  *jwksFetch
+}
+
+// NewRemoteJWKSVerifier ...
+func NewRemoteJWKSVerifier(config RemoteJWKSConfig) *RemoteJWKSVerifier {
+	if config.Client == nil {
+		config.Client = &http.Client{Timeout: defaultJWKSTimeout}
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = config.Client.Timeout
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = defaultJWKSTimeout
+	}
+	if config.CacheDuration == 0 {
+		config.CacheDuration = defaultJWKSCacheDuration
+	}
+	if config.MaxCacheDuration == 0 {
+		config.MaxCacheDuration = defaultJWKSMaxCacheDuration
+	}
+	if config.MinRefreshInterval == 0 {
+		config.MinRefreshInterval = defaultJWKSMinRefreshInterval
+	}
+	if config.MaxStaleDuration == 0 {
+		config.MaxStaleDuration = defaultJWKSMaxStaleDuration
+	}
+	return &RemoteJWKSVerifier{config: config}
+}
+
+// ParseClaims verifies the token with the key of its kid, checks its issuer, audience
+// and times, and decodes its claims into claims. A token without a kid is accepted
+// only if the JWKS has a single key.
+func (v *RemoteJWKSVerifier) ParseClaims(ctx context.Context, jwtToken string, claims Claims) error {
+	parser := &jwt.Parser{SkipClaimsValidation: true}
+	_, err := parser.ParseWithClaims(jwtToken, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		key, err := v.key(ctx, kid)
+		if err != nil {
+			return nil, err
+		}
+		if !containsAlgorithm(key.algorithms, token.Method.Alg()) {
+			return nil, &TokenError{Reason: ErrTokenSignatureInvalid, Err: errors.Errorf("Signing method %s is not allowed for key %s", token.Method.Alg(), kid)}
+		}
+		return key.publicKey, nil
+	})
+	if err != nil {
+		return tokenError(err)
+	}
+	config := JWTConfig{Issuer: v.config.Issuer, Audience: v.config.Audience, Leeway: v.config.Leeway}
+	return validateClaims(config, claims.Registered(), time.Now())
+}
+
+func (v *RemoteJWKSVerifier) key(ctx context.Context, kid string) (remoteKey, error) {
+	v.mu.Lock()
+	if key, ok := v.lookup(kid); ok && time.Now().Before(v.expiresAt) {
+		v.mu.Unlock()
+		return key, nil
+	}
+	fetch := v.fetching
+	if fetch == nil && time.Since(v.fetchedAt) >= v.config.MinRefreshInterval {
+		fetch = &jwksFetch{done: make(chan struct{})}
+		v.fetching = fetch
+		v.fetchedAt = time.Now()
+		go v.refresh(fetch)
+	}
+	v.mu.Unlock()
+
+	if fetch != nil {
+		// the fetch isn't cancelled with ctx, the other verifications can still use it
+		select {
+		case <-fetch.done:
+		case <-ctx.Done():
+			return remoteKey{}, errors.Wrap(ctx.Err(), "Failed to fetch JWKS")
+		}
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	key, ok := v.lookup(kid)
+	switch {
+	case ok && time.Now().Before(v.expiresAt.Add(v.config.MaxStaleDuration)):
+		return key, nil
+	case ok && v.fetchErr != nil:
+		return remoteKey{}, errors.Wrap(v.fetchErr, "JWKS expired")
+	case ok:
+		return remoteKey{}, errors.New("JWKS expired")
+	case v.keys == nil && v.fetchErr != nil:
+		return remoteKey{}, v.fetchErr
+	case v.fetchErr != nil:
+		// the kid can be of a new key which couldn't be fetched, the token isn't rejected
+		return remoteKey{}, errors.Wrapf(v.fetchErr, "Unknown key %s", kid)
+	}
+	return remoteKey{}, &TokenError{Reason: ErrTokenSignatureInvalid, Err: errors.Errorf("Unknown key %s", kid)}
+}
+
+func (v *RemoteJWKSVerifier) lookup(kid string) (remoteKey, bool) {
+	if kid == "" && len(v.keys) == 1 {
+		for _, key := range v.keys {
+			return key, true
+		}
+	}
+	key, ok := v.keys[kid]
+	return key, ok
+}
+
+// refresh fetches the keys with its own timeout, independently of the verifications
+// waiting for it
+func (v *RemoteJWKSVerifier) refresh(fetch *jwksFetch) {
+	defer close(fetch.done)
+	ctx, cancel := context.WithTimeout(context.Background(), v.config.Timeout)
+	defer cancel()
+	start := time.Now()
+	keys, cacheDuration, err := v.fetch(ctx)
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.fetching = nil
+	v.fetchErr = err
+	if err != nil {
+		if v.keys != nil {
+			// the cached keys are still used for MaxStaleDuration, the identity provider
+			// can be down for a while
+			logging.WithContext(nil).Warn("Failed to refresh JWKS", zap.String("url", v.config.URL), zap.Error(err))
+		}
+		return
+	}
+	v.keys = keys
+	v.expiresAt = start.Add(cacheDuration)
+}
+
+func (v *RemoteJWKSVerifier) fetch(ctx context.Context) (map[string]remoteKey, time.Duration, error) {
+	req, err := http.NewRequest("GET", v.config.URL, nil)
+	if err != nil {
+		return nil, 0, errors.WithStack(err)
+	}
+	resp, err := v.config.Client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "Failed to fetch JWKS")
+	}
+	defer httpresponse.BodyCloseWithErrorLog(resp)
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, errors.Errorf("Failed to fetch JWKS: %s", resp.Status)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxJWKSSize+1))
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "Failed to read JWKS")
+	}
+	if len(body) > maxJWKSSize {
+		return nil, 0, errors.New("JWKS is too large")
+	}
+	jwks := JWKS{}
+	if err := json.Unmarshal(body, &jwks); err != nil {
+		return nil, 0, errors.Wrap(err, "Failed to decode JWKS")
+	}
+
+	keys := map[string]remoteKey{}
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		publicKey, err := jwk.PublicKey()
+		if err != nil {
+			// the other keys can still be used, e.g. if one has an unsupported type
+			logging.WithContext(ctx).Warn("Skipping JWKS key", zap.String("url", v.config.URL), zap.Error(err))
+			continue
+		}
+		algorithms := keyAlgorithms(publicKey)
+		if jwk.Algorithm != "" {
+			if !containsAlgorithm(algorithms, jwk.Algorithm) {
+				logging.WithContext(ctx).Warn("Skipping JWKS key", zap.String("url", v.config.URL), zap.String("kid", jwk.KeyID), zap.String("alg", jwk.Algorithm))
+				continue
+			}
+			algorithms = []string{jwk.Algorithm}
+		}
+		keys[jwk.KeyID] = remoteKey{publicKey: publicKey, algorithms: algorithms}
+	}
+	return keys, v.cacheDuration(resp.Header.Get("Cache-Control")), nil
+}
+
+// cacheDuration returns the max-age of the Cache-Control header capped by MaxCacheDuration,
+// 0 if the response shouldn't be cached, and CacheDuration if there's no max-age
+func (v *RemoteJWKSVerifier) cacheDuration(cacheControl string) time.Duration {
+	for _, directive := range strings.Split(cacheControl, ",") {
+		directive = strings.ToLower(strings.TrimSpace(directive))
+		if directive == "no-store" || directive == "no-cache" {
+			return 0
+		}
+	}
+	for _, directive := range strings.Split(cacheControl, ",") {
+		directive = strings.ToLower(strings.TrimSpace(directive))
+		if !strings.HasPrefix(directive, "max-age=") {
+			continue
+		}
+		seconds, err := strconv.ParseInt(strings.TrimPrefix(directive, "max-age="), 10, 64)
+		if err != nil || seconds < 0 {
+			break
+		}
+		if seconds >= int64(v.config.MaxCacheDuration/time.Second) {
+			return v.config.MaxCacheDuration
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	return v.config.CacheDuration
+}
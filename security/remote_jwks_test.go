@@ -0,0 +1,291 @@
+package security_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bitrise-io/api-utils/security"
+)
+
+type jwksServer struct {
+	*httptest.Server
+
+	mu           sync.Mutex
+	keys         []security.JWK
+	cacheControl string
+	requests     int
+	// blocked holds the responses until it's closed
+	blocked chan struct{}
+}
+
+func newJWKSServer(t *testing.T) *jwksServer {
+	s := &jwksServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.requests++
+		blocked := s.blocked
+		s.mu.Unlock()
+		if blocked != nil {
+			<-blocked
+		}
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.cacheControl != "" {
+			w.Header().Set("Cache-Control", s.cacheControl)
+		}
+		require.NoError(t, json.NewEncoder(w).Encode(security.JWKS{Keys: s.keys}))
+	}))
+	return s
+}
+
+func (s *jwksServer) block() chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.blocked = make(chan struct{})
+	return s.blocked
+}
+
+func (s *jwksServer) addKey(t *testing.T, id string, publicKey interface{}) {
+	jwk, err := security.NewJWK(security.Key{ID: id, PublicKey: publicKey})
+	require.NoError(t, err)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys = append(s.keys, jwk)
+}
+
+func (s *jwksServer) requestCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+func signToken(t *testing.T, method jwt.SigningMethod, kid string, key interface{}, claims jwt.Claims) string {
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	signed, err := token.SignedString(key)
+	require.NoError(t, err)
+	return signed
+}
+
+func Test_RemoteJWKSVerifier(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	edPublicKey, edPrivateKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	server := newJWKSServer(t)
+	defer server.Close()
+	server.addKey(t, "rsa", &rsaKey.PublicKey)
+	server.addKey(t, "ec", &ecKey.PublicKey)
+	server.addKey(t, "ed", edPublicKey)
+	server.cacheControl = "public, max-age=300"
+
+	verifier := security.NewRemoteJWKSVerifier(security.RemoteJWKSConfig{
+		URL:                server.URL,
+		Issuer:             "https://id.example.com",
+		Audience:           []string{"build-service"},
+		MinRefreshInterval: time.Hour,
+	})
+	claims := func() *buildClaims {
+		return &buildClaims{
+			RegisteredClaims: security.RegisteredClaims{
+				Issuer:    "https://id.example.com",
+				Audience:  security.Audience{"build-service"},
+				Subject:   "user-1",
+				ExpiresAt: time.Now().Add(time.Minute).Unix(),
+			},
+			AppSlug: "app-1",
+		}
+	}
+
+	t.Log("ok - RSA, ECDSA and Ed25519 keys")
+	{
+		for _, token := range []string{
+			signToken(t, jwt.SigningMethodRS256, "rsa", rsaKey, claims()),
+			signToken(t, jwt.SigningMethodES256, "ec", ecKey, claims()),
+			signToken(t, security.SigningMethodEdDSA, "ed", edPrivateKey, claims()),
+		} {
+			parsed := &buildClaims{}
+			require.NoError(t, verifier.ParseClaims(context.Background(), token, parsed))
+			require.Equal(t, "user-1", parsed.Subject)
+			require.Equal(t, "app-1", parsed.AppSlug)
+		}
+		require.Equal(t, 1, server.requestCount())
+	}
+	t.Log("not ok - algorithm of an other key type")
+	{
+		token := signToken(t, jwt.SigningMethodHS256, "rsa", []byte("secret"), claims())
+		require.EqualError(t, verifier.ParseClaims(context.Background(), token, &buildClaims{}), "Token has invalid signature: Signing method HS256 is not allowed for key rsa")
+	}
+	t.Log("not ok - signed with an other key")
+	{
+		otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		require.NoError(t, err)
+		token := signToken(t, jwt.SigningMethodES256, "ec", otherKey, claims())
+		require.EqualError(t, verifier.ParseClaims(context.Background(), token, &buildClaims{}), "Token has invalid signature: crypto/ecdsa: verification error")
+	}
+	t.Log("not ok - wrong audience")
+	{
+		c := claims()
+		c.Audience = security.Audience{"other-service"}
+		token := signToken(t, jwt.SigningMethodRS256, "rsa", rsaKey, c)
+		require.EqualError(t, verifier.ParseClaims(context.Background(), token, &buildClaims{}), "Token has invalid audience")
+	}
+	t.Log("not ok - unknown kid refetches once per refresh interval")
+	{
+		token := signToken(t, jwt.SigningMethodRS256, "unknown", rsaKey, claims())
+		require.EqualError(t, verifier.ParseClaims(context.Background(), token, &buildClaims{}), "Token has invalid signature: Unknown key unknown")
+		require.Equal(t, 1, server.requestCount())
+	}
+}
+
+func Test_RemoteJWKSVerifier_Refresh(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	newKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	require.NoError(t, err)
+
+	t.Log("ok - unknown kid is fetched")
+	{
+		server := newJWKSServer(t)
+		defer server.Close()
+		server.addKey(t, "old", &rsaKey.PublicKey)
+		server.cacheControl = "max-age=3600"
+		verifier := security.NewRemoteJWKSVerifier(security.RemoteJWKSConfig{URL: server.URL, MinRefreshInterval: time.Nanosecond})
+
+		require.NoError(t, verifier.ParseClaims(context.Background(), signToken(t, jwt.SigningMethodRS256, "old", rsaKey, &buildClaims{}), &buildClaims{}))
+		server.addKey(t, "new", &newKey.PublicKey)
+		require.NoError(t, verifier.ParseClaims(context.Background(), signToken(t, jwt.SigningMethodES384, "new", newKey, &buildClaims{}), &buildClaims{}))
+		require.NoError(t, verifier.ParseClaims(context.Background(), signToken(t, jwt.SigningMethodRS256, "old", rsaKey, &buildClaims{}), &buildClaims{}))
+		require.Equal(t, 2, server.requestCount())
+	}
+	t.Log("ok - no-store responses are fetched again")
+	{
+		server := newJWKSServer(t)
+		defer server.Close()
+		server.addKey(t, "old", &rsaKey.PublicKey)
+		server.cacheControl = "no-store"
+		verifier := security.NewRemoteJWKSVerifier(security.RemoteJWKSConfig{URL: server.URL, MinRefreshInterval: time.Nanosecond})
+
+		token := signToken(t, jwt.SigningMethodRS256, "", rsaKey, &buildClaims{})
+		require.NoError(t, verifier.ParseClaims(context.Background(), token, &buildClaims{}))
+		require.NoError(t, verifier.ParseClaims(context.Background(), token, &buildClaims{}))
+		require.Equal(t, 2, server.requestCount())
+	}
+	t.Log("ok - cached keys are used if the refresh fails")
+	{
+		server := newJWKSServer(t)
+		server.addKey(t, "old", &rsaKey.PublicKey)
+		server.cacheControl = "no-store"
+		verifier := security.NewRemoteJWKSVerifier(security.RemoteJWKSConfig{URL: server.URL, MinRefreshInterval: time.Nanosecond})
+
+		token := signToken(t, jwt.SigningMethodRS256, "old", rsaKey, &buildClaims{})
+		require.NoError(t, verifier.ParseClaims(context.Background(), token, &buildClaims{}))
+		server.Close()
+		require.NoError(t, verifier.ParseClaims(context.Background(), token, &buildClaims{}))
+	}
+	t.Log("not ok - cached keys are used for MaxStaleDuration if the refresh fails")
+	{
+		server := newJWKSServer(t)
+		server.addKey(t, "old", &rsaKey.PublicKey)
+		server.cacheControl = "no-store"
+		verifier := security.NewRemoteJWKSVerifier(security.RemoteJWKSConfig{URL: server.URL, MinRefreshInterval: time.Nanosecond, MaxStaleDuration: 50 * time.Millisecond})
+
+		token := signToken(t, jwt.SigningMethodRS256, "old", rsaKey, &buildClaims{})
+		require.NoError(t, verifier.ParseClaims(context.Background(), token, &buildClaims{}))
+		server.Close()
+		require.NoError(t, verifier.ParseClaims(context.Background(), token, &buildClaims{}))
+		time.Sleep(100 * time.Millisecond)
+		err := verifier.ParseClaims(context.Background(), token, &buildClaims{})
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "JWKS expired: Failed to fetch JWKS")
+	}
+	t.Log("not ok - unknown kid when the refresh fails")
+	{
+		server := newJWKSServer(t)
+		server.addKey(t, "old", &rsaKey.PublicKey)
+		server.cacheControl = "no-store"
+		verifier := security.NewRemoteJWKSVerifier(security.RemoteJWKSConfig{URL: server.URL, MinRefreshInterval: time.Nanosecond})
+
+		require.NoError(t, verifier.ParseClaims(context.Background(), signToken(t, jwt.SigningMethodRS256, "old", rsaKey, &buildClaims{}), &buildClaims{}))
+		server.Close()
+		err := verifier.ParseClaims(context.Background(), signToken(t, jwt.SigningMethodES384, "new", newKey, &buildClaims{}), &buildClaims{})
+		require.Error(t, err)
+		_, isTokenErr := err.(*security.TokenError)
+		require.False(t, isTokenErr, "%T", err)
+		require.Contains(t, err.Error(), "Unknown key new: Failed to fetch JWKS")
+	}
+	t.Log("not ok - fetch times out")
+	{
+		server := newJWKSServer(t)
+		server.addKey(t, "old", &rsaKey.PublicKey)
+		blocked := server.block()
+		defer server.Close()
+		defer close(blocked)
+		verifier := security.NewRemoteJWKSVerifier(security.RemoteJWKSConfig{URL: server.URL, Client: &http.Client{}, Timeout: 50 * time.Millisecond})
+
+		err := verifier.ParseClaims(context.Background(), signToken(t, jwt.SigningMethodRS256, "old", rsaKey, &buildClaims{}), &buildClaims{})
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "context deadline exceeded")
+	}
+	t.Log("ok - concurrent verifications share a fetch, which isn't cancelled with them")
+	{
+		server := newJWKSServer(t)
+		defer server.Close()
+		server.addKey(t, "old", &rsaKey.PublicKey)
+		server.cacheControl = "max-age=3600"
+		blocked := server.block()
+		verifier := security.NewRemoteJWKSVerifier(security.RemoteJWKSConfig{URL: server.URL})
+		token := signToken(t, jwt.SigningMethodRS256, "old", rsaKey, &buildClaims{})
+
+		cancelled, cancel := context.WithCancel(context.Background())
+		cancelledErr := make(chan error, 1)
+		go func() { cancelledErr <- verifier.ParseClaims(cancelled, token, &buildClaims{}) }()
+		require.Eventually(t, func() bool { return server.requestCount() == 1 }, 5*time.Second, time.Millisecond)
+		errs := make(chan error, 3)
+		for i := 0; i < 3; i++ {
+			go func() { errs <- verifier.ParseClaims(context.Background(), token, &buildClaims{}) }()
+		}
+
+		cancel()
+		select {
+		case err := <-cancelledErr:
+			require.EqualError(t, err, "Failed to fetch JWKS: context canceled")
+		case <-time.After(5 * time.Second):
+			t.Fatal("cancelled verification is still waiting")
+		}
+		close(blocked)
+		for i := 0; i < 3; i++ {
+			require.NoError(t, <-errs)
+		}
+		require.NoError(t, verifier.ParseClaims(context.Background(), token, &buildClaims{}))
+		require.Equal(t, 1, server.requestCount())
+	}
+	t.Log("not ok - JWKS unavailable")
+	{
+		server := httptest.NewServer(http.NotFoundHandler())
+		defer server.Close()
+		verifier := security.NewRemoteJWKSVerifier(security.RemoteJWKSConfig{URL: server.URL})
+
+		token := signToken(t, jwt.SigningMethodRS256, "old", rsaKey, &buildClaims{})
+		require.EqualError(t, verifier.ParseClaims(context.Background(), token, &buildClaims{}), "Failed to fetch JWKS: 404 Not Found")
+	}
+}
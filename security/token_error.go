@@ -0,0 +1,88 @@
+package security
+
+import (
+	"github.com/dgrijalva/jwt-go"
+	"github.com/pkg/errors"
+)
+
+// The reasons of the token verification failures, use errors.Is to check them
+var (
+	ErrTokenMalformed        = errors.New("Token is malformed")
+	ErrTokenSignatureInvalid = errors.New("Token has invalid signature")
+	ErrTokenExpired          = errors.New("Token is expired")
+	ErrTokenNotValidYet      = errors.New("Token is not valid yet")
+	ErrTokenIssuedInFuture   = errors.New("Token is issued in the future")
+	ErrTokenInvalidIssuer    = errors.New("Token has invalid issuer")
+	ErrTokenInvalidAudience  = errors.New("Token has invalid audience")
+)
+
+// TokenError is returned when a token is rejected, it should be an unauthorized response.
+// The other errors of the verification, e.g. failing to fetch a JWKS, aren't caused by the
+// token.
+type TokenError struct {
+	// Reason is one of the ErrToken errors
+	Reason error
+	// Err is the cause, it can be nil
+	Err error
+}
+
+func (e *TokenError) Error() string {
+	if e.Err == nil {
+		return e.Reason.Error()
+	}
+	return e.Reason.Error() + ": " + e.Err.Error()
+}
+
+// Is reports whether the reason is target
+func (e *TokenError) Is(target error) bool {
+	return e.Reason == target
+}
+
+// Unwrap ...
+func (e *TokenError) Unwrap() error {
+	return e.Err
+}
+
+// tokenError converts the errors of jwt-go to TokenErrors
+func tokenError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*TokenError); ok {
+		return err
+	}
+	validationErr, ok := err.(*jwt.ValidationError)
+	if !ok {
+		return err
+	}
+	if inner, ok := validationErr.Inner.(*TokenError); ok {
+		return inner
+	}
+
+	switch {
+	case validationErr.Errors&jwt.ValidationErrorMalformed != 0:
+		return &TokenError{Reason: ErrTokenMalformed, Err: validationErr.Inner}
+	case validationErr.Errors&jwt.ValidationErrorUnverifiable != 0 && validationErr.Inner != nil:
+		// the key couldn't be looked up, it's not a problem of the token
+		return errors.WithStack(validationErr.Inner)
+	case validationErr.Errors&jwt.ValidationErrorUnverifiable != 0:
+		// e.g. an unknown algorithm
+		return &TokenError{Reason: ErrTokenSignatureInvalid, Err: validationErr}
+	case validationErr.Errors&jwt.ValidationErrorSignatureInvalid != 0:
+		if validationErr.Inner == nil {
+			return &TokenError{Reason: ErrTokenSignatureInvalid, Err: validationErr}
+		}
+		return &TokenError{Reason: ErrTokenSignatureInvalid, Err: validationErr.Inner}
+	case validationErr.Errors&jwt.ValidationErrorExpired != 0:
+		return &TokenError{Reason: ErrTokenExpired}
+	case validationErr.Errors&jwt.ValidationErrorNotValidYet != 0:
+		return &TokenError{Reason: ErrTokenNotValidYet}
+	case validationErr.Errors&jwt.ValidationErrorIssuedAt != 0:
+		return &TokenError{Reason: ErrTokenIssuedInFuture}
+	case validationErr.Errors&jwt.ValidationErrorIssuer != 0:
+		return &TokenError{Reason: ErrTokenInvalidIssuer}
+	case validationErr.Errors&jwt.ValidationErrorAudience != 0:
+		return &TokenError{Reason: ErrTokenInvalidAudience}
+	}
+	return &TokenError{Reason: ErrTokenMalformed, Err: err}
+}
@@ -0,0 +1,178 @@
+package security_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bitrise-io/api-utils/security"
+)
+
+func requireTokenError(t *testing.T, err error, reason error) {
+	tokenErr := &security.TokenError{}
+	require.True(t, errors.As(err, &tokenErr), "%v", err)
+	require.True(t, errors.Is(err, reason), "%v", err)
+}
+
+func Test_JWTService_Algorithms(t *testing.T) {
+	ecKey256, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	ecKey384, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	require.NoError(t, err)
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	edKeyDER, err := x509.MarshalPKCS8PrivateKey(edKey)
+	require.NoError(t, err)
+	edKeyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: edKeyDER})
+	ecKeyDER, err := x509.MarshalECPrivateKey(ecKey384)
+	require.NoError(t, err)
+	ecKeyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: ecKeyDER})
+
+	es384Key, err := security.ParseKeyPEM("es384", ecKeyPEM)
+	require.NoError(t, err)
+	edDSAKey, err := security.ParseKeyPEM("eddsa", edKeyPEM)
+	require.NoError(t, err)
+	keys, err := security.NewKeySet(security.Key{ID: "es256", PrivateKey: ecKey256}, es384Key, edDSAKey)
+	require.NoError(t, err)
+	service := security.NewJWTServiceWithKeySet(keys, security.JWTConfig{Expiration: time.Hour})
+
+	for kid, alg := range map[string]string{"es256": "ES256", "es384": "ES384", "eddsa": "EdDSA"} {
+		t.Log("ok - " + alg)
+		{
+			require.NoError(t, keys.Activate(kid))
+			token, err := service.SignClaims(&buildClaims{AppSlug: "app-1"})
+			require.NoError(t, err)
+			parsed, _, err := new(jwt.Parser).ParseUnverified(token, jwt.MapClaims{})
+			require.NoError(t, err)
+			require.Equal(t, alg, parsed.Header["alg"])
+
+			claims := &buildClaims{}
+			require.NoError(t, service.ParseClaims(token, claims))
+			require.Equal(t, "app-1", claims.AppSlug)
+		}
+	}
+	t.Log("ok - JWKS publishes the algorithms")
+	{
+		jwks, err := keys.JWKS()
+		require.NoError(t, err)
+		encoded, err := json.Marshal(jwks)
+		require.NoError(t, err)
+		require.Contains(t, string(encoded), `"kty":"EC","kid":"es256","use":"sig","alg":"ES256","crv":"P-256"`)
+		require.Contains(t, string(encoded), `"kty":"EC","kid":"es384","use":"sig","alg":"ES384","crv":"P-384"`)
+		require.Contains(t, string(encoded), `"kty":"OKP","kid":"eddsa","use":"sig","alg":"EdDSA","crv":"Ed25519"`)
+	}
+	t.Log("not ok - algorithm of an other key")
+	{
+		token := signToken(t, jwt.SigningMethodES384, "es256", ecKey384, &buildClaims{})
+		err := service.ParseClaims(token, &buildClaims{})
+		requireTokenError(t, err, security.ErrTokenSignatureInvalid)
+		require.EqualError(t, err, "Token has invalid signature: Signing method ES384 is not allowed for key es256")
+	}
+	t.Log("not ok - unsigned token")
+	{
+		token := signToken(t, jwt.SigningMethodNone, "es256", jwt.UnsafeAllowNoneSignatureType, &buildClaims{})
+		requireTokenError(t, service.ParseClaims(token, &buildClaims{}), security.ErrTokenSignatureInvalid)
+	}
+	t.Log("not ok - algorithm unsupported by the key")
+	{
+		require.EqualError(t, keys.Add(security.Key{ID: "rs256", PrivateKey: ecKey256, Algorithms: []string{"RS256"}}), "Algorithm RS256 is not supported by key rs256")
+	}
+}
+
+func Test_JWTService_AlgorithmConfusion(t *testing.T) {
+	publicKey, privateKey := generateRSAKeyPEM(t)
+	service, err := security.NewJWTService(publicKey, privateKey, time.Hour)
+	require.NoError(t, err)
+	// HMAC signed with the public key, which verifiers using the key for any algorithm accept
+	token := signToken(t, jwt.SigningMethodHS256, "", []byte(publicKey), jwt.MapClaims{"token": "auth-token"})
+
+	t.Log("not ok - Verify")
+	{
+		valid, err := service.Verify(token)
+		require.False(t, valid)
+		requireTokenError(t, err, security.ErrTokenSignatureInvalid)
+	}
+	t.Log("not ok - GetToken")
+	{
+		_, err := service.GetToken(token)
+		requireTokenError(t, err, security.ErrTokenSignatureInvalid)
+	}
+	t.Log("ok - RS256 token")
+	{
+		signed, err := service.Sign("auth-token")
+		require.NoError(t, err)
+		authToken, err := service.GetToken(signed)
+		require.NoError(t, err)
+		require.Equal(t, "auth-token", authToken)
+	}
+}
+
+func Test_TokenError(t *testing.T) {
+	publicKey, privateKey := generateRSAKeyPEM(t)
+	service, err := security.NewJWTServiceWithConfig(publicKey, privateKey, security.JWTConfig{Audience: []string{"build-service"}})
+	require.NoError(t, err)
+
+	t.Log("not ok - expired")
+	{
+		token, err := service.SignClaims(&buildClaims{RegisteredClaims: security.RegisteredClaims{ExpiresAt: time.Now().Add(-time.Minute).Unix()}})
+		require.NoError(t, err)
+		requireTokenError(t, service.ParseClaims(token, &buildClaims{}), security.ErrTokenExpired)
+	}
+	t.Log("not ok - expired legacy token")
+	{
+		legacy, err := security.NewJWTService(publicKey, privateKey, -time.Minute)
+		require.NoError(t, err)
+		token, err := legacy.Sign("auth-token")
+		require.NoError(t, err)
+		_, err = service.Verify(token)
+		requireTokenError(t, err, security.ErrTokenExpired)
+	}
+	t.Log("not ok - not valid yet")
+	{
+		token, err := service.SignClaims(&buildClaims{RegisteredClaims: security.RegisteredClaims{NotBefore: time.Now().Add(time.Minute).Unix()}})
+		require.NoError(t, err)
+		requireTokenError(t, service.ParseClaims(token, &buildClaims{}), security.ErrTokenNotValidYet)
+	}
+	t.Log("not ok - wrong audience")
+	{
+		token, err := service.SignClaims(&buildClaims{RegisteredClaims: security.RegisteredClaims{Audience: security.Audience{"other-service"}}})
+		require.NoError(t, err)
+		requireTokenError(t, service.ParseClaims(token, &buildClaims{}), security.ErrTokenInvalidAudience)
+	}
+	t.Log("not ok - bad signature")
+	{
+		token, err := service.SignClaims(&buildClaims{})
+		require.NoError(t, err)
+		requireTokenError(t, service.ParseClaims(token[:len(token)-4]+"AAAA", &buildClaims{}), security.ErrTokenSignatureInvalid)
+	}
+	t.Log("not ok - malformed")
+	{
+		requireTokenError(t, service.ParseClaims("not-a-token", &buildClaims{}), security.ErrTokenMalformed)
+	}
+	t.Log("not ok - JWKS unavailable isn't a token error")
+	{
+		server := httptest.NewServer(http.NotFoundHandler())
+		defer server.Close()
+		verifier := security.NewRemoteJWKSVerifier(security.RemoteJWKSConfig{URL: server.URL})
+		token, err := service.SignClaims(&buildClaims{})
+		require.NoError(t, err)
+
+		err = verifier.ParseClaims(context.Background(), token, &buildClaims{})
+		require.Error(t, err)
+		tokenErr := &security.TokenError{}
+		require.False(t, errors.As(err, &tokenErr))
+	}
+}